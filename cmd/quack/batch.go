@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pusher/quack/pkg/quack"
+	"github.com/spf13/cobra"
+)
+
+// newBatchCommand creates the batch subcommand, which renders a directory of
+// manifests without a cluster.
+func newBatchCommand(ah *quack.AdmissionHook) *cobra.Command {
+	var inputDir, outputDir, valuesFile string
+
+	cmd := &cobra.Command{
+		Use:   "batch",
+		Short: "Render a directory of manifests",
+		Long:  "Render each manifest in a directory as Quack would when it is created, using values from a file in place of the Values ConfigMap",
+		RunE: func(c *cobra.Command, args []string) error {
+			return batch(os.Stdout, ah, inputDir, outputDir, valuesFile)
+		},
+	}
+	cmd.Flags().StringVarP(&inputDir, "input-dir", "i", "", "Directory containing the manifests to render (YAML or JSON)")
+	cmd.Flags().StringVarP(&outputDir, "output-dir", "o", "", "Directory to write the rendered manifests to")
+	cmd.Flags().StringVar(&valuesFile, "values", "", "File containing the template values (YAML)")
+
+	return cmd
+}
+
+func batch(out io.Writer, ah *quack.AdmissionHook, inputDir string, outputDir string, valuesFile string) error {
+	if inputDir == "" || outputDir == "" {
+		return fmt.Errorf("--input-dir and --output-dir must be set")
+	}
+
+	valuesMap, err := readValuesConfigMap(ah, valuesFile)
+	if err != nil {
+		return err
+	}
+
+	changed, err := ah.RenderDirectory(inputDir, outputDir, valuesMap)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range changed {
+		fmt.Fprintf(out, "changed: %s\n", name)
+	}
+	fmt.Fprintf(out, "%d manifests changed\n", len(changed))
+	return nil
+}
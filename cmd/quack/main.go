@@ -2,13 +2,16 @@ package main
 
 import (
 	"flag"
+	"net/http"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/openshift/generic-admission-server/pkg/apiserver"
 	"github.com/openshift/generic-admission-server/pkg/cmd/server"
 	"github.com/pusher/quack/pkg/quack"
+	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	genericapiserver "k8s.io/apiserver/pkg/server"
 	"k8s.io/apiserver/pkg/util/logs"
@@ -23,15 +26,78 @@ func main() {
 	// Set flags to populate admission hook configuration
 	flagset.StringVarP(&ah.ValuesMapName, "values-configmap", "c", "quack-values", "Defines the name of the ConfigMap to load templating values from")
 	flagset.StringVarP(&ah.ValuesMapNamespace, "values-configmap-namespace", "n", "quack", "Defines the namespace to load the Values ConfigMap from")
-	flagset.StringVarP(&ah.RequiredAnnotation, "required-annotation", "a", "", "Require annotation on objects before templating them")
-	flagset.StringSliceVar(&ah.IgnoredPaths, "ignore-path", []string{}, "Ignore patches that are applied to this path")
+	flagset.StringSliceVar(&ah.ValuesMapNamespaces, "extra-values-configmap-namespace", []string{}, "Defines further namespaces to load the Values ConfigMap from, overriding the values-configmap-namespace, later namespaces take precedence")
+	flagset.StringVar(&ah.FallbackValuesMapName, "fallback-values-configmap", "", "Defines the name of a ConfigMap to load templating values from if the Values ConfigMap is empty")
+	flagset.StringSliceVar(&ah.ValuesMapOverlays, "values-configmap-overlay", []string{}, "Defines the names of ConfigMaps whose values override the Values ConfigMap, later overlays take precedence")
+	flagset.BoolVar(&ah.OptionalValuesMapOverlays, "optional-values-configmap-overlays", false, "Skip overlay ConfigMaps that don't exist, rather than rejecting requests")
+	flagset.BoolVar(&ah.NamespaceValues, "namespace-values", false, "Override values with those of the Values ConfigMap in the object's namespace, if it exists")
+	flagset.BoolVar(&ah.AllowMissingValues, "allow-missing-values", false, "Admit objects unchanged, rather than rejecting them, if the Values ConfigMap doesn't exist")
+	flagset.StringVar(&ah.ValuesSecretName, "values-secret", "", "Defines the name of a Secret to load templating values from, overriding values from the Values ConfigMap")
+	flagset.StringVar(&ah.ValuesSecretNamespace, "values-secret-namespace", "quack", "Defines the namespace to load the Values Secret from")
+	flagset.StringSliceVar(&ah.AllowedValuesNamespaces, "allowed-values-namespace", []string{}, "Restricts the namespaces values may be read from, including by the values-configmap-namespace annotation. If unset, the namespaces of the Values ConfigMap and Secret and of the object")
+	flagset.StringVarP(&ah.RequiredAnnotation, "required-annotation", "a", "", "Require annotation on objects before templating them, optionally with a value as name=value, overridden by the quack.required-annotation value")
+	flagset.BoolVar(&ah.WarnAnnotationMismatch, "warn-annotation-mismatch", false, "Warn when objects are skipped because the required annotation has the wrong value")
+	flagset.StringSliceVar(&ah.IgnoredPaths, "ignore-path", []string{}, "JSON Pointer to a path removed before templating, which is never patched")
+	flagset.StringSliceVar(&ah.DefaultsOnlyPaths, "defaults-only-paths", []string{}, "JSON Pointer to a path which is only patched if the object doesn't already set it")
+	flagset.StringVar(&ah.StatusPath, "status-path", "/status", "JSON Pointer to the status of objects, which is never patched unless kept by the quack.pusher.com/keep-status annotation")
+	flagset.StringVar(&ah.PartialsMapName, "partials-configmap", "", "Defines the name of the ConfigMap to load named templates from")
+	flagset.IntVar(&ah.MaxTemplateDepth, "max-template-depth", 0, "Reject objects whose partials invoke each other in a cycle or nest deeper than this, 0 for no limit")
+	flagset.IntVar(&ah.TemplateCacheSize, "template-cache-size", 0, "Cache this many parsed templates, reusing them for objects with identical content, 0 to disable caching")
+	flagset.DurationVar(&ah.RenderTimeout, "render-timeout", 2*time.Second, "Reject objects whose templates take longer than this to execute, 0 for no limit")
+	flagset.BoolVar(&ah.SkipUnchanged, "skip-unchanged-updates", false, "Skip updates that only change the generation or resourceVersion of an object")
+	flagset.BoolVar(&ah.VerboseResponses, "verbose-responses", false, "Explain why requests were skipped in admission responses")
+	flagset.StringVar(&ah.FailurePolicy, "failure-policy", "Fail", "Whether to reject (Fail) or admit unchanged (Ignore) objects that fail to template, overridden by namespace policies")
+	flagset.BoolVar(&ah.EventOnRenderError, "event-on-render-error", false, "Record a Warning Event on objects admitted unchanged by the Ignore failure policy, describing why they failed to template")
+	flagset.StringVar(&ah.WebhookConfigurationName, "webhook-configuration", "quack", "Name of the MutatingWebhookConfiguration to warn at startup if its failurePolicy is misaligned with --failure-policy, disabled if empty")
+	flagset.IntVar(&ah.FailureCode, "failure-code", http.StatusInternalServerError, "HTTP status code returned in the result of rejected requests")
+	flagset.IntVar(&ah.MaxPatchOps, "max-patch-ops", 0, "Reject requests whose patch would exceed this many operations, 0 for no limit")
+	flagset.IntVar(&ah.MaxAnnotations, "max-annotations", 0, "Reject objects with more than this many annotations of the annotation domain, 0 for no limit")
+	flagset.BoolVar(&ah.StrictValues, "strict-values", false, "Reject objects whose templates reference missing values, rather than rendering <no value>")
+	flagset.StringVar(&ah.StructuredValuesKey, "structured-values-key", "", "Key of the Values ConfigMap holding YAML of nested values, e.g. values.yaml")
+	flagset.StringVar(&ah.KeyStyle, "key-style", "", "Rename value keys for templates to camel (DB_HOST becomes dbHost) or screaming-snake (dbHost becomes DB_HOST) case")
+	flagset.BoolVar(&ah.DecompressValues, "decompress-values", false, "Decompress base64 encoded, gzipped values with keys ending in .gz")
+	flagset.BoolVar(&ah.DecodeValues, "decode-values", false, "Decode base64 encoded values with keys ending in .b64")
+	flagset.StringSliceVar(&ah.AllowedPatchPaths, "allowed-patch-paths", []string{}, "Only allow patches to paths under these prefixes")
+	flagset.StringSliceVar(&ah.IncludeKinds, "include-kinds", []string{}, "Kinds of object to template, as Kind or Kind.group")
+	flagset.StringSliceVar(&ah.ExcludeKinds, "exclude-kinds", []string{}, "Kinds of object not to template, as Kind or Kind.group")
+	flagset.StringVar(&ah.DefaultAction, "default-action", "", "Action for kinds neither included or excluded, template or skip (Default: skip if --include-kinds is set, otherwise template)")
+	flagset.StringVar(&ah.PatchMode, "patch-mode", "minimal", "Whether to patch only the changes made by templating, minimal, or replace every top level field with its rendered value, full-replace")
+	flagset.BoolVar(&ah.RecordPatch, "record-patch", false, "Record applied patches in the quack.pusher.com/patch annotation, exposing the prior patch to templates as .PriorPatch")
+	flagset.BoolVar(&ah.LenientDelimiters, "lenient-delimiters", false, "Template objects with invalid delimiter annotations using the default delimiters, rather than rejecting them")
+	flagset.BoolVar(&ah.RequireFullRender, "require-full-render", false, "Reject objects still containing the left delimiter once rendered, rather than warning")
+	flagset.BoolVar(&ah.EnableLookups, "enable-lookups", false, "Allow objects to template values from the object referenced by the quack.pusher.com/inherit-from annotation, and from other ConfigMaps and Secrets with the configMapData and lookup functions")
+	flagset.BoolVar(&ah.EnableSprig, "enable-sprig", true, "Make Sprig template functions available to templates")
+	flagset.StringVar(&ah.TemplateEngine, "template-engine", "text", "Template engine used unless overridden by the quack.pusher.com/engine annotation, text or html")
+	flagset.StringVar(&ah.ListItemFailure, "list-item-failure", "fail", "Whether to fail the request, or skip the item, when an item of a list fails to render, fail or skip")
+	flagset.StringSliceVar(&ah.DefaultAnnotations, "default-annotations", []string{}, "Annotations to add to objects that don't have them, given as key=template pairs")
+	flagset.StringSliceVar(&ah.DefaultLabels, "default-labels", []string{}, "Labels to add to objects that don't have them, given as key=template pairs")
+	flagset.BoolVar(&ah.TrackValueUsage, "track-value-usage", false, "Count the objects referencing each value in the quack_value_references_total metric")
+	flagset.StringSliceVar(&ah.DeprecatedKeys, "deprecated-keys", []string{}, "Warn when templates use deprecated values, given as old=new pairs of keys")
+	flagset.StringVar(&ah.AnnotationDomain, "annotation-domain", "quack.pusher.com", "Domain of the annotations configuring how objects are templated, e.g. the delimiter annotations")
+	flagset.StringSliceVar(&ah.LegacyAnnotations, "legacy-annotations", []string{}, "Treat legacy annotation names as their replacements, given as old=new pairs of annotations")
+	flagset.BoolVar(&ah.EnablePolicies, "enable-policies", false, "Read delimiters, required annotation and failure policy from the QuackPolicy in each namespace")
+	flagset.StringVar(&ah.LogFormat, "log-format", "text", "Format of per request logs, text or json. json writes one entry per request to stderr")
+	flagset.BoolVar(&ah.PatchLog, "patch-log", false, "Write a single line JSON record of each applied patch to stdout")
+	flagset.StringVar(&ah.WebhookResource, "webhook-resource", "admissionreviews", "Resource the webhook is served as, the webhook is served at /apis/quack.pusher.com/v1alpha1/<resource>")
+	flagset.StringVar(&ah.HealthBindAddress, "health-bind-address", "", "Address to serve health endpoints on, e.g. :8081, disabled if empty")
+	flagset.StringVar(&ah.MetricsBindAddress, "metrics-bind-address", "", "Address to serve metrics on, e.g. :8082, disabled if empty")
+	flagset.DurationVar(&ah.ValuesStaleAfter, "values-stale-after", 0, "Report values unhealthy if not loaded within this duration, 0 to disable")
+	flagset.DurationVar(&ah.ValuesRefreshInterval, "values-refresh-interval", 0, "Reload the Values ConfigMap at this interval instead of watching it, 0 to watch")
+	flagset.StringSliceVar(&ah.ExposedAnnotations, "expose-annotations", []string{}, "Object annotations to expose to templates under .Annotations")
+
+	// Subcommands share the admission hook configuration
+	subcommands := []*cobra.Command{
+		newReplayCommand(ah),
+		newBatchCommand(ah),
+		newRenderCommand(ah),
+	}
 
 	// Run server
-	runAdmissionServer(flagset, ah)
+	runAdmissionServer(flagset, subcommands, ah)
 }
 
 // Originally from: https://github.com/openshift/generic-admission-server/blob/v1.9.0/pkg/cmd/cmd.go
-func runAdmissionServer(flagset *pflag.FlagSet, admissionHooks ...apiserver.AdmissionHook) {
+func runAdmissionServer(flagset *pflag.FlagSet, subcommands []*cobra.Command, admissionHooks ...apiserver.AdmissionHook) {
 	logs.InitLogs()
 	defer logs.FlushLogs()
 
@@ -47,6 +113,7 @@ func runAdmissionServer(flagset *pflag.FlagSet, admissionHooks ...apiserver.Admi
 
 	// Add admission hook flags
 	cmd.PersistentFlags().AddFlagSet(flagset)
+	cmd.AddCommand(subcommands...)
 
 	// Flags for glog
 	cmd.PersistentFlags().AddGoFlagSet(flag.CommandLine)
@@ -56,4 +123,12 @@ func runAdmissionServer(flagset *pflag.FlagSet, admissionHooks ...apiserver.Admi
 	if err := cmd.Execute(); err != nil {
 		glog.Fatal(err)
 	}
+
+	// The server has stopped, so no more requests will be admitted, and the
+	// logs are flushed on return
+	for _, hook := range admissionHooks {
+		if summarizer, ok := hook.(interface{ LogSummary() }); ok {
+			summarizer.LogSummary()
+		}
+	}
 }
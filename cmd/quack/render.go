@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pusher/quack/pkg/quack"
+	"github.com/spf13/cobra"
+)
+
+// newRenderCommand creates the render subcommand, which renders a single
+// manifest without a cluster.
+func newRenderCommand(ah *quack.AdmissionHook) *cobra.Command {
+	var manifestFile, valuesFile string
+
+	cmd := &cobra.Command{
+		Use:   "render",
+		Short: "Render a manifest",
+		Long:  "Render a manifest as Quack would when it is created and print the rendered object and patch, using values from a file in place of the Values ConfigMap",
+		RunE: func(c *cobra.Command, args []string) error {
+			return render(os.Stdout, ah, manifestFile, valuesFile)
+		},
+	}
+	cmd.Flags().StringVarP(&manifestFile, "filename", "f", "", "File containing the manifest to render (YAML or JSON)")
+	cmd.Flags().StringVar(&valuesFile, "values", "", "File containing the template values (YAML)")
+
+	return cmd
+}
+
+func render(out io.Writer, ah *quack.AdmissionHook, manifestFile string, valuesFile string) error {
+	manifest, err := ioutil.ReadFile(manifestFile)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %v", err)
+	}
+
+	valuesMap, err := readValuesConfigMap(ah, valuesFile)
+	if err != nil {
+		return err
+	}
+
+	rendered, patch, err := ah.Render(manifest, valuesMap)
+	if err != nil {
+		return err
+	}
+
+	output := struct {
+		Object json.RawMessage `json:"object"`
+		Patch  json.RawMessage `json:"patch"`
+	}{
+		Object: json.RawMessage(rendered),
+		Patch:  json.RawMessage(patch),
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(output)
+}
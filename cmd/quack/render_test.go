@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pusher/quack/pkg/quack"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRender(t *testing.T) {
+	out := &bytes.Buffer{}
+	ah := &quack.AdmissionHook{ValuesMapNamespace: "quack"}
+	err := render(out, ah, "testdata/render/configmap.yaml", "testdata/render/values.yaml")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in render: %v", err)
+	}
+
+	assert.JSONEq(t, `{
+		"object": {
+			"apiVersion": "v1",
+			"kind": "ConfigMap",
+			"metadata": {"name": "cluster-info", "namespace": "kube-system"},
+			"data": {"cluster": "alpha", "domain": "alpha.example.com"}
+		},
+		"patch": [
+			{"op": "replace", "path": "/data/cluster", "value": "alpha"},
+			{"op": "replace", "path": "/data/domain", "value": "alpha.example.com"}
+		]
+	}`, out.String(), "Rendered object and patch should be printed")
+
+	err = render(out, ah, "testdata/render/missing.yaml", "testdata/render/values.yaml")
+	assert.NotNil(t, err, "Missing manifest should return an error")
+}
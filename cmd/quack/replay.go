@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/ghodss/yaml"
+	"github.com/pusher/quack/pkg/quack"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newReplayCommand creates the replay subcommand, which runs a recorded
+// AdmissionReview through the admission hook without a cluster.
+func newReplayCommand(ah *quack.AdmissionHook) *cobra.Command {
+	var reviewFile, valuesFile string
+
+	cmd := &cobra.Command{
+		Use:   "replay",
+		Short: "Replay a recorded AdmissionReview",
+		Long:  "Replay a recorded AdmissionReview through Quack and print the response, using values from a file in place of the Values ConfigMap",
+		RunE: func(c *cobra.Command, args []string) error {
+			return replay(os.Stdout, ah, reviewFile, valuesFile)
+		},
+	}
+	cmd.Flags().StringVarP(&reviewFile, "filename", "f", "", "File containing the recorded AdmissionReview (JSON)")
+	cmd.Flags().StringVar(&valuesFile, "values", "", "File containing the template values (YAML)")
+
+	return cmd
+}
+
+func replay(out io.Writer, ah *quack.AdmissionHook, reviewFile string, valuesFile string) error {
+	review, err := ioutil.ReadFile(reviewFile)
+	if err != nil {
+		return fmt.Errorf("failed to read admission review: %v", err)
+	}
+
+	valuesMap, err := readValuesConfigMap(ah, valuesFile)
+	if err != nil {
+		return err
+	}
+
+	resp, err := ah.Replay(review, valuesMap)
+	if err != nil {
+		return err
+	}
+
+	// Print the patch as JSON, rather than base64 encoded bytes
+	output := struct {
+		UID       string          `json:"uid"`
+		Allowed   bool            `json:"allowed"`
+		Result    *metav1.Status  `json:"status,omitempty"`
+		PatchType *string         `json:"patchType,omitempty"`
+		Patch     json.RawMessage `json:"patch,omitempty"`
+	}{
+		UID:     string(resp.UID),
+		Allowed: resp.Allowed,
+		Result:  resp.Result,
+		Patch:   json.RawMessage(resp.Patch),
+	}
+	if resp.PatchType != nil {
+		patchType := string(*resp.PatchType)
+		output.PatchType = &patchType
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(output)
+}
+
+// readValuesConfigMap reads the values from a YAML file into a Values
+// ConfigMap in the first of the values namespaces.
+// The file replaces all values from the cluster, so the admission hook is
+// configured to read values only from this ConfigMap.
+func readValuesConfigMap(ah *quack.AdmissionHook, valuesFile string) (*corev1.ConfigMap, error) {
+	ah.ValuesSecretName = ""
+	if ah.ValuesMapName == "" {
+		ah.ValuesMapName = "quack-values"
+	}
+
+	values := map[string]string{}
+	if valuesFile != "" {
+		valuesBytes, err := ioutil.ReadFile(valuesFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read values: %v", err)
+		}
+		err = yaml.Unmarshal(valuesBytes, &values)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal values: %v", err)
+		}
+	}
+
+	namespace := ah.ValuesMapNamespace
+	if namespace == "" {
+		namespace = "quack"
+	}
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ah.ValuesMapName,
+			Namespace: namespace,
+		},
+		Data: values,
+	}, nil
+}
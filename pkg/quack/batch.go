@@ -0,0 +1,133 @@
+package quack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ghodss/yaml"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// manifestExtensions are the extensions of files rendered by RenderDirectory.
+var manifestExtensions = []string{".yaml", ".yml", ".json"}
+
+// RenderDirectory renders each manifest in inputDir as if it were being
+// created, writing the rendered manifests to outputDir under the same name.
+// Requests for values are served from objects, which should include the
+// values ConfigMap.
+// Returns the names of the manifests which were changed by rendering.
+func (ah *AdmissionHook) RenderDirectory(inputDir string, outputDir string, objects ...runtime.Object) ([]string, error) {
+	err := ah.initialize(fake.NewSimpleClientset(objects...))
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(inputDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input directory: %v", err)
+	}
+	err = os.MkdirAll(outputDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
+
+	changed := []string{}
+	for _, file := range files {
+		if file.IsDir() || !contains(manifestExtensions, filepath.Ext(file.Name())) {
+			continue
+		}
+
+		manifest, err := ioutil.ReadFile(filepath.Join(inputDir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", file.Name(), err)
+		}
+		rendered, fileChanged, err := ah.renderManifest(manifest, filepath.Ext(file.Name()) == ".json")
+		if err != nil {
+			return nil, fmt.Errorf("failed to render %s: %v", file.Name(), err)
+		}
+		err = ioutil.WriteFile(filepath.Join(outputDir, file.Name()), rendered, file.Mode())
+		if err != nil {
+			return nil, fmt.Errorf("failed to write %s: %v", file.Name(), err)
+		}
+
+		if fileChanged {
+			changed = append(changed, file.Name())
+		}
+	}
+
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// renderManifest runs a YAML or JSON manifest through Admit as a create
+// request and applies the resulting patch.
+// Manifests which aren't changed are returned as they were read.
+func (ah *AdmissionHook) renderManifest(manifest []byte, outputJSON bool) ([]byte, bool, error) {
+	raw, resp, err := ah.admitManifest(manifest)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(resp.Patch) == 0 {
+		return manifest, false, nil
+	}
+
+	rendered, err := applyPatch(raw, resp.Patch)
+	if err != nil {
+		return nil, false, err
+	}
+	if outputJSON {
+		indented := []byte{}
+		indented, err = json.MarshalIndent(json.RawMessage(rendered), "", "  ")
+		return append(indented, '\n'), true, err
+	}
+	rendered, err = yaml.JSONToYAML(rendered)
+	return rendered, true, err
+}
+
+// admitManifest runs a YAML or JSON manifest through Admit as a create
+// request, returning the manifest as JSON and the response.
+// Denied requests are returned as an error.
+func (ah *AdmissionHook) admitManifest(manifest []byte) ([]byte, *admissionv1beta1.AdmissionResponse, error) {
+	raw, err := yaml.YAMLToJSON(manifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+
+	typeMeta := metav1.TypeMeta{}
+	err = json.Unmarshal(raw, &typeMeta)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read manifest type: %v", err)
+	}
+	objectMeta, err := getObjectMeta(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read manifest metadata: %v", err)
+	}
+
+	gvk := typeMeta.GroupVersionKind()
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID: types.UID(fmt.Sprintf("batch-%s", objectMeta.Name)),
+		Kind: metav1.GroupVersionKind{
+			Group:   gvk.Group,
+			Version: gvk.Version,
+			Kind:    gvk.Kind,
+		},
+		Namespace: objectMeta.Namespace,
+		Name:      objectMeta.Name,
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: raw,
+		},
+	})
+	if !resp.Allowed {
+		return nil, nil, fmt.Errorf("request denied: %s", resp.Result.Message)
+	}
+	return raw, resp, nil
+}
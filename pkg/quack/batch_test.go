@@ -0,0 +1,86 @@
+package quack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRenderDirectory(t *testing.T) {
+	valuesBytes, err := ioutil.ReadFile("testdata/batch/values.yaml")
+	if err != nil {
+		assert.FailNowf(t, "fileError", "Failed to read fixture: %v", err)
+	}
+	values := map[string]string{}
+	err = yaml.Unmarshal(valuesBytes, &values)
+	if err != nil {
+		assert.FailNowf(t, "yamlError", "Failed to unmarshal values: %v", err)
+	}
+
+	outputDir, err := ioutil.TempDir("", "quack-batch")
+	if err != nil {
+		assert.FailNowf(t, "fileError", "Failed to create output directory: %v", err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	ah := &AdmissionHook{
+		ValuesMapName:      "quack-values",
+		ValuesMapNamespace: "quack",
+	}
+	changed, err := ah.RenderDirectory("testdata/batch/manifests", outputDir, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "quack-values",
+			Namespace: "quack",
+		},
+		Data: values,
+	})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in RenderDirectory: %v", err)
+	}
+	assert.Equal(t, []string{"configmap.yaml"}, changed, "Only the templated manifest should be changed")
+
+	configMap, err := ioutil.ReadFile(filepath.Join(outputDir, "configmap.yaml"))
+	if err != nil {
+		assert.FailNowf(t, "fileError", "Failed to read output: %v", err)
+	}
+	assert.Equal(t, `apiVersion: v1
+data:
+  cluster: alpha
+  domain: alpha.example.com
+kind: ConfigMap
+metadata:
+  name: cluster-info
+  namespace: kube-system
+`, string(configMap), "Templated manifest should be rendered")
+
+	service, err := ioutil.ReadFile(filepath.Join(outputDir, "service.json"))
+	if err != nil {
+		assert.FailNowf(t, "fileError", "Failed to read output: %v", err)
+	}
+	original, err := ioutil.ReadFile("testdata/batch/manifests/service.json")
+	if err != nil {
+		assert.FailNowf(t, "fileError", "Failed to read fixture: %v", err)
+	}
+	assert.Equal(t, string(original), string(service), "Untemplated manifest should be copied unchanged")
+}
+
+func TestRenderDirectoryDenied(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "quack-batch")
+	if err != nil {
+		assert.FailNowf(t, "fileError", "Failed to create output directory: %v", err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	ah := &AdmissionHook{
+		ValuesMapName:      "quack-values",
+		ValuesMapNamespace: "quack",
+	}
+	_, err = ah.RenderDirectory("testdata/batch/manifests", outputDir)
+	assert.NotNil(t, err, "Missing values should return an error")
+}
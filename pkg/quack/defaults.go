@@ -0,0 +1,168 @@
+package quack
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultMetadataPatch renders the default annotations and labels the object
+// doesn't already have, returning a patch adding them, or nil if there are
+// none to add.
+// Existing annotations and labels are never overwritten.
+func defaultMetadataPatch(log requestLogger, object []byte, data interface{}, opts templateOptions, annotations map[string]string, labels map[string]string) ([]byte, error) {
+	objectMeta, err := getObjectMeta(object)
+	if err != nil {
+		return nil, fmt.Errorf("error reading object metadata: %v", err)
+	}
+
+	ops := []map[string]interface{}{}
+	annotationOps, err := defaultMapOps(log, "annotations", objectMeta.Annotations, data, opts, annotations)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, annotationOps...)
+	labelOps, err := defaultMapOps(log, "labels", objectMeta.Labels, data, opts, labels)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, labelOps...)
+
+	if len(ops) == 0 {
+		return nil, nil
+	}
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling defaults: %v", err)
+	}
+	return patch, nil
+}
+
+// defaultMapOps returns operations adding the rendered defaults missing from
+// the existing metadata field.
+func defaultMapOps(log requestLogger, field string, existing map[string]string, data interface{}, opts templateOptions, defaults map[string]string) ([]map[string]interface{}, error) {
+	keys := []string{}
+	for key := range defaults {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	rendered := make(map[string]string)
+	for _, key := range keys {
+		if _, ok := existing[key]; ok {
+			log.Infof(4, "Not adding default %s %s, already set", field, key)
+			continue
+		}
+		value, err := renderTemplate([]byte(defaults[key]), data, opts)
+		if err != nil {
+			return nil, fmt.Errorf("error rendering default %s %s: %v", field, key, err)
+		}
+		rendered[key] = string(value)
+	}
+
+	if len(rendered) == 0 {
+		return nil, nil
+	}
+
+	// Add the whole map if the object has none
+	path := fmt.Sprintf("/metadata/%s", field)
+	if existing == nil {
+		return []map[string]interface{}{
+			{"op": "add", "path": path, "value": rendered},
+		}, nil
+	}
+
+	ops := []map[string]interface{}{}
+	for _, key := range keys {
+		if value, ok := rendered[key]; ok {
+			ops = append(ops, map[string]interface{}{
+				"op":    "add",
+				"path":  fmt.Sprintf("%s/%s", path, escapeJSONPointer(key)),
+				"value": value,
+			})
+		}
+	}
+	return ops, nil
+}
+
+// defaultsOnlyPatch removes the operations on each of the paths, or within
+// them, if the path is already set in the original object, so those fields
+// are only patched when absent.
+func defaultsOnlyPatch(log requestLogger, original []byte, patch []byte, paths []string) ([]byte, error) {
+	var object interface{}
+	err := json.Unmarshal(original, &object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal object: %v", err)
+	}
+
+	ops := []json.RawMessage{}
+	err = json.Unmarshal(patch, &ops)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal patch: %v", err)
+	}
+
+	filtered := []json.RawMessage{}
+	for _, op := range ops {
+		parsed := struct {
+			Path string `json:"path"`
+		}{}
+		err = json.Unmarshal(op, &parsed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal operation: %v", err)
+		}
+		if path, ok := defaultsOnlyPath(parsed.Path, paths); ok && pathExists(object, path) {
+			log.Infof(4, "Not patching %s, %s already set", parsed.Path, path)
+			continue
+		}
+		filtered = append(filtered, op)
+	}
+
+	filteredPatch, err := json.Marshal(filtered)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling patch: %v", err)
+	}
+	return filteredPatch, nil
+}
+
+// defaultsOnlyPath returns the path of paths that the operation path is equal
+// to or within.
+func defaultsOnlyPath(opPath string, paths []string) (string, bool) {
+	for _, path := range paths {
+		path = strings.TrimSuffix(path, "/")
+		if opPath == path || strings.HasPrefix(opPath, path+"/") {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// pathExists determines whether the JSON Pointer refers to a value within the
+// unmarshalled object.
+func pathExists(object interface{}, path string) bool {
+	if path == "" {
+		return true
+	}
+	current := object
+	for _, token := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+		switch value := current.(type) {
+		case map[string]interface{}:
+			next, ok := value[token]
+			if !ok {
+				return false
+			}
+			current = next
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(value) {
+				return false
+			}
+			current = value[index]
+		default:
+			return false
+		}
+	}
+	return true
+}
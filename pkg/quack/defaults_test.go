@@ -0,0 +1,146 @@
+package quack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestDefaultMetadataPatch(t *testing.T) {
+	annotations := map[string]string{
+		"example.com/cluster": "{{ .ClusterName }}",
+		"example.com/owner":   "platform",
+	}
+	labels := map[string]string{
+		"cluster": "{{ .ClusterName }}",
+	}
+	values := map[string]string{"ClusterName": "alpha"}
+
+	patch, err := defaultMetadataPatch(requestLogger{}, []byte(`{"metadata": {"annotations": {"example.com/owner": "team-a"}}}`), values, templateOptions{}, annotations, labels)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in defaultMetadataPatch: %v", err)
+	}
+	assert.JSONEq(t, `[
+		{"op": "add", "path": "/metadata/annotations/example.com~1cluster", "value": "alpha"},
+		{"op": "add", "path": "/metadata/labels", "value": {"cluster": "alpha"}}
+	]`, string(patch), "Only missing defaults should be added")
+
+	patch, err = defaultMetadataPatch(requestLogger{}, []byte(`{"metadata": {"annotations": {"example.com/owner": "team-a", "example.com/cluster": "beta"}, "labels": {"cluster": "beta"}}}`), values, templateOptions{}, annotations, labels)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in defaultMetadataPatch: %v", err)
+	}
+	assert.Nil(t, patch, "Existing annotations and labels should not be overwritten")
+
+	_, err = defaultMetadataPatch(requestLogger{}, []byte(`{"metadata": {}}`), values, templateOptions{}, map[string]string{"a": "{{ .A "}, nil)
+	assert.NotNil(t, err, "Invalid default template should return an error")
+}
+
+func TestAdmitDefaultMetadata(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"ClusterName": "alpha"})
+	ah.DefaultAnnotations = []string{"example.com/cluster={{ .ClusterName }}"}
+	ah.DefaultLabels = []string{"cluster={{ .ClusterName }}"}
+	err := ah.initialize(ah.client)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in initialize: %v", err)
+	}
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "labels": {"cluster": "beta"}}, "a": "{{ .ClusterName }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/a", "value": "alpha"},
+		{"op": "add", "path": "/metadata/annotations", "value": {"example.com/cluster": "alpha"}}
+	]`, string(resp.Patch), "Missing defaults should be added after the computed patch")
+}
+
+func TestInitializeInvalidDefaults(t *testing.T) {
+	ah := &AdmissionHook{DefaultLabels: []string{"cluster"}}
+	err := ah.initialize(nil)
+	assert.NotNil(t, err, "Default without a template should return an error")
+}
+
+func TestDefaultsOnlyPatch(t *testing.T) {
+	original := []byte(`{"metadata": {"name": "foo", "labels": {"app": "foo"}}, "spec": {"containers": [{"name": "a"}]}}`)
+	patch := []byte(`[
+		{"op": "add", "path": "/metadata/labels/app", "value": "bar"},
+		{"op": "add", "path": "/metadata/labels/team", "value": "platform"},
+		{"op": "add", "path": "/spec/replicas", "value": 2},
+		{"op": "add", "path": "/spec/containers/0/image", "value": "nginx"}
+	]`)
+
+	filtered, err := defaultsOnlyPatch(requestLogger{}, original, patch, []string{"/metadata/labels/app", "/metadata/labels/team", "/spec/replicas/"})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in defaultsOnlyPatch: %v", err)
+	}
+	assert.JSONEq(t, `[
+		{"op": "add", "path": "/metadata/labels/team", "value": "platform"},
+		{"op": "add", "path": "/spec/replicas", "value": 2},
+		{"op": "add", "path": "/spec/containers/0/image", "value": "nginx"}
+	]`, string(filtered), "Only operations on unset defaults only paths should be kept")
+
+	filtered, err = defaultsOnlyPatch(requestLogger{}, original, patch, []string{"/spec/containers/0"})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in defaultsOnlyPatch: %v", err)
+	}
+	assert.JSONEq(t, `[
+		{"op": "add", "path": "/metadata/labels/app", "value": "bar"},
+		{"op": "add", "path": "/metadata/labels/team", "value": "platform"},
+		{"op": "add", "path": "/spec/replicas", "value": 2}
+	]`, string(filtered), "Operations within a set defaults only path should be dropped")
+}
+
+func TestPathExists(t *testing.T) {
+	object := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{"example.com/owner": "team-a"},
+		},
+		"items": []interface{}{"a"},
+	}
+	assert.True(t, pathExists(object, ""), "Root should exist")
+	assert.True(t, pathExists(object, "/metadata/annotations/example.com~1owner"), "Escaped keys should exist")
+	assert.True(t, pathExists(object, "/items/0"), "Array elements should exist")
+	assert.False(t, pathExists(object, "/items/1"), "Out of range elements should not exist")
+	assert.False(t, pathExists(object, "/metadata/labels"), "Missing keys should not exist")
+	assert.False(t, pathExists(object, "/items/0/name"), "Paths within strings should not exist")
+}
+
+func TestAdmitDefaultsOnlyPaths(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"ClusterName": "alpha"})
+	ah.DefaultsOnlyPaths = []string{"/metadata/labels/cluster"}
+	ah.DefaultLabels = []string{"cluster={{ .ClusterName }}"}
+	err := ah.initialize(ah.client)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in initialize: %v", err)
+	}
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "present-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "labels": {"cluster": "{{ .ClusterName }}"}}, "a": "{{ .ClusterName }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/a", "value": "alpha"}
+	]`, string(resp.Patch), "Set defaults only paths should not be patched")
+
+	resp = ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "absent-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "labels": {}}}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[
+		{"op": "add", "path": "/metadata/labels/cluster", "value": "alpha"}
+	]`, string(resp.Patch), "Unset defaults only paths should be patched")
+}
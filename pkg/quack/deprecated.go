@@ -0,0 +1,111 @@
+package quack
+
+import (
+	"fmt"
+	"html/template"
+	"sort"
+	texttemplate "text/template"
+	"text/template/parse"
+)
+
+// deprecatedKeyWarnings returns a warning for each deprecated key referenced
+// by the input or its partials, suggesting the replacement.
+// Only references to fields of the top level of the template data, e.g.
+// `.OldKey` or `$.OldKey`, are detected.
+func deprecatedKeyWarnings(input []byte, opts templateOptions, deprecatedKeys map[string]string) ([]string, error) {
+	referenced, err := templateKeys(input, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	warnings := []string{}
+	for key := range referenced {
+		if replacement, ok := deprecatedKeys[key]; ok {
+			warnings = append(warnings, fmt.Sprintf("Value %s is deprecated, use %s instead", key, replacement))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings, nil
+}
+
+// templateKeys returns the top level fields of the template data referenced
+// by the input or its partials.
+func templateKeys(input []byte, opts templateOptions) (map[string]bool, error) {
+	// text/template shares its syntax with html/template, so is used to parse
+	// templates for either engine
+	funcs := texttemplate.FuncMap{
+		"toJson":   func(interface{}) string { return "" },
+		"required": required,
+	}
+	for name, f := range opts.funcs {
+		funcs[name] = f
+	}
+	funcs = texttemplate.FuncMap(limitFuncs(template.FuncMap(funcs), opts.allowedFuncs))
+	tmpl := texttemplate.New("object").Delims(opts.delims.left, opts.delims.right).Funcs(funcs)
+	for name, partial := range opts.partials {
+		_, err := tmpl.New(name).Parse(partial)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse partial %s: %v", name, err)
+		}
+	}
+	_, err := tmpl.Parse(string(input))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %v", err)
+	}
+
+	referenced := make(map[string]bool)
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			referencedKeys(t.Tree.Root, referenced)
+		}
+	}
+	return referenced, nil
+}
+
+// referencedKeys records the top level fields referenced beneath the node.
+func referencedKeys(node parse.Node, referenced map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			referencedKeys(child, referenced)
+		}
+	case *parse.ActionNode:
+		referencedKeys(n.Pipe, referenced)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			referencedKeys(cmd, referenced)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			referencedKeys(arg, referenced)
+		}
+	case *parse.IfNode:
+		referencedBranchKeys(&n.BranchNode, referenced)
+	case *parse.RangeNode:
+		referencedBranchKeys(&n.BranchNode, referenced)
+	case *parse.WithNode:
+		referencedBranchKeys(&n.BranchNode, referenced)
+	case *parse.TemplateNode:
+		referencedKeys(n.Pipe, referenced)
+	case *parse.ChainNode:
+		referencedKeys(n.Node, referenced)
+	case *parse.FieldNode:
+		referenced[n.Ident[0]] = true
+	case *parse.VariableNode:
+		if n.Ident[0] == "$" && len(n.Ident) > 1 {
+			referenced[n.Ident[1]] = true
+		}
+	}
+}
+
+func referencedBranchKeys(n *parse.BranchNode, referenced map[string]bool) {
+	referencedKeys(n.Pipe, referenced)
+	referencedKeys(n.List, referenced)
+	referencedKeys(n.ElseList, referenced)
+}
@@ -0,0 +1,56 @@
+package quack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestDeprecatedKeyWarnings(t *testing.T) {
+	deprecatedKeys := map[string]string{
+		"Region": "AWSRegion",
+		"Zone":   "AWSZone",
+		"Unused": "Used",
+	}
+	input := []byte(`{"region": "{{ .Region }}", "zone": "{{ if true }}{{ $.Zone | printf "%s" }}{{ end }}", "new": "{{ .AWSRegion }}"}`)
+
+	warnings, err := deprecatedKeyWarnings(input, templateOptions{}, deprecatedKeys)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in deprecatedKeyWarnings: %v", err)
+	}
+	assert.Equal(t, []string{
+		"Value Region is deprecated, use AWSRegion instead",
+		"Value Zone is deprecated, use AWSZone instead",
+	}, warnings, "Referenced deprecated keys should produce warnings")
+
+	warnings, err = deprecatedKeyWarnings([]byte(`{"a": "{{ template "partial" . }}"}`), templateOptions{
+		partials: map[string]string{"partial": "{{ .Unused }}"},
+	}, deprecatedKeys)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in deprecatedKeyWarnings: %v", err)
+	}
+	assert.Equal(t, []string{"Value Unused is deprecated, use Used instead"}, warnings, "Deprecated keys in partials should produce warnings")
+}
+
+func TestAdmitDeprecatedKeys(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"Region": "eu-west-1"})
+	ah.DeprecatedKeys = []string{"Region=AWSRegion"}
+	ah.VerboseResponses = true
+	err := ah.initialize(ah.client)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in initialize: %v", err)
+	}
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {}}, "region": "{{ .Region }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request using a deprecated key should be allowed")
+	assert.JSONEq(t, `[{"op": "replace", "path": "/region", "value": "eu-west-1"}]`, string(resp.Patch), "Deprecated key should still be templated")
+	assert.Equal(t, "Value Region is deprecated, use AWSRegion instead", resp.Result.Message, "Response should warn about the deprecated key")
+}
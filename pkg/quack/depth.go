@@ -0,0 +1,67 @@
+package quack
+
+import (
+	"fmt"
+	"strings"
+	"text/template/parse"
+)
+
+// checkTemplateDepth ensures named templates invoked from the root template,
+// directly or through other named templates, are nested no deeper than
+// maxDepth.
+// Templates that invoke themselves, directly or through others, would nest
+// without limit, so are rejected as a cycle.
+func checkTemplateDepth(trees map[string]*parse.Tree, root string, maxDepth int) error {
+	return checkTemplateChain(trees, []string{root}, maxDepth)
+}
+
+// checkTemplateChain checks the templates invoked by the last template in the
+// chain of invocations.
+func checkTemplateChain(trees map[string]*parse.Tree, chain []string, maxDepth int) error {
+	tree := trees[chain[len(chain)-1]]
+	if tree == nil {
+		return nil
+	}
+
+	for _, name := range invokedTemplates(tree.Root) {
+		next := append(append([]string{}, chain...), name)
+		if contains(chain, name) {
+			return fmt.Errorf("templates invoke each other in a cycle: %s", strings.Join(next, " -> "))
+		}
+		if len(next)-1 > maxDepth {
+			return fmt.Errorf("templates are nested deeper than the maximum depth of %d: %s", maxDepth, strings.Join(next, " -> "))
+		}
+		err := checkTemplateChain(trees, next, maxDepth)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// invokedTemplates returns the names of the templates invoked by
+// `{{ template "name" }}` actions within the node.
+func invokedTemplates(node parse.Node) []string {
+	names := []string{}
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return names
+		}
+		for _, child := range n.Nodes {
+			names = append(names, invokedTemplates(child)...)
+		}
+	case *parse.IfNode:
+		names = append(names, invokedTemplates(n.List)...)
+		names = append(names, invokedTemplates(n.ElseList)...)
+	case *parse.RangeNode:
+		names = append(names, invokedTemplates(n.List)...)
+		names = append(names, invokedTemplates(n.ElseList)...)
+	case *parse.WithNode:
+		names = append(names, invokedTemplates(n.List)...)
+		names = append(names, invokedTemplates(n.ElseList)...)
+	case *parse.TemplateNode:
+		names = append(names, n.Name)
+	}
+	return names
+}
@@ -0,0 +1,49 @@
+package quack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderTemplateMaxDepth(t *testing.T) {
+	partials := map[string]string{
+		"a": `{{ template "b" . }}`,
+		"b": `{{ if .B }}{{ template "c" . }}{{ end }}`,
+		"c": `{{ range .Items }}{{ template "d" . }}{{ end }}`,
+		"d": `deep`,
+	}
+	input := []byte(`{"a": "{{ template "a" . }}"}`)
+	data := map[string]interface{}{"B": true, "Items": []string{"x"}}
+
+	for _, engine := range []string{engineText, engineHTML} {
+		output, err := renderTemplate(input, data, templateOptions{engine: engine, partials: partials, maxDepth: 4})
+		if err != nil {
+			assert.FailNowf(t, "methodError", "Error in renderTemplate: %v", err)
+		}
+		assert.Equal(t, `{"a": "deep"}`, string(output), "Partials nested within the limit should render with %s", engine)
+
+		_, err = renderTemplate(input, data, templateOptions{engine: engine, partials: partials, maxDepth: 3})
+		if assert.NotNil(t, err, "Partials nested beyond the limit should return an error with %s", engine) {
+			assert.Contains(t, err.Error(), "object -> a -> b -> c -> d", "Error should name the chain of partials")
+		}
+	}
+}
+
+func TestRenderTemplateCycle(t *testing.T) {
+	partials := map[string]string{
+		"a": `{{ template "b" . }}`,
+		"b": `{{ with .B }}{{ else }}{{ template "a" . }}{{ end }}`,
+	}
+	input := []byte(`{"a": "{{ template "a" . }}"}`)
+
+	for _, engine := range []string{engineText, engineHTML} {
+		_, err := renderTemplate(input, nil, templateOptions{engine: engine, partials: partials, maxDepth: 100})
+		if assert.NotNil(t, err, "Partials invoking each other should return an error with %s", engine) {
+			assert.Contains(t, err.Error(), "cycle: object -> a -> b -> a", "Error should name the cycle")
+		}
+	}
+
+	_, err := renderTemplate([]byte(`{{ template "object" . }}`), nil, templateOptions{maxDepth: 100})
+	assert.NotNil(t, err, "Template invoking itself should return an error")
+}
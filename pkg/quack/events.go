@@ -0,0 +1,76 @@
+package quack
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	eventComponent          = "quack"
+	eventReasonFailedRender = "FailedTemplating"
+	eventDefaultNamespace   = "default"
+)
+
+// recordFailureEvent records a Warning Event on the object of a request that
+// failed to template, so its authors can see why with `kubectl describe`.
+// Events for cluster scoped objects are recorded in the default namespace.
+// Failing to record the event is logged, and otherwise ignored.
+func (ah *AdmissionHook) recordFailureEvent(req *admissionv1beta1.AdmissionRequest, message string) {
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = eventDefaultNamespace
+	}
+	name := req.Name
+	generateName := ""
+	uid := req.UID
+	if objectMeta, err := getObjectMeta(req.Object.Raw); err == nil {
+		// The name is not set on requests for objects with a generated name
+		if name == "" {
+			name = objectMeta.Name
+		}
+		generateName = objectMeta.GenerateName
+		uid = objectMeta.UID
+	}
+	// Objects with a generated name aren't named until after admission, so
+	// their events are named after the prefix, or else the kind
+	eventPrefix := name
+	if eventPrefix == "" {
+		eventPrefix = strings.TrimRight(generateName, "-.")
+	}
+	if eventPrefix == "" {
+		eventPrefix = strings.ToLower(req.Kind.Kind)
+	}
+
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			// Named as by client-go's event recorder
+			Name:      fmt.Sprintf("%s.%x", eventPrefix, now.UnixNano()),
+			Namespace: namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: metav1.GroupVersion{Group: req.Kind.Group, Version: req.Kind.Version}.String(),
+			Kind:       req.Kind.Kind,
+			Namespace:  req.Namespace,
+			Name:       name,
+			UID:        uid,
+		},
+		Reason:         eventReasonFailedRender,
+		Message:        message,
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: eventComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	_, err := ah.client.CoreV1().Events(namespace).Create(event)
+	if err != nil {
+		glog.Errorf("Failed to record event for %s %s: %v", req.Kind.Kind, podID(req.Namespace, name), err)
+	}
+}
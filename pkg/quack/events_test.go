@@ -0,0 +1,84 @@
+package quack
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestAdmitEventOnRenderError(t *testing.T) {
+	req := &admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+		Namespace: "team-a",
+		Name:      "foo",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "namespace": "team-a"}, "a": "{{ .A "}`),
+		},
+	}
+
+	for failurePolicy, events := range map[string]int{failurePolicyIgnore: 1, failurePolicyFail: 0} {
+		ah := newTestAdmissionHook(map[string]string{})
+		ah.FailurePolicy = failurePolicy
+		ah.EventOnRenderError = true
+
+		ah.Admit(req)
+		eventList, err := ah.client.CoreV1().Events("team-a").List(metav1.ListOptions{})
+		if err != nil {
+			assert.FailNowf(t, "methodError", "Error listing events: %v", err)
+		}
+		if !assert.Len(t, eventList.Items, events, "Failure policy %s should record %d events", failurePolicy, events) || events == 0 {
+			continue
+		}
+
+		event := eventList.Items[0]
+		assert.Equal(t, corev1.EventTypeWarning, event.Type, "Event should be a warning")
+		assert.Equal(t, eventReasonFailedRender, event.Reason, "Event should have the failed render reason")
+		assert.Contains(t, event.Message, "Error rendering template", "Event should describe the error")
+		assert.Equal(t, corev1.ObjectReference{
+			APIVersion: "apps/v1",
+			Kind:       "Deployment",
+			Namespace:  "team-a",
+			Name:       "foo",
+		}, event.InvolvedObject, "Event should refer to the object")
+	}
+
+	ah := newTestAdmissionHook(map[string]string{})
+	ah.FailurePolicy = failurePolicyIgnore
+	ah.Admit(req)
+	eventList, err := ah.client.CoreV1().Events("team-a").List(metav1.ListOptions{})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error listing events: %v", err)
+	}
+	assert.Empty(t, eventList.Items, "Events should not be recorded unless enabled")
+}
+
+func TestRecordFailureEventGeneratedName(t *testing.T) {
+	for raw, prefix := range map[string]string{
+		`{"metadata": {"generateName": "foo-"}}`: "foo.",
+		`{"metadata": {}}`:                       "deployment.",
+	} {
+		ah := newTestAdmissionHook(map[string]string{})
+		ah.recordFailureEvent(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			Namespace: "team-a",
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: []byte(raw)},
+		}, "Error rendering template")
+
+		eventList, err := ah.client.CoreV1().Events("team-a").List(metav1.ListOptions{})
+		if err != nil {
+			assert.FailNowf(t, "methodError", "Error listing events: %v", err)
+		}
+		if assert.Len(t, eventList.Items, 1, "Event should be recorded for objects without a name") {
+			assert.True(t, strings.HasPrefix(eventList.Items[0].Name, prefix), "Event %s should be named after %q", eventList.Items[0].Name, prefix)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package quack
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// checkWebhookFailurePolicy warns if the failurePolicy of the webhooks in the
+// WebhookConfigurationName is misaligned with the FailurePolicy.
+// The check is skipped if Quack isn't allowed to read the configuration.
+func (ah *AdmissionHook) checkWebhookFailurePolicy() {
+	if ah.WebhookConfigurationName == "" {
+		return
+	}
+
+	config, err := ah.client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().Get(ah.WebhookConfigurationName, metav1.GetOptions{})
+	if apierrors.IsForbidden(err) || apierrors.IsNotFound(err) {
+		glog.V(2).Infof("Not checking webhook failure policy: %v", err)
+		return
+	}
+	if err != nil {
+		glog.Warningf("Failed to check webhook failure policy: %v", err)
+		return
+	}
+
+	for _, warning := range failurePolicyWarnings(ah.FailurePolicy, config.Webhooks) {
+		glog.Warning(warning)
+	}
+}
+
+// failurePolicyWarnings describes each webhook whose failurePolicy is
+// misaligned with Quack's failure policy.
+// Webhooks failing closed while Quack ignores failures block every object
+// whenever Quack is unavailable, for templating that isn't otherwise
+// required. Webhooks ignoring failures while Quack fails closed admit objects
+// untemplated whenever Quack is unavailable, though Quack would reject them.
+func failurePolicyWarnings(failurePolicy string, webhooks []admissionregistrationv1beta1.Webhook) []string {
+	if failurePolicy == "" {
+		failurePolicy = failurePolicyFail
+	}
+
+	warnings := []string{}
+	for _, webhook := range webhooks {
+		// The API server defaults the failurePolicy of v1beta1 webhooks to Ignore
+		webhookPolicy := admissionregistrationv1beta1.Ignore
+		if webhook.FailurePolicy != nil {
+			webhookPolicy = *webhook.FailurePolicy
+		}
+
+		switch {
+		case failurePolicy == failurePolicyIgnore && webhookPolicy == admissionregistrationv1beta1.Fail:
+			warnings = append(warnings, fmt.Sprintf("Webhook %s has failurePolicy %s but Quack's failure policy is %s: objects are rejected whenever Quack is unavailable, though Quack admits objects that fail to template", webhook.Name, webhookPolicy, failurePolicy))
+		case failurePolicy == failurePolicyFail && webhookPolicy == admissionregistrationv1beta1.Ignore:
+			warnings = append(warnings, fmt.Sprintf("Webhook %s has failurePolicy %s but Quack's failure policy is %s: objects are admitted untemplated whenever Quack is unavailable, though Quack rejects objects that fail to template", webhook.Name, webhookPolicy, failurePolicy))
+		}
+	}
+	return warnings
+}
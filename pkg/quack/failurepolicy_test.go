@@ -0,0 +1,46 @@
+package quack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+)
+
+func newTestWebhook(name string, failurePolicy *admissionregistrationv1beta1.FailurePolicyType) admissionregistrationv1beta1.Webhook {
+	return admissionregistrationv1beta1.Webhook{
+		Name:          name,
+		FailurePolicy: failurePolicy,
+	}
+}
+
+func TestFailurePolicyWarnings(t *testing.T) {
+	fail := admissionregistrationv1beta1.Fail
+	ignore := admissionregistrationv1beta1.Ignore
+
+	cases := []struct {
+		failurePolicy string
+		webhook       admissionregistrationv1beta1.Webhook
+		warnings      int
+	}{
+		{failurePolicyFail, newTestWebhook("fail", &fail), 0},
+		{"", newTestWebhook("fail", &fail), 0},
+		{failurePolicyIgnore, newTestWebhook("ignore", &ignore), 0},
+		{failurePolicyIgnore, newTestWebhook("fail", &fail), 1},
+		{failurePolicyFail, newTestWebhook("ignore", &ignore), 1},
+		{failurePolicyFail, newTestWebhook("unset", nil), 1},
+		{failurePolicyIgnore, newTestWebhook("unset", nil), 0},
+	}
+	for _, c := range cases {
+		warnings := failurePolicyWarnings(c.failurePolicy, []admissionregistrationv1beta1.Webhook{c.webhook})
+		assert.Len(t, warnings, c.warnings, "Failure policy %q with webhook %s should produce %d warnings", c.failurePolicy, c.webhook.Name, c.warnings)
+	}
+
+	warnings := failurePolicyWarnings(failurePolicyIgnore, []admissionregistrationv1beta1.Webhook{
+		newTestWebhook("a.quack.pusher.com", &fail),
+		newTestWebhook("b.quack.pusher.com", &ignore),
+	})
+	if assert.Len(t, warnings, 1, "Only misaligned webhooks should produce warnings") {
+		assert.Contains(t, warnings[0], "a.quack.pusher.com", "Warning should name the webhook")
+	}
+}
@@ -0,0 +1,333 @@
+package quack
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+
+	"github.com/Masterminds/sprig"
+	"github.com/ghodss/yaml"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	derivedValueLength     = 8
+	valueAnnotationPrefix  = "quack.pusher.com/value."
+	allowedFuncsAnnotation = "quack.pusher.com/allowed-funcs"
+)
+
+// templateFuncs returns the functions available to templates.
+// Sprig functions are included if enabled, though Quack's own functions take
+// precedence.
+func templateFuncs(enableSprig bool) template.FuncMap {
+	funcs := template.FuncMap{}
+	if enableSprig {
+		funcs = sprigFuncs()
+	}
+	funcs["fromJsonArray"] = fromJSONArray
+	funcs["urlQueryEscape"] = url.QueryEscape
+	funcs["urlPathEscape"] = url.PathEscape
+	funcs["jsonEscape"] = jsonEscape
+	funcs["toYaml"] = toYAML
+	funcs["fromYaml"] = fromYAML
+	funcs["indent"] = indent
+	funcs["nindent"] = nindent
+	return funcs
+}
+
+// allowedFuncs returns the names of the functions listed in the object's
+// allowedFuncsAnnotation in the annotation domain, or nil if unset, allowing
+// every function.
+func allowedFuncs(objectMeta metav1.ObjectMeta, domain string) map[string]bool {
+	allowed, ok := objectMeta.Annotations[domainAnnotation(allowedFuncsAnnotation, domain)]
+	if !ok {
+		return nil
+	}
+
+	names := map[string]bool{}
+	for _, name := range splitFields(allowed) {
+		names[name] = true
+	}
+	return names
+}
+
+// limitFuncs limits the functions to the allowed ones, if set.
+// Templates using any other function then fail to parse.
+func limitFuncs(funcs template.FuncMap, allowed map[string]bool) template.FuncMap {
+	if allowed == nil {
+		return funcs
+	}
+
+	limited := template.FuncMap{}
+	for name, f := range funcs {
+		if allowed[name] {
+			limited[name] = f
+		}
+	}
+	return limited
+}
+
+// sprigFuncs returns the Sprig functions, excluding those that would expose
+// the environment of the webhook to templates.
+func sprigFuncs() template.FuncMap {
+	funcs := template.FuncMap(sprig.TxtFuncMap())
+	delete(funcs, "env")
+	delete(funcs, "expandenv")
+	return funcs
+}
+
+// deriveFunc returns a function producing a stable, random looking value
+// from a seed and the identity of the object.
+// The identity is the object's kind, namespace and name, rather than its UID,
+// as the UID isn't set until the object is created, so creating, updating and
+// retrying requests for an object all derive the same value.
+func deriveFunc(kind metav1.GroupVersionKind, namespace string, name string) func(string) string {
+	identity := fmt.Sprintf("%s/%s/%s/%s", kind.Group, kind.Kind, namespace, name)
+
+	return func(seed string) string {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s", identity, seed)))
+		return hex.EncodeToString(sum[:])[:derivedValueLength]
+	}
+}
+
+// valueForFunc returns a function resolving a value from, in order of
+// precedence, the object's valueAnnotationPrefix annotations in the
+// annotation domain, the values configmap in the object's namespace, the
+// global values and finally an optional default.
+// The namespace configmap is only loaded if needed, at most once.
+func valueForFunc(client kubernetes.Interface, name string, namespace string, objectMeta metav1.ObjectMeta, domain string, values map[string]string) func(string, ...string) (string, error) {
+	prefix := domainAnnotation(valueAnnotationPrefix, domain)
+	var namespaceValues map[string]string
+	return func(key string, defaultValue ...string) (string, error) {
+		if len(defaultValue) > 1 {
+			return "", fmt.Errorf("valueFor accepts at most one default, got %d", len(defaultValue))
+		}
+
+		if value, ok := objectMeta.Annotations[prefix+key]; ok {
+			return value, nil
+		}
+
+		if namespaceValues == nil && namespace != "" {
+			cm, err := client.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				return "", fmt.Errorf("couldn't get configmap %s: %v", podID(namespace, name), err)
+			}
+			namespaceValues = map[string]string{}
+			if err == nil {
+				namespaceValues = cm.Data
+			}
+		}
+		if value, ok := namespaceValues[key]; ok {
+			return value, nil
+		}
+
+		if value, ok := values[key]; ok {
+			return value, nil
+		}
+
+		if len(defaultValue) == 1 {
+			return defaultValue[0], nil
+		}
+		return "", fmt.Errorf("no value for %s", key)
+	}
+}
+
+// configMapDataFunc returns a function fetching the data of a ConfigMap, so
+// its whole contents can be embedded in an object, e.g. with toJson.
+// Fetching other objects is only allowed if lookups are enabled, and if
+// authorize, given the resource, namespace and name, allows it.
+func configMapDataFunc(client kubernetes.Interface, enabled bool, authorize func(string, string, string) error) func(string, string) (map[string]string, error) {
+	return func(name string, namespace string) (map[string]string, error) {
+		if !enabled {
+			return nil, fmt.Errorf("lookups are disabled, set --enable-lookups to use configMapData")
+		}
+		err := authorize("configmaps", namespace, name)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get configmap %s: %v", podID(namespace, name), err)
+		}
+		cm, err := client.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get configmap %s: %v", podID(namespace, name), err)
+		}
+		data := cm.Data
+		if data == nil {
+			data = map[string]string{}
+		}
+		return data, nil
+	}
+}
+
+// lookupFunc returns a function fetching a single key of a ConfigMap or
+// Secret, given the kind, namespace, name and key, e.g.
+// `lookup "configmap" "infra" "endpoints" "db-host"`.
+// Missing objects and keys are errors, so the request is rejected.
+// Fetching other objects is only allowed if lookups are enabled, and if
+// authorize, given the resource, namespace and name, allows it.
+func lookupFunc(client kubernetes.Interface, enabled bool, authorize func(string, string, string) error) func(string, string, string, string) (string, error) {
+	return func(kind string, namespace string, name string, key string) (string, error) {
+		if !enabled {
+			return "", fmt.Errorf("lookups are disabled, set --enable-lookups to use lookup")
+		}
+
+		var value string
+		var ok bool
+		switch strings.ToLower(kind) {
+		case "configmap":
+			err := authorize("configmaps", namespace, name)
+			if err != nil {
+				return "", fmt.Errorf("couldn't get configmap %s: %v", podID(namespace, name), err)
+			}
+			cm, err := client.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+			if err != nil {
+				return "", fmt.Errorf("couldn't get configmap %s: %v", podID(namespace, name), err)
+			}
+			value, ok = cm.Data[key]
+		case "secret":
+			err := authorize("secrets", namespace, name)
+			if err != nil {
+				return "", fmt.Errorf("couldn't get secret %s: %v", podID(namespace, name), err)
+			}
+			secret, err := client.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+			if err != nil {
+				return "", fmt.Errorf("couldn't get secret %s: %v", podID(namespace, name), err)
+			}
+			var valueBytes []byte
+			valueBytes, ok = secret.Data[key]
+			value = string(valueBytes)
+		default:
+			return "", fmt.Errorf("can't lookup kind %q, must be configmap or secret", kind)
+		}
+		if !ok {
+			return "", fmt.Errorf("key %s not found in %s %s", key, strings.ToLower(kind), podID(namespace, name))
+		}
+		return value, nil
+	}
+}
+
+// hasGroupFunc returns a function determining whether the user making the
+// request is a member of a group.
+func hasGroupFunc(groups []string) func(string) bool {
+	return func(group string) bool {
+		return contains(groups, group)
+	}
+}
+
+// apiVersionIsFunc returns a function determining whether the object was
+// requested at an apiVersion, given as group/version, or version for the core
+// group.
+func apiVersionIsFunc(kind metav1.GroupVersionKind) func(string) bool {
+	apiVersion := kind.Version
+	if kind.Group != "" {
+		apiVersion = kind.Group + "/" + kind.Version
+	}
+	return func(version string) bool {
+		return version == apiVersion
+	}
+}
+
+// fromJSONArray parses a JSON array, such as a list stored in a configmap.
+func fromJSONArray(value string) ([]interface{}, error) {
+	array := []interface{}{}
+	err := json.Unmarshal([]byte(value), &array)
+	if err != nil {
+		return nil, fmt.Errorf("value is not a JSON array: %v", err)
+	}
+	return array, nil
+}
+
+// jsonEscape escapes a value for inclusion in a JSON string, so values
+// containing quotes, backslashes or control characters can't break the
+// rendered object.
+func jsonEscape(value string) string {
+	buff := new(bytes.Buffer)
+	encoder := json.NewEncoder(buff)
+	encoder.SetEscapeHTML(false)
+	// Encoding a string can't fail
+	encoder.Encode(value)
+	quoted := strings.TrimSuffix(buff.String(), "\n")
+	return quoted[1 : len(quoted)-1]
+}
+
+// toYAML renders a value, such as a structured value, as YAML, without a
+// trailing newline.
+func toYAML(value interface{}) (string, error) {
+	yamlBytes, err := yaml.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal value to YAML: %v", err)
+	}
+	return strings.TrimSuffix(string(yamlBytes), "\n"), nil
+}
+
+// fromYAML parses a value containing a YAML map.
+func fromYAML(value string) (map[string]interface{}, error) {
+	parsed := map[string]interface{}{}
+	err := yaml.Unmarshal([]byte(value), &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("value is not a YAML map: %v", err)
+	}
+	return parsed, nil
+}
+
+// indent prefixes every line of the value with spaces, as Sprig's indent, so
+// it is available when Sprig is disabled.
+func indent(spaces int, value string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.Replace(value, "\n", "\n"+pad, -1)
+}
+
+// nindent indents the value, starting it on a new line.
+func nindent(spaces int, value string) string {
+	return "\n" + indent(spaces, value)
+}
+
+// required returns the value, or an error with the message if the value is
+// missing or empty, failing the render.
+func required(message string, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, errors.New(message)
+	}
+	if s, ok := value.(string); ok && s == "" {
+		return nil, errors.New(message)
+	}
+	return value, nil
+}
+
+// jsonValues holds values rendered by toJson during a single render.
+// toJson renders a placeholder which is later replaced, along with the quotes
+// of the string it is rendered into, by the raw JSON of the value.
+// This allows arrays and objects to be inserted into string fields.
+type jsonValues struct {
+	values [][]byte
+}
+
+func (j *jsonValues) toJSON(value interface{}) (string, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal value: %v", err)
+	}
+	j.values = append(j.values, raw)
+	return jsonPlaceholder(len(j.values) - 1), nil
+}
+
+func (j *jsonValues) replace(output []byte) ([]byte, error) {
+	for i, raw := range j.values {
+		placeholder := jsonPlaceholder(i)
+		output = bytes.Replace(output, []byte(fmt.Sprintf("%q", placeholder)), raw, -1)
+		if bytes.Contains(output, []byte(placeholder)) {
+			return nil, fmt.Errorf("toJson must render the entire value of a string")
+		}
+	}
+	return output, nil
+}
+
+func jsonPlaceholder(index int) string {
+	return fmt.Sprintf("__quack_json_%d__", index)
+}
@@ -0,0 +1,143 @@
+package quack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// valuesStatus tracks when the values were last successfully loaded.
+type valuesStatus struct {
+	mutex     sync.RWMutex
+	refreshed time.Time
+}
+
+func (s *valuesStatus) markRefreshed(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.refreshed = now
+}
+
+func (s *valuesStatus) lastRefreshed() time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.refreshed
+}
+
+// valuesHealth is the body of the values health endpoint.
+type valuesHealth struct {
+	Refreshed  *time.Time `json:"refreshed,omitempty"`
+	AgeSeconds float64    `json:"ageSeconds"`
+	Stale      bool       `json:"stale"`
+}
+
+// checkValuesHealth reports the age of the values, which are stale if they
+// have not been loaded within ValuesStaleAfter, or have never been loaded.
+// The values are never stale if ValuesStaleAfter is 0.
+func (ah *AdmissionHook) checkValuesHealth(now time.Time) valuesHealth {
+	refreshed := ah.valuesStatus.lastRefreshed()
+	if refreshed.IsZero() {
+		return valuesHealth{
+			Stale: ah.ValuesStaleAfter > 0,
+		}
+	}
+
+	age := now.Sub(refreshed)
+	return valuesHealth{
+		Refreshed:  &refreshed,
+		AgeSeconds: age.Seconds(),
+		Stale:      ah.ValuesStaleAfter > 0 && age > ah.ValuesStaleAfter,
+	}
+}
+
+// ValuesHealthz serves the health of the values, responding 503 if stale.
+func (ah *AdmissionHook) ValuesHealthz(w http.ResponseWriter, r *http.Request) {
+	health := ah.checkValuesHealth(time.Now())
+
+	w.Header().Set("Content-Type", "application/json")
+	if health.Stale {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	err := json.NewEncoder(w).Encode(health)
+	if err != nil {
+		glog.Errorf("Failed to write values health: %v", err)
+	}
+}
+
+// Healthz responds 200 whenever Quack is serving.
+func (ah *AdmissionHook) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// Readyz responds 200 once Quack has been initialized and the values have been
+// loaded at least once, and 503 otherwise.
+// Until the values have been loaded by the values cache, each check attempts
+// to read them, so readiness reflects whether the values can be read.
+func (ah *AdmissionHook) Readyz(w http.ResponseWriter, r *http.Request) {
+	err := ah.checkReady()
+	if err != nil {
+		glog.V(2).Infof("Not ready: %v", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "not ready: %v\n", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// checkReady returns an error if Quack isn't ready to template requests.
+func (ah *AdmissionHook) checkReady() error {
+	if atomic.LoadInt32(&ah.initialized) == 0 {
+		return fmt.Errorf("not initialized")
+	}
+	if !ah.valuesStatus.lastRefreshed().IsZero() {
+		return nil
+	}
+
+	// Reading the values doesn't refresh them, as the values health reports
+	// whether the values cache is being kept up to date
+	_, _, err := ah.loadValues(requestLogger{}, metav1.ObjectMeta{}, "", authenticationv1.UserInfo{}, ah.getMapValues)
+	if err != nil {
+		return fmt.Errorf("failed to load values: %v", err)
+	}
+	return nil
+}
+
+// markInitialized records that Initialize succeeded.
+func (ah *AdmissionHook) markInitialized() {
+	atomic.StoreInt32(&ah.initialized, 1)
+}
+
+// serveHealth serves the health endpoints on the HealthBindAddress until
+// stopCh is closed.
+func (ah *AdmissionHook) serveHealth(stopCh <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", ah.Healthz)
+	mux.HandleFunc("/healthz/values", ah.ValuesHealthz)
+	mux.HandleFunc("/readyz", ah.Readyz)
+	server := &http.Server{
+		Addr:    ah.HealthBindAddress,
+		Handler: mux,
+	}
+
+	go func() {
+		<-stopCh
+		server.Close()
+	}()
+
+	glog.Infof("Serving health endpoints at %s", ah.HealthBindAddress)
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		glog.Errorf("Health server failed: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package quack
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestCheckValuesHealth(t *testing.T) {
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	ah := &AdmissionHook{ValuesStaleAfter: 10 * time.Minute}
+
+	health := ah.checkValuesHealth(now)
+	assert.True(t, health.Stale, "Values never loaded should be stale")
+	assert.Nil(t, health.Refreshed, "Values never loaded should have no refresh time")
+
+	ah.valuesStatus.markRefreshed(now.Add(-5 * time.Minute))
+	health = ah.checkValuesHealth(now)
+	assert.False(t, health.Stale, "Recently loaded values should be fresh")
+	assert.Equal(t, float64(300), health.AgeSeconds, "Age should be time since last refresh")
+
+	ah.valuesStatus.markRefreshed(now.Add(-15 * time.Minute))
+	health = ah.checkValuesHealth(now)
+	assert.True(t, health.Stale, "Values older than the threshold should be stale")
+
+	ah.ValuesStaleAfter = 0
+	health = ah.checkValuesHealth(now)
+	assert.False(t, health.Stale, "Values should never be stale without a threshold")
+}
+
+func TestValuesHealthz(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.ValuesStaleAfter = time.Minute
+
+	recorder := httptest.NewRecorder()
+	ah.ValuesHealthz(recorder, httptest.NewRequest("GET", "/healthz/values", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code, "Values never loaded should be unhealthy")
+
+	ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`),
+		},
+	})
+
+	recorder = httptest.NewRecorder()
+	ah.ValuesHealthz(recorder, httptest.NewRequest("GET", "/healthz/values", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code, "Values loaded by a request should not refresh them")
+
+	ah.ValuesRefreshInterval = time.Hour
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ah.initializeValuesCache(stopCh)
+
+	recorder = httptest.NewRecorder()
+	ah.ValuesHealthz(recorder, httptest.NewRequest("GET", "/healthz/values", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code, "Values loaded by the snapshot should be healthy")
+
+	health := valuesHealth{}
+	err := json.Unmarshal(recorder.Body.Bytes(), &health)
+	if err != nil {
+		assert.FailNowf(t, "jsonError", "Failed to unmarshal health: %v", err)
+	}
+	assert.False(t, health.Stale, "Values loaded by the snapshot should not be stale")
+	assert.NotNil(t, health.Refreshed, "Health should include the refresh time")
+}
+
+func TestHealthz(t *testing.T) {
+	ah := &AdmissionHook{}
+
+	recorder := httptest.NewRecorder()
+	ah.Healthz(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code, "Health should always be ok")
+}
+
+func TestReadyz(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.ValuesMapName = "missing-values"
+
+	recorder := httptest.NewRecorder()
+	ah.Readyz(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code, "Quack should not be ready before initialization")
+
+	ah.markInitialized()
+	recorder = httptest.NewRecorder()
+	ah.Readyz(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code, "Quack should not be ready before values are loaded")
+
+	ah.ValuesMapName = "quack-values"
+	recorder = httptest.NewRecorder()
+	ah.Readyz(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code, "Quack should be ready once values are loaded")
+	assert.True(t, ah.valuesStatus.lastRefreshed().IsZero(), "Readiness checks should not mark values refreshed")
+}
@@ -0,0 +1,217 @@
+//go:build integration
+// +build integration
+
+package quack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	restclient "k8s.io/client-go/rest"
+)
+
+// The integration tests run against a real API server backed by etcd.
+// Binaries are found in the directory given by KUBEBUILDER_ASSETS, or by the
+// TEST_ASSET_ETCD and TEST_ASSET_KUBE_APISERVER environment variables,
+// following the conventions of envtest.
+var integrationConfig *restclient.Config
+
+func TestMain(m *testing.M) {
+	cp, err := startControlPlane()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start control plane: %v\n", err)
+		os.Exit(1)
+	}
+	integrationConfig = &restclient.Config{Host: cp.url}
+
+	code := m.Run()
+	cp.stop()
+	os.Exit(code)
+}
+
+type controlPlane struct {
+	dir       string
+	url       string
+	etcd      *exec.Cmd
+	apiServer *exec.Cmd
+}
+
+func startControlPlane() (*controlPlane, error) {
+	dir, err := ioutil.TempDir("", "quack-integration")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	cp := &controlPlane{dir: dir}
+
+	ports, err := freePorts(4)
+	if err != nil {
+		cp.stop()
+		return nil, err
+	}
+	etcdURL := fmt.Sprintf("http://127.0.0.1:%d", ports[0])
+	cp.url = fmt.Sprintf("http://127.0.0.1:%d", ports[2])
+
+	cp.etcd = exec.Command(assetPath("TEST_ASSET_ETCD", "etcd"),
+		"--data-dir="+filepath.Join(dir, "etcd"),
+		"--listen-client-urls="+etcdURL,
+		"--advertise-client-urls="+etcdURL,
+		fmt.Sprintf("--listen-peer-urls=http://127.0.0.1:%d", ports[1]),
+	)
+	cp.apiServer = exec.Command(assetPath("TEST_ASSET_KUBE_APISERVER", "kube-apiserver"),
+		"--etcd-servers="+etcdURL,
+		"--cert-dir="+filepath.Join(dir, "certs"),
+		"--insecure-bind-address=127.0.0.1",
+		fmt.Sprintf("--insecure-port=%d", ports[2]),
+		fmt.Sprintf("--secure-port=%d", ports[3]),
+		"--service-cluster-ip-range=10.0.0.0/24",
+		"--admission-control=AlwaysAdmit",
+	)
+
+	for _, cmd := range []*exec.Cmd{cp.etcd, cp.apiServer} {
+		cmd.Stdout = ioutil.Discard
+		cmd.Stderr = ioutil.Discard
+		err = cmd.Start()
+		if err != nil {
+			cp.stop()
+			return nil, fmt.Errorf("failed to start %s: %v", cmd.Path, err)
+		}
+	}
+
+	err = waitForHealthy(cp.url+"/healthz", time.Minute)
+	if err != nil {
+		cp.stop()
+		return nil, err
+	}
+	return cp, nil
+}
+
+func (cp *controlPlane) stop() {
+	for _, cmd := range []*exec.Cmd{cp.apiServer, cp.etcd} {
+		if cmd != nil && cmd.Process != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+	}
+	os.RemoveAll(cp.dir)
+}
+
+func assetPath(env string, binary string) string {
+	if path := os.Getenv(env); path != "" {
+		return path
+	}
+	if dir := os.Getenv("KUBEBUILDER_ASSETS"); dir != "" {
+		return filepath.Join(dir, binary)
+	}
+	return filepath.Join("/usr/local/kubebuilder/bin", binary)
+}
+
+func freePorts(count int) ([]int, error) {
+	ports := []int{}
+	for i := 0; i < count; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, fmt.Errorf("failed to find free port: %v", err)
+		}
+		defer listener.Close()
+		ports = append(ports, listener.Addr().(*net.TCPAddr).Port)
+	}
+	return ports, nil
+}
+
+func waitForHealthy(url string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out waiting for %s", url)
+}
+
+// newIntegrationAdmissionHook initializes an AdmissionHook against the API
+// server, reading values from a fresh namespace.
+func newIntegrationAdmissionHook(t *testing.T, name string, stopCh <-chan struct{}) (*AdmissionHook, kubernetes.Interface) {
+	client, err := kubernetes.NewForConfig(integrationConfig)
+	if err != nil {
+		assert.FailNowf(t, "clientError", "Failed to create client: %v", err)
+	}
+	_, err = client.CoreV1().Namespaces().Create(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+	})
+	if err != nil {
+		assert.FailNowf(t, "clientError", "Failed to create namespace: %v", err)
+	}
+
+	ah := &AdmissionHook{
+		ValuesMapName:      "quack-values",
+		ValuesMapNamespace: name,
+	}
+	err = ah.Initialize(integrationConfig, stopCh)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in Initialize: %v", err)
+	}
+	return ah, client
+}
+
+func TestIntegrationAdmitPatchesObject(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ah, client := newIntegrationAdmissionHook(t, "quack-patch", stopCh)
+
+	_, err := client.CoreV1().ConfigMaps("quack-patch").Create(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "quack-values"},
+		Data: map[string]string{
+			"ClusterName": "alpha",
+		},
+	})
+	if err != nil {
+		assert.FailNowf(t, "clientError", "Failed to create configmap: %v", err)
+	}
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "data": {"host": "{{- .ClusterName -}}.example.com"}}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[{"op": "replace", "path": "/data/host", "value": "alpha.example.com"}]`, string(resp.Patch), "Patch should template values from the API server")
+}
+
+func TestIntegrationAdmitMissingConfigMap(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ah, _ := newIntegrationAdmissionHook(t, "quack-missing", stopCh)
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "data": {"host": "{{- .ClusterName -}}.example.com"}}`),
+		},
+	})
+	assert.False(t, resp.Allowed, "Request should be denied")
+	assert.Nil(t, resp.Patch, "Request should not be patched")
+	if assert.NotNil(t, resp.Result, "Denied request should have a result") {
+		assert.Contains(t, resp.Result.Message, "quack-values", "Result should name the missing configmap")
+	}
+}
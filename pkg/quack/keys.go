@@ -0,0 +1,92 @@
+package quack
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	keyStyleCamel          = "camel"
+	keyStyleScreamingSnake = "screaming-snake"
+)
+
+// validateKeyStyle checks the key style is known, or empty for no transform.
+func validateKeyStyle(style string) error {
+	switch style {
+	case "", keyStyleCamel, keyStyleScreamingSnake:
+		return nil
+	}
+	return fmt.Errorf("invalid key style %q, must be %q or %q", style, keyStyleCamel, keyStyleScreamingSnake)
+}
+
+// transformKeys renames the values to the key style, so templates can refer
+// to values by names other than those used in the Values ConfigMap.
+// Keys which would be renamed to the same name are an error.
+func transformKeys(values map[string]string, style string) (map[string]string, error) {
+	var transform func(string) string
+	switch style {
+	case keyStyleCamel:
+		transform = camelCase
+	case keyStyleScreamingSnake:
+		transform = screamingSnakeCase
+	default:
+		return values, nil
+	}
+
+	transformed := make(map[string]string, len(values))
+	sources := make(map[string]string, len(values))
+	for key, value := range values {
+		name := transform(key)
+		if source, ok := sources[name]; ok {
+			// Report the keys in a stable order
+			if source > key {
+				source, key = key, source
+			}
+			return nil, fmt.Errorf("keys %s and %s both map to %s", source, key, name)
+		}
+		sources[name] = key
+		transformed[name] = value
+	}
+	return transformed, nil
+}
+
+// camelCase converts SCREAMING_SNAKE_CASE keys, e.g. DB_HOST, to camelCase,
+// e.g. dbHost. Keys that are already mixed case are unchanged.
+func camelCase(key string) string {
+	if !strings.Contains(key, "_") && strings.ToUpper(key) != key {
+		return key
+	}
+
+	words := strings.Split(strings.ToLower(key), "_")
+	var b strings.Builder
+	for _, word := range words {
+		if word == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			word = strings.ToUpper(word[:1]) + word[1:]
+		}
+		b.WriteString(word)
+	}
+	return b.String()
+}
+
+// screamingSnakeCase converts camelCase keys, e.g. dbHost, to
+// SCREAMING_SNAKE_CASE, e.g. DB_HOST. Acronyms are kept together, so
+// httpURLPath becomes HTTP_URL_PATH.
+func screamingSnakeCase(key string) string {
+	runes := []rune(key)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			previous := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(previous) || unicode.IsDigit(previous) || (unicode.IsUpper(previous) && nextLower) {
+				b.WriteRune('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
@@ -0,0 +1,78 @@
+package quack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestCamelCase(t *testing.T) {
+	for key, expected := range map[string]string{
+		"DB_HOST":        "dbHost",
+		"HOST":           "host",
+		"AWS_REGION_2":   "awsRegion2",
+		"dbHost":         "dbHost",
+		"ClusterName":    "ClusterName",
+		"_LEADING_UNDER": "leadingUnder",
+	} {
+		assert.Equal(t, expected, camelCase(key), "Unexpected camel case for %s", key)
+	}
+}
+
+func TestScreamingSnakeCase(t *testing.T) {
+	for key, expected := range map[string]string{
+		"dbHost":      "DB_HOST",
+		"host":        "HOST",
+		"awsRegion2":  "AWS_REGION2",
+		"httpURLPath": "HTTP_URL_PATH",
+		"DB_HOST":     "DB_HOST",
+		"ClusterName": "CLUSTER_NAME",
+	} {
+		assert.Equal(t, expected, screamingSnakeCase(key), "Unexpected screaming snake case for %s", key)
+	}
+}
+
+func TestTransformKeys(t *testing.T) {
+	values := map[string]string{"DB_HOST": "db.example.com", "PORT": "5432"}
+
+	transformed, err := transformKeys(values, keyStyleCamel)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in transformKeys: %v", err)
+	}
+	assert.Equal(t, map[string]string{"dbHost": "db.example.com", "port": "5432"}, transformed, "Keys should be camel case")
+
+	transformed, err = transformKeys(transformed, keyStyleScreamingSnake)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in transformKeys: %v", err)
+	}
+	assert.Equal(t, values, transformed, "Keys should be screaming snake case")
+
+	transformed, err = transformKeys(values, "")
+	assert.Nil(t, err, "No key style should not return an error")
+	assert.Equal(t, values, transformed, "Keys should be unchanged without a key style")
+
+	_, err = transformKeys(map[string]string{"DB_HOST": "a", "dbHost": "b"}, keyStyleCamel)
+	assert.EqualError(t, err, "keys DB_HOST and dbHost both map to dbHost", "Colliding camel case keys should return an error")
+
+	_, err = transformKeys(map[string]string{"DB_HOST": "a", "dbHost": "b"}, keyStyleScreamingSnake)
+	assert.EqualError(t, err, "keys DB_HOST and dbHost both map to DB_HOST", "Colliding screaming snake case keys should return an error")
+
+	assert.NotNil(t, validateKeyStyle("kebab"), "Unknown key style should return an error")
+}
+
+func TestAdmitKeyStyle(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"DB_HOST": "db.example.com"})
+	ah.KeyStyle = keyStyleCamel
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "host": "{{ .dbHost }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[{"op": "replace", "path": "/host", "value": "db.example.com"}]`, string(resp.Patch), "Values should be available by their renamed keys")
+}
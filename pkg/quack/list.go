@@ -0,0 +1,74 @@
+package quack
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	listItemFailureFail = "fail"
+	listItemFailureSkip = "skip"
+)
+
+// isList determines whether the object is a list of objects, such as a v1
+// List, whose items should be rendered individually.
+func isList(raw []byte) bool {
+	list := struct {
+		Kind  string            `json:"kind"`
+		Items []json.RawMessage `json:"items"`
+	}{}
+	err := json.Unmarshal(raw, &list)
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(list.Kind, "List") && list.Items != nil
+}
+
+// renderList renders each item of a list as a separate template.
+// Items that fail to render either fail the whole list, or if ListItemFailure
+// is skip, are left unrendered and returned in skipped.
+func (ah *AdmissionHook) renderList(input []byte, data interface{}, opts templateOptions) ([]byte, []string, error) {
+	list := map[string]interface{}{}
+	err := json.Unmarshal(input, &list)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal list: %v", err)
+	}
+	items := struct {
+		Items []json.RawMessage `json:"items"`
+	}{}
+	err = json.Unmarshal(input, &items)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal list items: %v", err)
+	}
+
+	skipped := []string{}
+	rendered := make([]json.RawMessage, len(items.Items))
+	for i, item := range items.Items {
+		output, err := renderTemplate(item, data, opts)
+		if err != nil {
+			if ah.ListItemFailure != listItemFailureSkip {
+				return nil, nil, fmt.Errorf("failed to render item %s: %v", listItemID(i, item), err)
+			}
+			skipped = append(skipped, listItemID(i, item))
+			output = item
+		}
+		rendered[i] = output
+	}
+
+	list["items"] = rendered
+	output, err := json.Marshal(list)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal list: %v", err)
+	}
+	return output, skipped, nil
+}
+
+// listItemID identifies an item by its index, and its name if it has one.
+func listItemID(index int, item []byte) string {
+	objectMeta, err := getObjectMeta(item)
+	if err != nil || objectMeta.Name == "" {
+		return fmt.Sprintf("%d", index)
+	}
+	return fmt.Sprintf("%d (%s)", index, podID(objectMeta.Namespace, objectMeta.Name))
+}
@@ -0,0 +1,74 @@
+package quack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var testList = []byte(`{
+	"apiVersion": "v1",
+	"kind": "List",
+	"metadata": {},
+	"items": [
+		{"metadata": {"name": "good"}, "a": "{{ .A }}"},
+		{"metadata": {"name": "bad"}, "a": "{{ .A "}
+	]
+}`)
+
+func TestIsList(t *testing.T) {
+	assert.True(t, isList(testList), "List should be detected")
+	assert.True(t, isList([]byte(`{"kind": "ConfigMapList", "items": []}`)), "Typed list should be detected")
+	assert.False(t, isList([]byte(`{"kind": "ConfigMap", "items": []}`)), "Object with items should not be a list")
+	assert.False(t, isList([]byte(`{"kind": "List"}`)), "List without items should not be a list")
+}
+
+func TestRenderListFail(t *testing.T) {
+	ah := &AdmissionHook{ListItemFailure: listItemFailureFail}
+
+	_, _, err := ah.renderList(testList, map[string]string{"A": "alpha"}, templateOptions{})
+	assert.NotNil(t, err, "Item failing to render should fail the list")
+	assert.Contains(t, err.Error(), "1 (bad)", "Error should name the failed item")
+}
+
+func TestRenderListSkip(t *testing.T) {
+	ah := &AdmissionHook{ListItemFailure: listItemFailureSkip}
+
+	output, skipped, err := ah.renderList(testList, map[string]string{"A": "alpha"}, templateOptions{})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in renderList: %v", err)
+	}
+	assert.Equal(t, []string{"1 (bad)"}, skipped, "Failed item should be skipped")
+	assert.JSONEq(t, `{
+		"apiVersion": "v1",
+		"kind": "List",
+		"metadata": {},
+		"items": [
+			{"metadata": {"name": "good"}, "a": "alpha"},
+			{"metadata": {"name": "bad"}, "a": "{{ .A "}
+		]
+	}`, string(output), "Other items should be rendered")
+}
+
+func TestAdmitListItemFailure(t *testing.T) {
+	for mode, allowed := range map[string]bool{listItemFailureFail: false, listItemFailureSkip: true} {
+		ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+		ah.ListItemFailure = mode
+		ah.VerboseResponses = true
+
+		resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Operation: admissionv1beta1.Create,
+			Object: runtime.RawExtension{
+				Raw: testList,
+			},
+		})
+		assert.Equal(t, allowed, resp.Allowed, "List with a bad item should follow the %s mode", mode)
+		if allowed {
+			assert.JSONEq(t, `[{"op": "replace", "path": "/items/0/a", "value": "alpha"}]`, string(resp.Patch), "Good item should be patched")
+			assert.Contains(t, resp.Result.Message, "1 (bad)", "Response should name the skipped item")
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package quack
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+)
+
+const (
+	decisionPatched = "patched"
+	decisionAllowed = "allowed"
+	decisionDenied  = "denied"
+)
+
+// logLine writes a line to the log, info lines only at or above the
+// verbosity level.
+// Replaced in tests to capture the log.
+var logLine = func(severity string, level glog.Level, line string) {
+	// Depth 2 attributes the line to the caller of the requestLogger
+	switch severity {
+	case severityError:
+		glog.ErrorDepth(2, line)
+	case severityWarning:
+		glog.WarningDepth(2, line)
+	default:
+		if glog.V(level) {
+			glog.InfoDepth(2, line)
+		}
+	}
+}
+
+const (
+	severityInfo    = "INFO"
+	severityWarning = "WARNING"
+	severityError   = "ERROR"
+)
+
+// requestLogger prefixes log lines with the UID and name of the request being
+// admitted, so lines for concurrent requests can be told apart.
+// The zero value logs lines without a prefix, for helpers called outside of a
+// request.
+type requestLogger struct {
+	prefix string
+}
+
+func newRequestLogger(req *admissionv1beta1.AdmissionRequest) requestLogger {
+	return requestLogger{prefix: fmt.Sprintf("[%s %s] ", req.UID, requestName(req))}
+}
+
+func (l requestLogger) Infof(level glog.Level, format string, args ...interface{}) {
+	logLine(severityInfo, level, l.prefix+fmt.Sprintf(format, args...))
+}
+
+func (l requestLogger) Warningf(format string, args ...interface{}) {
+	logLine(severityWarning, 0, l.prefix+fmt.Sprintf(format, args...))
+}
+
+func (l requestLogger) Errorf(format string, args ...interface{}) {
+	logLine(severityError, 0, l.prefix+fmt.Sprintf(format, args...))
+}
+
+// admissionLogEntry is the structured log written for each request when the
+// LogFormat is json.
+type admissionLogEntry struct {
+	Time       string  `json:"time"`
+	UID        string  `json:"uid"`
+	Kind       string  `json:"kind"`
+	Namespace  string  `json:"namespace"`
+	Name       string  `json:"name"`
+	Operation  string  `json:"operation"`
+	Decision   string  `json:"decision"`
+	PatchOps   int     `json:"patchOps"`
+	DurationMs float64 `json:"durationMs"`
+	Message    string  `json:"message,omitempty"`
+}
+
+// logAdmission writes a single line JSON log entry describing the request
+// and the response given to it.
+func (ah *AdmissionHook) logAdmission(req *admissionv1beta1.AdmissionRequest, resp *admissionv1beta1.AdmissionResponse, duration time.Duration) {
+	entry := admissionLogEntry{
+		Time:       time.Now().UTC().Format(time.RFC3339Nano),
+		UID:        string(req.UID),
+		Kind:       req.Kind.Kind,
+		Namespace:  req.Namespace,
+		Name:       req.Name,
+		Operation:  string(req.Operation),
+		Decision:   decision(resp),
+		PatchOps:   patchOps(resp.Patch),
+		DurationMs: float64(duration) / float64(time.Millisecond),
+	}
+	if resp.Result != nil {
+		entry.Message = resp.Result.Message
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		glog.Errorf("Failed to marshal log entry: %v", err)
+		return
+	}
+
+	output := ah.logOutput
+	if output == nil {
+		output = os.Stderr
+	}
+	_, err = output.Write(append(line, '\n'))
+	if err != nil {
+		glog.Errorf("Failed to write log entry: %v", err)
+	}
+}
+
+// patchLogEntry is the record written to stdout for each patched request when
+// PatchLog is set.
+type patchLogEntry struct {
+	Time      string          `json:"time"`
+	UID       string          `json:"uid"`
+	Kind      string          `json:"kind"`
+	Namespace string          `json:"namespace"`
+	Name      string          `json:"name"`
+	Patch     json.RawMessage `json:"patch"`
+}
+
+// logPatch writes a single line JSON record of the patch applied to the
+// request, regardless of glog's verbosity.
+func (ah *AdmissionHook) logPatch(req *admissionv1beta1.AdmissionRequest, patch []byte) {
+	line, err := json.Marshal(patchLogEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		UID:       string(req.UID),
+		Kind:      req.Kind.Kind,
+		Namespace: req.Namespace,
+		Name:      req.Name,
+		Patch:     json.RawMessage(patch),
+	})
+	if err != nil {
+		glog.Errorf("Failed to marshal patch log entry: %v", err)
+		return
+	}
+
+	output := ah.patchLogOutput
+	if output == nil {
+		output = os.Stdout
+	}
+	_, err = output.Write(append(line, '\n'))
+	if err != nil {
+		glog.Errorf("Failed to write patch log entry: %v", err)
+	}
+}
+
+func decision(resp *admissionv1beta1.AdmissionResponse) string {
+	switch {
+	case !resp.Allowed:
+		return decisionDenied
+	case len(resp.Patch) > 0:
+		return decisionPatched
+	default:
+		return decisionAllowed
+	}
+}
+
+// patchOps counts the operations in a JSON Patch.
+func patchOps(patch []byte) int {
+	if len(patch) == 0 {
+		return 0
+	}
+	ops := []json.RawMessage{}
+	err := json.Unmarshal(patch, &ops)
+	if err != nil {
+		return 0
+	}
+	return len(ops)
+}
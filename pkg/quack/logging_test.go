@@ -0,0 +1,158 @@
+package quack
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/golang/glog"
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestAdmitJSONLog(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.LogFormat = logFormatJSON
+	output := new(bytes.Buffer)
+	ah.logOutput = output
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+		Namespace: "default",
+		Name:      "foo",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}", "b": "{{ .A }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+
+	entry := map[string]interface{}{}
+	err := json.Unmarshal(output.Bytes(), &entry)
+	if err != nil {
+		assert.FailNowf(t, "jsonError", "Failed to unmarshal log entry: %v", err)
+	}
+	assert.Equal(t, "create-uid", entry["uid"], "Log should contain the UID")
+	assert.Equal(t, "ConfigMap", entry["kind"], "Log should contain the kind")
+	assert.Equal(t, "default", entry["namespace"], "Log should contain the namespace")
+	assert.Equal(t, "foo", entry["name"], "Log should contain the name")
+	assert.Equal(t, "CREATE", entry["operation"], "Log should contain the operation")
+	assert.Equal(t, decisionPatched, entry["decision"], "Log should contain the decision")
+	assert.Equal(t, float64(2), entry["patchOps"], "Log should contain the number of patch operations")
+	assert.Contains(t, entry, "durationMs", "Log should contain the duration")
+}
+
+func TestAdmitTextLog(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+	output := new(bytes.Buffer)
+	ah.logOutput = output
+
+	ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "delete-uid",
+		Operation: admissionv1beta1.Delete,
+	})
+	assert.Empty(t, output.String(), "JSON log should not be written by default")
+}
+
+func TestAdmitPatchLog(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.PatchLog = true
+	output := new(bytes.Buffer)
+	ah.patchLogOutput = output
+
+	for _, raw := range []string{
+		`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`,
+		`{"metadata": {"name": "foo"}, "a": "alpha"}`,
+	} {
+		ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+			Namespace: "default",
+			Name:      "foo",
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: []byte(raw)},
+		})
+	}
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	if !assert.Len(t, lines, 1, "Only patched requests should be recorded") {
+		return
+	}
+	entry := map[string]interface{}{}
+	err := json.Unmarshal([]byte(lines[0]), &entry)
+	if err != nil {
+		assert.FailNowf(t, "jsonError", "Failed to unmarshal patch log entry: %v", err)
+	}
+	assert.Equal(t, "create-uid", entry["uid"], "Record should contain the UID")
+	assert.Equal(t, "ConfigMap", entry["kind"], "Record should contain the kind")
+	assert.Equal(t, "default", entry["namespace"], "Record should contain the namespace")
+	assert.Equal(t, "foo", entry["name"], "Record should contain the name")
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"op": "replace", "path": "/a", "value": "alpha"},
+	}, entry["patch"], "Record should contain the patch as JSON")
+	assert.Contains(t, entry, "time", "Record should contain the time")
+}
+
+// captureLog replaces logLine, recording every line regardless of level, until
+// the returned function is called.
+func captureLog() (*[]string, func()) {
+	lines := []string{}
+	original := logLine
+	logLine = func(severity string, level glog.Level, line string) {
+		lines = append(lines, severity+" "+line)
+	}
+	return &lines, func() { logLine = original }
+}
+
+func TestAdmitLogsUID(t *testing.T) {
+	lines, restore := captureLog()
+	defer restore()
+
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "patch-uid",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+		Name:      "foo",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`),
+		},
+	})
+	ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "error-uid",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+		Name:      "bar",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "bar"}, "a": "{{ .A "}`),
+		},
+	})
+
+	for _, expected := range []string{
+		"INFO [patch-uid /v1, Kind=ConfigMap foo] Processing CREATE request for",
+		"INFO [patch-uid /v1, Kind=ConfigMap foo] Requested Object Annotations",
+		"INFO [patch-uid /v1, Kind=ConfigMap foo] Patching",
+		"INFO [error-uid /v1, Kind=ConfigMap bar] Processing CREATE request for",
+		"ERROR [error-uid /v1, Kind=ConfigMap bar] Failed CREATE request for bar: Error rendering template",
+	} {
+		found := false
+		for _, line := range *lines {
+			found = found || strings.HasPrefix(line, expected)
+		}
+		assert.True(t, found, "Log should contain a line starting %q, got %v", expected, *lines)
+	}
+
+	for _, line := range *lines {
+		assert.Regexp(t, `^[A-Z]+ \[(patch-uid /v1, Kind=ConfigMap foo|error-uid /v1, Kind=ConfigMap bar)\] `, line, "Every line should contain the UID and name of the request")
+	}
+}
+
+func TestDecision(t *testing.T) {
+	assert.Equal(t, decisionDenied, decision(&admissionv1beta1.AdmissionResponse{}), "Disallowed responses should be denied")
+	assert.Equal(t, decisionAllowed, decision(&admissionv1beta1.AdmissionResponse{Allowed: true}), "Allowed responses without a patch should be allowed")
+	assert.Equal(t, decisionPatched, decision(&admissionv1beta1.AdmissionResponse{Allowed: true, Patch: []byte(`[{}]`)}), "Allowed responses with a patch should be patched")
+}
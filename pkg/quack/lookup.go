@@ -0,0 +1,177 @@
+package quack
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	inheritFromAnnotation = "quack.pusher.com/inherit-from"
+	parentContextKey      = "Parent"
+)
+
+// discoveryTTL is how long discovered resources are used before the API
+// server is asked for them again, so kinds added since, such as those of new
+// CustomResourceDefinitions, can be looked up once it expires.
+const discoveryTTL = time.Minute
+
+// resourceCache holds the resources last discovered from the API server, so
+// lookups don't discover every resource on each request.
+// The zero value is an empty cache.
+type resourceCache struct {
+	mutex      sync.Mutex
+	resources  []*metav1.APIResourceList
+	discovered time.Time
+}
+
+// get returns the resources discovered within the discoveryTTL, or calls
+// discover to discover them again.
+func (c *resourceCache) get(discover func() ([]*metav1.APIResourceList, error)) ([]*metav1.APIResourceList, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.resources != nil && time.Since(c.discovered) < discoveryTTL {
+		return c.resources, nil
+	}
+
+	resources, err := discover()
+	if err != nil {
+		return nil, err
+	}
+	c.resources = resources
+	c.discovered = time.Now()
+	return resources, nil
+}
+
+// getParent fetches the object referenced by the inherit-from annotation in the
+// annotation domain, as kind/name, from the namespace of the request.
+// Cluster scoped kinds, such as Namespace, are fetched regardless of the
+// namespace. Returns nil if the object has no inherit-from annotation.
+// The user making the request must be allowed to get the parent, so objects
+// can't copy fields of objects their users couldn't read themselves.
+func (ah *AdmissionHook) getParent(objectMeta metav1.ObjectMeta, namespace string, userInfo authenticationv1.UserInfo) (map[string]interface{}, error) {
+	annotation := domainAnnotation(inheritFromAnnotation, ah.annotationDomain())
+	reference, ok := objectMeta.Annotations[annotation]
+	if !ok {
+		return nil, nil
+	}
+	if ah.lookupClients == nil {
+		return nil, fmt.Errorf("lookups are disabled, set --enable-lookups to use %s", annotation)
+	}
+
+	parts := strings.SplitN(reference, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid reference %q, must be of the form kind/name", reference)
+	}
+	kind, name := parts[0], parts[1]
+
+	resource, gv, err := ah.findResource(kind)
+	if err != nil {
+		return nil, err
+	}
+	if !resource.Namespaced {
+		namespace = ""
+	}
+
+	err = ah.checkAccess(userInfo, authorizationv1.ResourceAttributes{
+		Namespace: namespace,
+		Verb:      "get",
+		Group:     gv.Group,
+		Version:   gv.Version,
+		Resource:  resource.Name,
+		Name:      name,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := ah.lookupClients.ClientForGroupVersionKind(gv.WithKind(resource.Kind))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client for %s: %v", gv.WithKind(resource.Kind), err)
+	}
+	parent, err := client.Resource(resource, namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get %s %s: %v", resource.Kind, podID(namespace, name), err)
+	}
+	return parent.Object, nil
+}
+
+// findResource discovers the resource serving a kind, matched regardless of
+// case.
+func (ah *AdmissionHook) findResource(kind string) (*metav1.APIResource, schema.GroupVersion, error) {
+	resourceLists, err := ah.discoveredResources.get(ah.client.Discovery().ServerResources)
+	if err != nil {
+		return nil, schema.GroupVersion{}, fmt.Errorf("failed to discover resources: %v", err)
+	}
+
+	for _, resourceList := range resourceLists {
+		gv, err := schema.ParseGroupVersion(resourceList.GroupVersion)
+		if err != nil {
+			return nil, schema.GroupVersion{}, fmt.Errorf("invalid group version %q: %v", resourceList.GroupVersion, err)
+		}
+		for i := range resourceList.APIResources {
+			resource := resourceList.APIResources[i]
+			// Subresources share the kind of their parent resource
+			if strings.Contains(resource.Name, "/") {
+				continue
+			}
+			if strings.EqualFold(resource.Kind, kind) {
+				return &resource, gv, nil
+			}
+		}
+	}
+	return nil, schema.GroupVersion{}, fmt.Errorf("no resource found for kind %s", kind)
+}
+
+// checkAccess reviews whether the user making a request may access the
+// resource with the attributes, returning an error if they may not.
+func (ah *AdmissionHook) checkAccess(userInfo authenticationv1.UserInfo, attributes authorizationv1.ResourceAttributes) error {
+	extra := make(map[string]authorizationv1.ExtraValue, len(userInfo.Extra))
+	for key, value := range userInfo.Extra {
+		extra[key] = authorizationv1.ExtraValue(value)
+	}
+
+	review, err := ah.client.AuthorizationV1().SubjectAccessReviews().Create(&authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &attributes,
+			User:               userInfo.Username,
+			Groups:             userInfo.Groups,
+			UID:                userInfo.UID,
+			Extra:              extra,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to review access of user %s: %v", userInfo.Username, err)
+	}
+	if !review.Status.Allowed {
+		return fmt.Errorf("user %s may not %s %s %s", userInfo.Username, attributes.Verb, attributes.Resource, podID(attributes.Namespace, attributes.Name))
+	}
+	return nil
+}
+
+// lookupAuthorizer returns a function authorizing templates of the request to
+// get an object in the core group, given its resource, namespace and name.
+// Values must be allowed to be read from the namespace, and the user making
+// the request must be allowed to get the object.
+func (ah *AdmissionHook) lookupAuthorizer(req *admissionv1beta1.AdmissionRequest) func(string, string, string) error {
+	return func(resource string, namespace string, name string) error {
+		err := ah.checkValuesNamespaces(req.Namespace, namespace)
+		if err != nil {
+			return err
+		}
+		return ah.checkAccess(req.UserInfo, authorizationv1.ResourceAttributes{
+			Namespace: namespace,
+			Verb:      "get",
+			Version:   "v1",
+			Resource:  resource,
+			Name:      name,
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package quack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// allowAccess answers access reviews of users named "mallard", who may get
+// every object, and denies all other users.
+func allowAccess(ah *AdmissionHook) {
+	ah.client.(*fake.Clientset).PrependReactor("create", "subjectaccessreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		review := action.(clienttesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		review.Status.Allowed = review.Spec.User == "mallard" && review.Spec.ResourceAttributes.Verb == "get"
+		return true, review, nil
+	})
+}
+
+// newTestLookupClients configures fake lookup clients serving a Namespace and a
+// namespaced Team custom resource, readable by users named "mallard".
+func newTestLookupClients(ah *AdmissionHook) {
+	allowAccess(ah)
+
+	ah.client.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "namespaces", Kind: "Namespace"},
+				{Name: "namespaces/status", Kind: "Namespace"},
+			},
+		},
+		{
+			GroupVersion: "example.com/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "teams", Kind: "Team", Namespaced: true},
+			},
+		},
+	}
+
+	clients := &dynamicfake.FakeClientPool{}
+	clients.AddReactor("get", "namespaces", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Namespace",
+			"metadata": map[string]interface{}{
+				"name":   action.(clienttesting.GetAction).GetName(),
+				"labels": map[string]interface{}{"team": "ducks"},
+			},
+		}}, nil
+	})
+	clients.AddReactor("get", "teams", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		getAction := action.(clienttesting.GetAction)
+		return true, &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "example.com/v1",
+			"kind":       "Team",
+			"metadata": map[string]interface{}{
+				"name":      getAction.GetName(),
+				"namespace": getAction.GetNamespace(),
+			},
+			"spec": map[string]interface{}{"owner": "mallard"},
+		}}, nil
+	})
+	ah.lookupClients = clients
+}
+
+func TestGetParent(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+	newTestLookupClients(ah)
+	user := authenticationv1.UserInfo{Username: "mallard"}
+
+	parent, err := ah.getParent(metav1.ObjectMeta{}, "pond", user)
+	assert.Nil(t, err, "Object without annotation should not return an error")
+	assert.Nil(t, parent, "Object without annotation should have no parent")
+
+	parent, err = ah.getParent(metav1.ObjectMeta{Annotations: map[string]string{inheritFromAnnotation: "team/default"}}, "pond", user)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in getParent: %v", err)
+	}
+	assert.Equal(t, "pond", parent["metadata"].(map[string]interface{})["namespace"], "Namespaced parent should be fetched from the request namespace")
+
+	parent, err = ah.getParent(metav1.ObjectMeta{Annotations: map[string]string{inheritFromAnnotation: "Namespace/pond"}}, "pond", user)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in getParent: %v", err)
+	}
+	assert.Equal(t, "pond", parent["metadata"].(map[string]interface{})["name"], "Cluster scoped parent should be fetched")
+
+	_, err = ah.getParent(metav1.ObjectMeta{Annotations: map[string]string{inheritFromAnnotation: "Widget/foo"}}, "pond", user)
+	assert.NotNil(t, err, "Unknown kind should return an error")
+
+	_, err = ah.getParent(metav1.ObjectMeta{Annotations: map[string]string{inheritFromAnnotation: "team"}}, "pond", user)
+	assert.NotNil(t, err, "Invalid reference should return an error")
+
+	_, err = ah.getParent(metav1.ObjectMeta{Annotations: map[string]string{inheritFromAnnotation: "team/default"}}, "pond", authenticationv1.UserInfo{Username: "drake"})
+	assert.NotNil(t, err, "Parents the user may not get should return an error")
+
+	// The fake discovery records actions separately from the fake clientset
+	discoveries := 0
+	for _, action := range ah.client.Discovery().(*fakediscovery.FakeDiscovery).Actions() {
+		if action.GetResource().Resource == "resource" {
+			discoveries++
+		}
+	}
+	assert.Equal(t, 1, discoveries, "Discovered resources should be reused between lookups")
+
+	ah.lookupClients = nil
+	_, err = ah.getParent(metav1.ObjectMeta{Annotations: map[string]string{inheritFromAnnotation: "team/default"}}, "pond", user)
+	assert.NotNil(t, err, "Lookups should be rejected when disabled")
+}
+
+func TestAdmitInheritFrom(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+	newTestLookupClients(ah)
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Namespace: "pond",
+		Operation: admissionv1beta1.Create,
+		UserInfo:  authenticationv1.UserInfo{Username: "mallard"},
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/inherit-from": "Team/default"}}, "owner": "{{ .Parent.spec.owner }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[{"op": "replace", "path": "/owner", "value": "mallard"}]`, string(resp.Patch), "Parent should be exposed to the template, without patching the annotation")
+
+	resp = ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Namespace: "pond",
+		Operation: admissionv1beta1.Create,
+		UserInfo:  authenticationv1.UserInfo{Username: "drake"},
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/inherit-from": "Team/default"}}, "owner": "{{ .Parent.spec.owner }}"}`),
+		},
+	})
+	assert.False(t, resp.Allowed, "Request should be rejected")
+	assert.Contains(t, resp.Result.Message, "user drake may not get teams pond/default", "Users should only inherit from parents they may get")
+}
+
+func TestLookupAuthorizer(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+	allowAccess(ah)
+
+	authorize := ah.lookupAuthorizer(&admissionv1beta1.AdmissionRequest{
+		Namespace: "pond",
+		UserInfo:  authenticationv1.UserInfo{Username: "mallard"},
+	})
+	assert.Nil(t, authorize("configmaps", "pond", "shared"), "Objects in the request namespace should be authorized")
+	assert.Nil(t, authorize("configmaps", "quack", "shared"), "Objects in the values namespace should be authorized")
+	err := authorize("configmaps", "lake", "shared")
+	if assert.NotNil(t, err, "Objects in other namespaces should not be authorized") {
+		assert.Contains(t, err.Error(), `namespace "lake" is not allowed`, "Error should name the namespace")
+	}
+
+	authorize = ah.lookupAuthorizer(&admissionv1beta1.AdmissionRequest{
+		Namespace: "pond",
+		UserInfo:  authenticationv1.UserInfo{Username: "drake"},
+	})
+	err = authorize("configmaps", "pond", "shared")
+	if assert.NotNil(t, err, "Objects the user may not get should not be authorized") {
+		assert.Contains(t, err.Error(), "user drake may not get configmaps pond/shared", "Error should name the user")
+	}
+}
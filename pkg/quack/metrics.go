@@ -0,0 +1,108 @@
+package quack
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+)
+
+// Reasons requests are skipped, used to label skippedRequests.
+const (
+	skipReasonOperation          = "operation"
+	skipReasonNoObject           = "no_object"
+	skipReasonKind               = "kind"
+	skipReasonUnchanged          = "unchanged"
+	skipReasonRequiredAnnotation = "required_annotation"
+	skipReasonSkipAnnotation     = "skip_annotation"
+	skipReasonMissingValues      = "missing_values"
+)
+
+// Outcomes of requests, used to label requestsTotal.
+const (
+	outcomeSkipped  = "skipped"
+	outcomePatched  = "patched"
+	outcomeNoChange = "nochange"
+	outcomeError    = "error"
+)
+
+// Stages of templating timed by renderDuration.
+const (
+	stageValues = "values"
+	stageRender = "render"
+)
+
+// skippedRequests counts requests skipped by each filter in Admit.
+var skippedRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "quack_skipped_requests_total",
+		Help: "Number of requests skipped without templating, by the reason they were skipped.",
+	},
+	[]string{"reason"},
+)
+
+// requestsTotal counts requests by their operation and outcome.
+var requestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "quack_requests_total",
+		Help: "Number of requests processed, by operation and outcome.",
+	},
+	[]string{"operation", "outcome"},
+)
+
+// renderDuration observes the time taken to load values and render templates.
+var renderDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "quack_render_duration_seconds",
+		Help:    "Time taken to load the values and render the template of a request, by stage.",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"stage"},
+)
+
+// registry holds only Quack's metrics, served at the MetricsBindAddress.
+// Metrics are also registered with the default registry, which is served by
+// the admission server at /metrics.
+var registry = prometheus.NewRegistry()
+
+func init() {
+	for _, collector := range []prometheus.Collector{skippedRequests, requestsTotal, renderDuration} {
+		prometheus.MustRegister(collector)
+		registry.MustRegister(collector)
+	}
+}
+
+// countRequest counts a request with the outcome.
+func countRequest(operation admissionv1beta1.Operation, outcome string) {
+	requestsTotal.WithLabelValues(string(operation), outcome).Inc()
+}
+
+// observeDuration records the time taken by a stage since start.
+func observeDuration(stage string, start time.Time) {
+	renderDuration.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
+
+// serveMetrics serves Quack's metrics on the MetricsBindAddress until stopCh
+// is closed.
+func (ah *AdmissionHook) serveMetrics(stopCh <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Addr:    ah.MetricsBindAddress,
+		Handler: mux,
+	}
+
+	go func() {
+		<-stopCh
+		server.Close()
+	}()
+
+	glog.Infof("Serving metrics at %s", ah.MetricsBindAddress)
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		glog.Errorf("Metrics server failed: %v", err)
+	}
+}
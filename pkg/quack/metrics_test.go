@@ -0,0 +1,162 @@
+package quack
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func skippedCount(t *testing.T, reason string) float64 {
+	metric := &dto.Metric{}
+	err := skippedRequests.WithLabelValues(reason).Write(metric)
+	if err != nil {
+		assert.FailNowf(t, "metricError", "Failed to read metric: %v", err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestAdmitSkippedRequestsMetric(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+	ah.ExcludeKinds = []string{"Secret"}
+	ah.SkipUnchanged = true
+	ah.RequiredAnnotation = "quack.pusher.com/template"
+
+	object := runtime.RawExtension{Raw: []byte(`{"metadata": {"name": "foo"}}`)}
+	// Unchanged updates are only skipped once templated
+	annotated := runtime.RawExtension{Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/template": "true"}}}`)}
+	cases := map[string]*admissionv1beta1.AdmissionRequest{
+		skipReasonOperation: {
+			Operation: admissionv1beta1.Delete,
+			Object:    object,
+		},
+		skipReasonNoObject: {
+			Operation: admissionv1beta1.Create,
+		},
+		skipReasonKind: {
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Secret"},
+			Operation: admissionv1beta1.Create,
+			Object:    object,
+		},
+		skipReasonUnchanged: {
+			Operation: admissionv1beta1.Update,
+			Object:    annotated,
+			OldObject: annotated,
+		},
+		skipReasonRequiredAnnotation: {
+			Operation: admissionv1beta1.Create,
+			Object:    object,
+		},
+	}
+
+	for reason, req := range cases {
+		before := map[string]float64{}
+		for r := range cases {
+			before[r] = skippedCount(t, r)
+		}
+
+		resp := ah.Admit(req)
+		assert.True(t, resp.Allowed, "Skipped request should be allowed")
+
+		for r := range cases {
+			expected := before[r]
+			if r == reason {
+				expected++
+			}
+			assert.Equal(t, expected, skippedCount(t, r), "Skipping for %s should only count the %s reason", reason, r)
+		}
+	}
+}
+
+func requestsCount(t *testing.T, operation admissionv1beta1.Operation, outcome string) float64 {
+	metric := &dto.Metric{}
+	err := requestsTotal.WithLabelValues(string(operation), outcome).Write(metric)
+	if err != nil {
+		assert.FailNowf(t, "metricError", "Failed to read metric: %v", err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func renderCount(t *testing.T, stage string) uint64 {
+	metric := &dto.Metric{}
+	err := renderDuration.WithLabelValues(stage).(prometheus.Histogram).Write(metric)
+	if err != nil {
+		assert.FailNowf(t, "metricError", "Failed to read metric: %v", err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestAdmitRequestsMetric(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+
+	cases := map[string]*admissionv1beta1.AdmissionRequest{
+		outcomeSkipped: {
+			Operation: admissionv1beta1.Delete,
+		},
+		outcomePatched: {
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`)},
+		},
+		outcomeNoChange: {
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: []byte(`{"metadata": {"name": "foo"}, "a": "alpha"}`)},
+		},
+		outcomeError: {
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A"}`)},
+		},
+	}
+
+	for outcome, req := range cases {
+		before := map[string]float64{}
+		for o, r := range cases {
+			before[o] = requestsCount(t, r.Operation, o)
+		}
+
+		ah.Admit(req)
+
+		for o, r := range cases {
+			expected := before[o]
+			if o == outcome {
+				expected++
+			}
+			assert.Equal(t, expected, requestsCount(t, r.Operation, o), "A %s request should only count the %s outcome", outcome, o)
+		}
+	}
+}
+
+func TestAdmitRenderDurationMetric(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	valuesBefore := renderCount(t, stageValues)
+	renderBefore := renderCount(t, stageRender)
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		Operation: admissionv1beta1.Create,
+		Object:    runtime.RawExtension{Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`)},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+
+	assert.Equal(t, valuesBefore+1, renderCount(t, stageValues), "Loading values should be timed")
+	assert.Equal(t, renderBefore+1, renderCount(t, stageRender), "Rendering should be timed")
+}
+
+func TestRegistryGathersQuackMetrics(t *testing.T) {
+	countRequest(admissionv1beta1.Create, outcomePatched)
+	observeDuration(stageRender, time.Now())
+
+	families, err := registry.Gather()
+	if err != nil {
+		assert.FailNowf(t, "metricError", "Failed to gather metrics: %v", err)
+	}
+	names := []string{}
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	assert.Contains(t, names, "quack_requests_total", "Requests should be served")
+	assert.Contains(t, names, "quack_render_duration_seconds", "Render durations should be served")
+}
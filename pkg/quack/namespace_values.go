@@ -0,0 +1,115 @@
+package quack
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// namespaceValuesTTL is how long the Values ConfigMap fetched from a
+// namespace, or its absence, is used before it is fetched again, so changes
+// to namespace values apply once it expires.
+const namespaceValuesTTL = time.Minute
+
+// namespaceValuesCache holds the Values ConfigMap last fetched from each
+// namespace, so namespace values don't cost a request to the API server for
+// every object admitted.
+// The zero value is an empty cache.
+type namespaceValuesCache struct {
+	mutex   sync.Mutex
+	entries map[string]namespaceValuesEntry
+}
+
+// namespaceValuesEntry is the Values ConfigMap fetched from a namespace, nil
+// if the namespace has none.
+type namespaceValuesEntry struct {
+	configMap *corev1.ConfigMap
+	fetched   time.Time
+}
+
+// get returns the ConfigMap of the namespace fetched within the
+// namespaceValuesTTL, or calls fetch to fetch it again.
+// The cache isn't locked while fetching, so slow namespaces don't delay
+// requests in others.
+func (c *namespaceValuesCache) get(namespace string, fetch func(string) (*corev1.ConfigMap, error)) (*corev1.ConfigMap, error) {
+	c.mutex.Lock()
+	entry, ok := c.entries[namespace]
+	c.mutex.Unlock()
+	if ok && time.Since(entry.fetched) < namespaceValuesTTL {
+		return entry.configMap, nil
+	}
+
+	cm, err := fetch(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]namespaceValuesEntry{}
+	}
+	c.entries[namespace] = namespaceValuesEntry{configMap: cm, fetched: time.Now()}
+	return cm, nil
+}
+
+// overrideNamespaceValues overrides values with those of the Values ConfigMap
+// in the object's namespace, so namespaces can customise the global values
+// without annotating every object.
+// Namespaces without the ConfigMap, namespaces Quack may not get it from, and
+// namespaces values may not be read from, are skipped.
+func (ah *AdmissionHook) overrideNamespaceValues(log requestLogger, values map[string]string, version string, namespace string) (map[string]string, string, error) {
+	if namespace == "" || !ah.valuesNamespaceAllowed(namespace, namespace) {
+		return values, version, nil
+	}
+
+	cm, err := ah.namespaceValues.get(namespace, func(namespace string) (*corev1.ConfigMap, error) {
+		return ah.getNamespaceValues(log, namespace)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if cm == nil {
+		return values, version, nil
+	}
+
+	overridden := make(map[string]string, len(values)+len(cm.Data))
+	for key, value := range values {
+		overridden[key] = value
+	}
+	for key, value := range cm.Data {
+		overridden[key] = value
+	}
+	// Read after the required annotation is checked, so never available to
+	// templates
+	delete(overridden, requiredAnnotationKey)
+	versions := []string{fmt.Sprintf("%s@%s", podID(namespace, ah.ValuesMapName), cm.ResourceVersion)}
+	if version != "" {
+		versions = append([]string{version}, versions...)
+	}
+	return overridden, strings.Join(versions, ","), nil
+}
+
+// getNamespaceValues fetches the Values ConfigMap of the namespace, returning
+// nil if it doesn't exist, or if Quack isn't allowed to get it, so namespace
+// values can be granted to some namespaces only.
+func (ah *AdmissionHook) getNamespaceValues(log requestLogger, namespace string) (*corev1.ConfigMap, error) {
+	cm, err := ah.client.CoreV1().ConfigMaps(namespace).Get(ah.ValuesMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		log.Infof(4, "Configmap %s not found, skipping", podID(namespace, ah.ValuesMapName))
+		return nil, nil
+	}
+	if apierrors.IsForbidden(err) {
+		log.Infof(4, "Not allowed to get configmap %s, skipping", podID(namespace, ah.ValuesMapName))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get configmap %s: %v", podID(namespace, ah.ValuesMapName), err)
+	}
+	return cm, nil
+}
@@ -0,0 +1,123 @@
+package quack
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// countNamespaceValuesGets counts the Values ConfigMaps fetched from the
+// namespace.
+func countNamespaceValuesGets(ah *AdmissionHook, namespace string) int {
+	gets := 0
+	for _, action := range ah.client.(*fake.Clientset).Actions() {
+		if action.Matches("get", "configmaps") && action.GetNamespace() == namespace {
+			gets++
+		}
+	}
+	return gets
+}
+
+func TestNamespaceValuesCache(t *testing.T) {
+	cache := namespaceValuesCache{}
+	fetches := 0
+	fetch := func(namespace string) (*corev1.ConfigMap, error) {
+		fetches++
+		return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "quack-values", Namespace: namespace}}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		cm, err := cache.get("team-a", fetch)
+		if err != nil {
+			assert.FailNowf(t, "methodError", "Error in get: %v", err)
+		}
+		assert.Equal(t, "team-a", cm.Namespace, "ConfigMap of the namespace should be returned")
+	}
+	assert.Equal(t, 1, fetches, "ConfigMap should be reused within the TTL")
+
+	_, err := cache.get("team-b", fetch)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in get: %v", err)
+	}
+	assert.Equal(t, 2, fetches, "ConfigMaps should be cached per namespace")
+
+	cache.entries["team-a"] = namespaceValuesEntry{fetched: time.Now().Add(-namespaceValuesTTL)}
+	_, err = cache.get("team-a", fetch)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in get: %v", err)
+	}
+	assert.Equal(t, 3, fetches, "ConfigMap should be fetched again once expired")
+}
+
+func TestAdmitNamespaceValuesForbidden(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.NamespaceValues = true
+	ah.client.(*fake.Clientset).PrependReactor("get", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() != "team-a" {
+			return false, nil, nil
+		}
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "quack-values", nil)
+	})
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Namespace: "team-a",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[{"op": "replace", "path": "/a", "value": "alpha"}]`, string(resp.Patch), "Namespaces Quack may not read should be skipped")
+}
+
+func TestAdmitNamespaceValuesRequiredAnnotation(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+	ah.client = fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "quack-values", Namespace: "quack"},
+			Data:       map[string]string{"A": "alpha"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "quack-values", Namespace: "team-a"},
+			Data:       map[string]string{"A": "team-a-alpha", requiredAnnotationKey: "other"},
+		},
+	)
+	ah.NamespaceValues = true
+	ah.RequiredAnnotation = "quack.pusher.com/template"
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Namespace: "team-a",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.Nil(t, resp.Patch, "Object without the required annotation should not be templated")
+	assert.Equal(t, 0, countNamespaceValuesGets(ah, "team-a"), "Namespace values should not be fetched for objects that aren't templated")
+
+	for i := 0; i < 2; i++ {
+		resp = ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Namespace: "team-a",
+			Operation: admissionv1beta1.Create,
+			Object: runtime.RawExtension{
+				Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/template": "true"}}, "a": "{{ .A }}"}`),
+			},
+		})
+		assert.True(t, resp.Allowed, "Request should be allowed")
+		assert.JSONEq(t, `[{"op": "replace", "path": "/a", "value": "team-a-alpha"}]`, string(resp.Patch), "Namespace values should not change the required annotation")
+	}
+	assert.Equal(t, 1, countNamespaceValuesGets(ah, "team-a"), "Namespace values should be reused between requests")
+}
@@ -0,0 +1,75 @@
+package quack
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+const (
+	patchModeMinimal     = "minimal"
+	patchModeFullReplace = "full-replace"
+)
+
+func validatePatchMode(mode string) error {
+	switch mode {
+	case "", patchModeMinimal, patchModeFullReplace:
+		return nil
+	default:
+		return fmt.Errorf("invalid patch mode %q, must be %q or %q", mode, patchModeMinimal, patchModeFullReplace)
+	}
+}
+
+// fullReplacePatch converts a patch into one replacing every top level field
+// of the original object with its value in the patched object, so clients
+// receive the whole rendered object rather than individual changes.
+// Fields filtered from the patch keep their original values.
+func fullReplacePatch(original []byte, patch []byte) ([]byte, error) {
+	patched, err := applyPatch(original, patch)
+	if err != nil {
+		return nil, err
+	}
+
+	originalFields := map[string]json.RawMessage{}
+	err = json.Unmarshal(original, &originalFields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal object: %v", err)
+	}
+	patchedFields := map[string]json.RawMessage{}
+	err = json.Unmarshal(patched, &patchedFields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal patched object: %v", err)
+	}
+
+	fields := []string{}
+	for field := range originalFields {
+		fields = append(fields, field)
+	}
+	for field := range patchedFields {
+		if _, ok := originalFields[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	ops := []map[string]interface{}{}
+	for _, field := range fields {
+		path := "/" + escapeJSONPointer(field)
+		value, patchedOk := patchedFields[field]
+		_, originalOk := originalFields[field]
+		switch {
+		case !patchedOk:
+			ops = append(ops, map[string]interface{}{"op": "remove", "path": path})
+		case !originalOk:
+			ops = append(ops, map[string]interface{}{"op": "add", "path": path, "value": value})
+		default:
+			ops = append(ops, map[string]interface{}{"op": "replace", "path": path, "value": value})
+		}
+	}
+
+	replacePatch, err := json.Marshal(ops)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling patch: %v", err)
+	}
+	return replacePatch, nil
+}
@@ -0,0 +1,64 @@
+package quack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestFullReplacePatch(t *testing.T) {
+	original := []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}", "b": "beta"}`)
+	patch := []byte(`[
+		{"op": "replace", "path": "/a", "value": "alpha"},
+		{"op": "remove", "path": "/b"},
+		{"op": "add", "path": "/c~1d", "value": "gamma"}
+	]`)
+
+	replacePatch, err := fullReplacePatch(original, patch)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in fullReplacePatch: %v", err)
+	}
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/a", "value": "alpha"},
+		{"op": "remove", "path": "/b"},
+		{"op": "add", "path": "/c~1d", "value": "gamma"},
+		{"op": "replace", "path": "/metadata", "value": {"name": "foo"}}
+	]`, string(replacePatch), "Every top level field should be replaced, added or removed")
+}
+
+func TestAdmitPatchModeFullReplace(t *testing.T) {
+	object := []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/left-delim": "[[", "quack.pusher.com/right-delim": "]]", "owner": "[[ .A ]]"}}, "spec": {"a": "[[ .A ]]", "b": "beta"}, "status": {"phase": "[[ .A ]]"}}`)
+
+	results := map[string]string{}
+	for _, mode := range []string{patchModeMinimal, patchModeFullReplace} {
+		ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+		ah.PatchMode = mode
+		ah.IgnoredPaths = []string{"/metadata/annotations/owner"}
+		err := ah.initialize(ah.client)
+		if err != nil {
+			assert.FailNowf(t, "methodError", "Error in initialize: %v", err)
+		}
+
+		resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: object},
+		})
+		assert.True(t, resp.Allowed, "Request should be allowed in %s mode", mode)
+		patched, err := applyPatch(object, resp.Patch)
+		if err != nil {
+			assert.FailNowf(t, "methodError", "Error in applyPatch: %v", err)
+		}
+		results[mode] = string(patched)
+	}
+	assert.JSONEq(t, results[patchModeMinimal], results[patchModeFullReplace], "Full replace and minimal patches should produce the same object")
+	assert.JSONEq(t, `{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/left-delim": "[[", "quack.pusher.com/right-delim": "]]", "owner": "[[ .A ]]"}}, "spec": {"a": "alpha", "b": "beta"}, "status": {"phase": "[[ .A ]]"}}`, results[patchModeFullReplace], "Filtered paths should keep their submitted values")
+}
+
+func TestInitializeInvalidPatchMode(t *testing.T) {
+	ah := &AdmissionHook{PatchMode: "merge"}
+	err := ah.initialize(nil)
+	assert.NotNil(t, err, "Invalid patch mode should return an error")
+}
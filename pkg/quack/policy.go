@@ -0,0 +1,139 @@
+package quack
+
+import (
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	failurePolicyFail   = "Fail"
+	failurePolicyIgnore = "Ignore"
+
+	policyResyncPeriod = 10 * time.Minute
+)
+
+// policyGroupVersion is the API group and version QuackPolicies are served at.
+var policyGroupVersion = schema.GroupVersion{
+	Group:   "quack.pusher.com",
+	Version: "v1alpha1",
+}
+
+var policyResource = &metav1.APIResource{
+	Name:       "quackpolicies",
+	Namespaced: true,
+	Kind:       "QuackPolicy",
+}
+
+// QuackPolicy configures templating of objects in its namespace.
+// Fields that are unset fall back to object annotations and flags.
+type QuackPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec QuackPolicySpec `json:"spec"`
+}
+
+// QuackPolicySpec is the configuration set by a QuackPolicy.
+type QuackPolicySpec struct {
+	LeftDelim          string `json:"leftDelim,omitempty"`          // Left delimiter for templates
+	RightDelim         string `json:"rightDelim,omitempty"`         // Right delimiter for templates
+	RequiredAnnotation string `json:"requiredAnnotation,omitempty"` // Annotation required before templating
+	FailurePolicy      string `json:"failurePolicy,omitempty"`      // Fail or Ignore errors templating objects
+}
+
+// policyLister reads QuackPolicies from an informer's cache.
+type policyLister struct {
+	indexer cache.Indexer
+}
+
+// newPolicyInformer returns an informer for QuackPolicies in all namespaces.
+func newPolicyInformer(client dynamic.Interface) cache.SharedIndexInformer {
+	resourceClient := client.Resource(policyResource, metav1.NamespaceAll)
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return resourceClient.List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return resourceClient.Watch(options)
+			},
+		},
+		&unstructured.Unstructured{},
+		policyResyncPeriod,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
+}
+
+// get returns the QuackPolicy for a namespace, or an empty policy if the
+// namespace has none.
+func (l *policyLister) get(namespace string) (*QuackPolicy, error) {
+	objs, err := l.indexer.ByIndex(cache.NamespaceIndex, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list policies: %v", err)
+	}
+	if len(objs) == 0 {
+		return &QuackPolicy{}, nil
+	}
+	if len(objs) > 1 {
+		return nil, fmt.Errorf("found %d policies in namespace %s, expected at most 1", len(objs), namespace)
+	}
+
+	obj, ok := objs[0].(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected policy type %T", objs[0])
+	}
+	policy := &QuackPolicy{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert policy %s: %v", podID(obj.GetNamespace(), obj.GetName()), err)
+	}
+
+	err = validatePolicy(policy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %v", podID(policy.Namespace, policy.Name), err)
+	}
+	return policy, nil
+}
+
+func validatePolicy(policy *QuackPolicy) error {
+	if (policy.Spec.LeftDelim == "") != (policy.Spec.RightDelim == "") {
+		return fmt.Errorf("must set either both leftDelim and rightDelim, or neither")
+	}
+
+	switch policy.Spec.FailurePolicy {
+	case "", failurePolicyFail, failurePolicyIgnore:
+	default:
+		return fmt.Errorf("invalid failure policy %q, must be %q or %q", policy.Spec.FailurePolicy, failurePolicyFail, failurePolicyIgnore)
+	}
+	return nil
+}
+
+// getPolicy returns the QuackPolicy for a namespace, or an empty policy if
+// policies are disabled.
+func (ah *AdmissionHook) getPolicy(namespace string) (*QuackPolicy, error) {
+	if ah.policies == nil {
+		return &QuackPolicy{}, nil
+	}
+	return ah.policies.get(namespace)
+}
+
+// initializePolicies starts an informer for QuackPolicies and waits for its
+// cache to fill.
+func (ah *AdmissionHook) initializePolicies(client dynamic.Interface, stopCh <-chan struct{}) error {
+	informer := newPolicyInformer(client)
+	go informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		return fmt.Errorf("failed to sync policy cache")
+	}
+
+	ah.policies = &policyLister{indexer: informer.GetIndexer()}
+	return nil
+}
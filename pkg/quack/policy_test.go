@@ -0,0 +1,151 @@
+package quack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func newTestPolicy(namespace string, name string, spec map[string]interface{}) unstructured.Unstructured {
+	return unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "quack.pusher.com/v1alpha1",
+			"kind":       "QuackPolicy",
+			"metadata": map[string]interface{}{
+				"namespace": namespace,
+				"name":      name,
+			},
+			"spec": spec,
+		},
+	}
+}
+
+// initializeTestPolicies serves the policies to the AdmissionHook from a
+// fake dynamic client. The returned channel should be closed to stop the
+// informer.
+func initializeTestPolicies(t *testing.T, ah *AdmissionHook, policies ...unstructured.Unstructured) chan struct{} {
+	client := &dynamicfake.FakeClient{
+		GroupVersion: policyGroupVersion,
+		Fake:         &clienttesting.Fake{},
+	}
+	client.AddReactor("list", "quackpolicies", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, &unstructured.UnstructuredList{Items: policies}, nil
+	})
+	client.AddWatchReactor("quackpolicies", clienttesting.DefaultWatchReactor(watch.NewFake(), nil))
+
+	stopCh := make(chan struct{})
+	err := ah.initializePolicies(client, stopCh)
+	if err != nil {
+		close(stopCh)
+		assert.FailNowf(t, "methodError", "Error in initializePolicies: %v", err)
+	}
+	return stopCh
+}
+
+func TestGetPolicy(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+	stopCh := initializeTestPolicies(t, ah,
+		newTestPolicy("team-a", "quack", map[string]interface{}{
+			"leftDelim":          "[[",
+			"rightDelim":         "]]",
+			"requiredAnnotation": "team-a.example.com/template",
+			"failurePolicy":      "Ignore",
+		}),
+		newTestPolicy("team-b", "one", map[string]interface{}{}),
+		newTestPolicy("team-b", "two", map[string]interface{}{}),
+		newTestPolicy("team-c", "quack", map[string]interface{}{"leftDelim": "[["}),
+	)
+	defer close(stopCh)
+
+	policy, err := ah.getPolicy("team-a")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in getPolicy: %v", err)
+	}
+	assert.Equal(t, QuackPolicySpec{
+		LeftDelim:          "[[",
+		RightDelim:         "]]",
+		RequiredAnnotation: "team-a.example.com/template",
+		FailurePolicy:      failurePolicyIgnore,
+	}, policy.Spec, "Policy should be read from the namespace")
+
+	policy, err = ah.getPolicy("default")
+	assert.Nil(t, err, "Namespace without a policy should not return an error")
+	assert.Equal(t, QuackPolicySpec{}, policy.Spec, "Namespace without a policy should have an empty policy")
+
+	_, err = ah.getPolicy("team-b")
+	assert.NotNil(t, err, "Multiple policies in a namespace should return an error")
+
+	_, err = ah.getPolicy("team-c")
+	assert.NotNil(t, err, "Invalid policy should return an error")
+}
+
+func TestGetPolicyDisabled(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+
+	policy, err := ah.getPolicy("default")
+	assert.Nil(t, err, "Disabled policies should not return an error")
+	assert.Equal(t, QuackPolicySpec{}, policy.Spec, "Disabled policies should return an empty policy")
+}
+
+func TestAdmitPolicy(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.RequiredAnnotation = "quack.pusher.com/template"
+	stopCh := initializeTestPolicies(t, ah,
+		newTestPolicy("team-a", "quack", map[string]interface{}{
+			"leftDelim":          "[[",
+			"rightDelim":         "]]",
+			"requiredAnnotation": "team-a.example.com/template",
+		}),
+	)
+	defer close(stopCh)
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Namespace: "team-a",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"team-a.example.com/template": ""}}, "a": "[[ .A ]]"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[{"op": "replace", "path": "/a", "value": "alpha"}]`, string(resp.Patch), "Policy delimiters and annotation should be used")
+
+	resp = ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Namespace: "default",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"team-a.example.com/template": ""}}, "a": "{{ .A }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.Nil(t, resp.Patch, "Flags should be used in namespaces without a policy")
+}
+
+func TestAdmitPolicyFailurePolicy(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+	stopCh := initializeTestPolicies(t, ah,
+		newTestPolicy("ignore", "quack", map[string]interface{}{"failurePolicy": "Ignore"}),
+		newTestPolicy("fail", "quack", map[string]interface{}{"failurePolicy": "Fail"}),
+	)
+	defer close(stopCh)
+
+	for namespace, allowed := range map[string]bool{"ignore": true, "fail": false} {
+		resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Namespace: namespace,
+			Operation: admissionv1beta1.Create,
+			Object: runtime.RawExtension{
+				Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A "}`),
+			},
+		})
+		assert.Equal(t, allowed, resp.Allowed, "Failure in namespace %s should follow its policy", namespace)
+		assert.Nil(t, resp.Patch, "Failed request in namespace %s should not be patched", namespace)
+	}
+}
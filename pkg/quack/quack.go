@@ -2,211 +2,1666 @@ package quack
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	texttemplate "text/template"
+	"text/template/parse"
+	"time"
 
 	mergepatch "github.com/evanphx/json-patch"
+	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
 	"github.com/mattbaird/jsonpatch"
 	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	restclient "k8s.io/client-go/rest"
 )
 
 const (
 	lastAppliedConfigPath = "/metadata/annotations/kubectl.kubernetes.io~1last-applied-configuration"
-	quackAnnotationPrefix = "/metadata/annotations/quack.pusher.com"
+	annotationsPath       = "/metadata/annotations/"
 	leftDelimAnnotation   = "quack.pusher.com/left-delim"
 	rightDelimAnnotation  = "quack.pusher.com/right-delim"
+	delimPresetAnnotation = "quack.pusher.com/delim-preset"
+	jsonPatchAnnotation   = "quack.pusher.com/json-patch"
+	engineAnnotation      = "quack.pusher.com/engine"
+	patchRecordAnnotation = "quack.pusher.com/patch"
+	valuesKeysAnnotation  = "quack.pusher.com/values-keys"
+
+	quantityFieldsAnnotation       = "quack.pusher.com/quantity-fields"
+	durationFieldsAnnotation       = "quack.pusher.com/duration-fields"
+	ignorePathsAnnotation          = "quack.pusher.com/ignore-paths"
+	keepStatusAnnotation           = "quack.pusher.com/keep-status"
+	disableStatusRemovalAnnotation = "quack.pusher.com/disable-status-removal"
+	skipAnnotation                 = "quack.pusher.com/skip"
+
+	valuesMapAnnotation          = "quack.pusher.com/values-configmap"
+	valuesMapNamespaceAnnotation = "quack.pusher.com/values-configmap-namespace"
+
+	annotationsContextKey = "Annotations"
+	valuesHashContextKey  = "ValuesHash"
+	priorPatchContextKey  = "PriorPatch"
+	requestContextKey     = "Request"
+	uidContextKey         = "UID"
+
+	requiredAnnotationKey = "quack.required-annotation"
+	compressedValueSuffix = ".gz"
+	encodedValueSuffix    = ".b64"
+
+	defaultWebhookResource  = "admissionreviews"
+	defaultAnnotationDomain = "quack.pusher.com"
+	defaultStatusPath       = "/status"
+	statusSubresource       = "status"
+	specPath                = "/spec"
+
+	defaultActionTemplate = "template"
+	defaultActionSkip     = "skip"
+
+	engineHTML = "html"
+	engineText = "text"
+
+	logFormatText = "text"
+	logFormatJSON = "json"
 )
 
-// AdmissionHook implements the OpenShift MutatingAdmissionHook interface.
-// https://github.com/openshift/generic-admission-server/blob/v1.9.0/pkg/apiserver/apiserver.go#L45
-type AdmissionHook struct {
-	client             *kubernetes.Clientset // Kubernetes client for calling Api
-	ValuesMapName      string                // Source of templating values
-	ValuesMapNamespace string                // Namespace the configmap lives in
-	RequiredAnnotation string                // Annotation required before templating
-	IgnoredPaths       []string              // Paths to not patch
+// AdmissionHook implements the OpenShift MutatingAdmissionHook interface.
+// https://github.com/openshift/generic-admission-server/blob/v1.9.0/pkg/apiserver/apiserver.go#L45
+type AdmissionHook struct {
+	client                    kubernetes.Interface // Kubernetes client for calling Api
+	ValuesMapName             string               // Source of templating values
+	ValuesMapNamespace        string               // Namespace the configmap lives in
+	ValuesMapNamespaces       []string             // Further namespaces the configmap lives in, overriding ValuesMapNamespace in order of precedence
+	FallbackValuesMapName     string               // Configmap read in place of an empty configmap
+	ValuesMapOverlays         []string             // Configmaps whose values override the configmap, in order of precedence
+	OptionalValuesMapOverlays bool                 // Skip overlay configmaps that don't exist
+	AllowMissingValues        bool                 // Admit objects unchanged if a values configmap doesn't exist
+	ValuesSecretName          string               // Secret to load values from, overriding the configmap
+	ValuesSecretNamespace     string               // Namespace the secret lives in
+	AllowedValuesNamespaces   []string             // Namespaces values may be read from, all if empty
+	RequiredAnnotation        string               // Annotation required before templating
+	IgnoredPaths              []string             // Paths to not patch
+	DefaultsOnlyPaths         []string             // Paths only patched if unset in the object
+	StatusPath                string               // Path of the status, not patched unless kept, defaults to /status
+	ExposedAnnotations        []string             // Object annotations available to templates
+	PartialsMapName           string               // Source of named templates
+	SkipUnchanged             bool                 // Skip updates that only change generation/resourceVersion
+	VerboseResponses          bool                 // Explain skipped requests in the response
+	MaxPatchOps               int                  // Maximum operations in a patch, 0 for no limit
+	MaxAnnotations            int                  // Maximum annotations of the annotation domain, 0 for no limit
+	MaxTemplateDepth          int                  // Maximum nesting of partials, 0 for no limit
+	TemplateCacheSize         int                  // Maximum parsed templates cached, 0 to disable caching
+	RenderTimeout             time.Duration        // Maximum time to execute each template, 0 for no limit
+	IncludeKinds              []string             // Kinds to template
+	ExcludeKinds              []string             // Kinds not to template
+	DefaultAction             string               // Action for kinds neither included or excluded
+	AllowedPatchPaths         []string             // Path prefixes patches are restricted to
+	NamespaceValues           bool                 // Override values with the Values ConfigMap in the object's namespace
+	DecompressValues          bool                 // Decompress values with the compressedValueSuffix
+	DecodeValues              bool                 // Base64 decode values with the encodedValueSuffix
+	TemplateEngine            string               // Engine used unless set by the engineAnnotation
+	RecordPatch               bool                 // Record applied patches in the patchRecordAnnotation
+	PatchMode                 string               // Whether to return minimal patches or replace whole fields
+	LogFormat                 string               // Format of per request logs, text or json
+	PatchLog                  bool                 // Write a record of each applied patch to stdout
+	EnablePolicies            bool                 // Read configuration from QuackPolicies
+	ListItemFailure           string               // Whether to fail or skip list items that fail to render
+	TrackValueUsage           bool                 // Count the objects referencing each value
+	DeprecatedKeys            []string             // Deprecated value keys and their replacements, as old=new
+	LegacyAnnotations         []string             // Legacy annotation names and their replacements, as old=new
+	WebhookResource           string               // Resource the webhook is served as, determining its path
+	HealthBindAddress         string               // Address to serve health endpoints on, disabled if empty
+	MetricsBindAddress        string               // Address to serve metrics on, disabled if empty
+	ValuesStaleAfter          time.Duration        // Age after which values are reported stale, 0 to disable
+	ValuesRefreshInterval     time.Duration        // Interval to reload values at instead of watching them, 0 to watch
+	AnnotationDomain          string               // Domain of annotations configuring quack
+	DefaultAnnotations        []string             // Annotations added to objects without them, as key=template
+	DefaultLabels             []string             // Labels added to objects without them, as key=template
+	LenientDelimiters         bool                 // Use default delimiters when the delimiter annotations are invalid
+	RequireFullRender         bool                 // Reject objects containing delimiters once rendered
+	EnableSprig               bool                 // Make Sprig functions available to templates
+	EnableLookups             bool                 // Allow templates to read objects referenced by annotations
+	FailureCode               int                  // Status code of rejected requests, 500 if unset
+	FailurePolicy             string               // Whether to Fail or Ignore requests that fail to template
+	WebhookConfigurationName  string               // MutatingWebhookConfiguration whose failurePolicy is checked at startup, if set
+	EventOnRenderError        bool                 // Record an Event on objects admitted unchanged after failing to template
+	WarnAnnotationMismatch    bool                 // Warn when the required annotation has the wrong value
+	KeyStyle                  string               // Style value keys are renamed to in templates, if set
+	StructuredValuesKey       string               // Values key holding YAML of nested values, if set
+	StrictValues              bool                 // Reject objects referencing missing values
+	logOutput                 io.Writer            // Destination of json logs, defaults to stderr
+	patchLogOutput            io.Writer            // Destination of patch records, defaults to stdout
+	policies                  *policyLister        // Source of QuackPolicies, if enabled
+	lookupClients             dynamic.ClientPool   // Clients for objects referenced by annotations, if enabled
+	discoveredResources       resourceCache        // Resources discovered for lookups
+	namespaceValues           namespaceValuesCache // Values ConfigMaps fetched from object namespaces
+	deprecatedKeys            map[string]string    // Parsed DeprecatedKeys
+	legacyAnnotations         map[string]string    // Parsed LegacyAnnotations
+	defaultAnnotations        map[string]string    // Parsed DefaultAnnotations
+	defaultLabels             map[string]string    // Parsed DefaultLabels
+	valuesStatus              valuesStatus         // When the values were last loaded
+	stats                     admissionStats       // Outcomes of requests since startup
+	valuesCache               *valuesCache         // Watches the Values ConfigMap, if started
+	valuesSnapshot            *valuesSnapshot      // Periodically refreshed Values ConfigMap, if started
+	templateCache             *templateCache       // Parsed templates, if TemplateCacheSize is set
+	initialized               int32                // Set atomically once Initialize has succeeded
+}
+
+// Initialize configures the AdmissionHook.
+//
+// Initializes connection Kubernetes Client
+func (ah *AdmissionHook) Initialize(kubeClientConfig *restclient.Config, stopCh <-chan struct{}) error {
+	// Initialise a Kubernetes client
+	client, err := kubernetes.NewForConfig(kubeClientConfig)
+	if err != nil {
+		return fmt.Errorf("failed to intialise kubernetes clientset: %v", err)
+	}
+
+	err = ah.initialize(client)
+	if err != nil {
+		return err
+	}
+	ah.initializeValuesCache(stopCh)
+	ah.checkWebhookFailurePolicy()
+
+	if ah.EnableLookups {
+		ah.lookupClients = dynamic.NewDynamicClientPool(kubeClientConfig)
+	}
+
+	if ah.EnablePolicies {
+		policyConfig := *kubeClientConfig
+		policyConfig.GroupVersion = &policyGroupVersion
+		policyConfig.APIPath = "/apis"
+		policyClient, err := dynamic.NewClient(&policyConfig)
+		if err != nil {
+			return fmt.Errorf("failed to intialise policy client: %v", err)
+		}
+		err = ah.initializePolicies(policyClient, stopCh)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ah.HealthBindAddress != "" {
+		go ah.serveHealth(stopCh)
+	}
+	if ah.MetricsBindAddress != "" {
+		go ah.serveMetrics(stopCh)
+	}
+
+	gvr, _ := ah.MutatingResource()
+	glog.Infof("Serving webhook at %s", servingPath(gvr))
+	ah.markInitialized()
+	glog.Info("Webhook Initialization Complete.")
+	return nil
+}
+
+// initialize validates the configuration of the AdmissionHook and sets the
+// client used to load values.
+func (ah *AdmissionHook) initialize(client kubernetes.Interface) error {
+	ah.client = client
+
+	switch ah.DefaultAction {
+	case "", defaultActionTemplate, defaultActionSkip:
+	default:
+		return fmt.Errorf("invalid default action %q, must be %q or %q", ah.DefaultAction, defaultActionTemplate, defaultActionSkip)
+	}
+
+	if ah.TemplateEngine == "" {
+		ah.TemplateEngine = engineText
+	}
+	err := validateEngine(ah.TemplateEngine)
+	if err != nil {
+		return err
+	}
+
+	switch ah.ListItemFailure {
+	case "", listItemFailureFail, listItemFailureSkip:
+	default:
+		return fmt.Errorf("invalid list item failure %q, must be %q or %q", ah.ListItemFailure, listItemFailureFail, listItemFailureSkip)
+	}
+
+	ah.deprecatedKeys, err = parsePairs(ah.DeprecatedKeys)
+	if err != nil {
+		return fmt.Errorf("invalid deprecated keys: %v", err)
+	}
+	ah.legacyAnnotations, err = parsePairs(ah.LegacyAnnotations)
+	if err != nil {
+		return fmt.Errorf("invalid legacy annotations: %v", err)
+	}
+	ah.defaultAnnotations, err = parsePairs(ah.DefaultAnnotations)
+	if err != nil {
+		return fmt.Errorf("invalid default annotations: %v", err)
+	}
+	ah.defaultLabels, err = parsePairs(ah.DefaultLabels)
+	if err != nil {
+		return fmt.Errorf("invalid default labels: %v", err)
+	}
+
+	switch ah.LogFormat {
+	case "", logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("invalid log format %q, must be %q or %q", ah.LogFormat, logFormatText, logFormatJSON)
+	}
+
+	err = validateKeyStyle(ah.KeyStyle)
+	if err != nil {
+		return err
+	}
+
+	err = validatePatchMode(ah.PatchMode)
+	if err != nil {
+		return err
+	}
+
+	switch ah.FailurePolicy {
+	case "", failurePolicyFail, failurePolicyIgnore:
+	default:
+		return fmt.Errorf("invalid failure policy %q, must be %q or %q", ah.FailurePolicy, failurePolicyFail, failurePolicyIgnore)
+	}
+
+	namespaces := ah.valuesMapNamespaces()
+	if ah.ValuesSecretName != "" {
+		namespaces = append(namespaces, ah.ValuesSecretNamespace)
+	}
+	err = ah.checkValuesNamespaces("", namespaces...)
+	if err != nil {
+		return err
+	}
+
+	if ah.TemplateCacheSize > 0 {
+		ah.templateCache, err = newTemplateCache(ah.TemplateCacheSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ah.FailureCode != 0 && (ah.FailureCode < 400 || ah.FailureCode > 599) {
+		return fmt.Errorf("invalid failure code %d, must be a 4xx or 5xx status", ah.FailureCode)
+	}
+
+	// Add lastAppliedConfigPath to ignored paths, unless it's already present
+	if !contains(ah.IgnoredPaths, lastAppliedConfigPath) {
+		ah.IgnoredPaths = append(ah.IgnoredPaths, lastAppliedConfigPath)
+	}
+
+	return nil
+}
+
+// MutatingResource defines where the Webhook is hosted.
+// The generic-admission-server serves the webhook at the path derived from
+// the resource by servingPath.
+func (ah *AdmissionHook) MutatingResource() (schema.GroupVersionResource, string) {
+	resource := ah.WebhookResource
+	if resource == "" {
+		resource = defaultWebhookResource
+	}
+	return schema.GroupVersionResource{
+			Group:    "quack.pusher.com",
+			Version:  "v1alpha1",
+			Resource: resource,
+		},
+		"AdmissionReview"
+}
+
+// servingPath returns the path the generic-admission-server serves a
+// webhook's resource at.
+func servingPath(gvr schema.GroupVersionResource) string {
+	return fmt.Sprintf("/apis/%s/%s/%s", gvr.Group, gvr.Version, gvr.Resource)
+}
+
+// Admit is the actual business logic of the webhook.
+// This is the method that processes the request to the admission controller.
+//
+// Checks the operation is a create or update operation.
+// Loads the template values from the configmap.
+// Templates the values into the raw object (json) from the admission request.
+// Calculates a JSON Patch to append to the admission response.
+// Only admission.k8s.io/v1beta1 requests are served, as the admission server
+// Quack is built on predates admission.k8s.io/v1.
+func (ah *AdmissionHook) Admit(req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	start := time.Now()
+	resp := ah.admitWithPolicy(req)
+	if !resp.Allowed && resp.Result != nil && ah.FailureCode != 0 {
+		resp.Result.Code = int32(ah.FailureCode)
+	}
+	ah.stats.record(resp)
+	switch decision(resp) {
+	case decisionPatched:
+		countRequest(req.Operation, outcomePatched)
+	case decisionDenied:
+		countRequest(req.Operation, outcomeError)
+	}
+	if ah.LogFormat == logFormatJSON {
+		ah.logAdmission(req, resp, time.Since(start))
+	}
+	if ah.PatchLog && decision(resp) == decisionPatched {
+		ah.logPatch(req, resp.Patch)
+	}
+	return resp
+}
+
+// admitWithPolicy admits the request according to the QuackPolicy for its
+// namespace, allowing the request unchanged on failure if the policy, or
+// otherwise the FailurePolicy, ignores failures.
+func (ah *AdmissionHook) admitWithPolicy(req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	log := newRequestLogger(req)
+	var resp *admissionv1beta1.AdmissionResponse
+	failurePolicy := ah.FailurePolicy
+	policy, err := ah.getPolicy(req.Namespace)
+	if err != nil {
+		resp = errorResponse(&admissionv1beta1.AdmissionResponse{UID: req.UID}, "Failed to get policy: %v", err)
+	} else {
+		resp = ah.admit(req, policy)
+		if policy.Spec.FailurePolicy != "" {
+			failurePolicy = policy.Spec.FailurePolicy
+		}
+	}
+
+	if !resp.Allowed && resp.Result != nil {
+		log.Errorf("Failed %s request for %s: %s", req.Operation, podID(req.Namespace, req.Name), resp.Result.Message)
+	}
+
+	if !resp.Allowed && failurePolicy == failurePolicyIgnore {
+		log.Warningf("Allowing %s request for %s unchanged: Failure ignored by failure policy.", req.Operation, podID(req.Namespace, req.Name))
+		if ah.EventOnRenderError && resp.Result != nil {
+			ah.recordFailureEvent(req, resp.Result.Message)
+		}
+		ah.stats.markErrored()
+		countRequest(req.Operation, outcomeError)
+		return &admissionv1beta1.AdmissionResponse{
+			UID:     req.UID,
+			Allowed: true,
+		}
+	}
+	return resp
+}
+
+func (ah *AdmissionHook) admit(req *admissionv1beta1.AdmissionRequest, policy *QuackPolicy) *admissionv1beta1.AdmissionResponse {
+	log := newRequestLogger(req)
+	resp := &admissionv1beta1.AdmissionResponse{}
+	resp.UID = req.UID
+	requestName := requestName(req)
+
+	// Skip operations that aren't create or update
+	if req.Operation != admissionv1beta1.Create &&
+		req.Operation != admissionv1beta1.Update {
+		return ah.skipResponse(resp, req, skipReasonOperation, "Skipping %s request for %s: Operation not templated.", req.Operation, requestName)
+	}
+
+	// Skip requests without an object, there is nothing to template
+	if len(req.Object.Raw) == 0 {
+		return ah.skipResponse(resp, req, skipReasonNoObject, "Skipping %s request for %s: No object in request.", req.Operation, requestName)
+	}
+
+	// Skip kinds that shouldn't be templated
+	if !ah.kindAllowed(req.Kind) {
+		return ah.skipResponse(resp, req, skipReasonKind, "Skipping %s request for %s: Kind not templated.", req.Operation, requestName)
+	}
+
+	objectMeta, err := getObjectMeta(req.Object.Raw)
+	if err != nil {
+		return errorResponse(resp, "Failed to read object metadata: %v", err)
+	}
+
+	// Skip objects that opt out of templating, regardless of the required annotation
+	if objectMeta.Annotations[domainAnnotation(skipAnnotation, ah.annotationDomain())] == "true" {
+		return ah.skipResponse(resp, req, skipReasonSkipAnnotation, "Skipping %s request for %s: Object opted out with %s.", req.Operation, requestName, domainAnnotation(skipAnnotation, ah.annotationDomain()))
+	}
+
+	// Skip requests that do not have the required annotation, before loading
+	// the values, so objects that aren't templated never depend on them.
+	// The Values ConfigMap is read at most once, for both the required
+	// annotation and the values, so requests use a single version of it.
+	mapValues := ah.mapValuesOnce()
+	requiredAnnotation := policy.Spec.RequiredAnnotation
+	if requiredAnnotation == "" {
+		requiredAnnotation = ah.getRequiredAnnotation(log, mapValues)
+	}
+	annototationPresent, err := requestHasAnnotation(log, requiredAnnotation, req.Object.Raw, ah.legacyAnnotations)
+	if err != nil {
+		return errorResponse(resp, "Failed to read annotations: %v", err)
+	}
+	if !annototationPresent {
+		if ah.WarnAnnotationMismatch {
+			name, expected, _ := splitRequiredAnnotation(requiredAnnotation)
+			if actual, ok := migrateAnnotations(log, objectMeta.Annotations, ah.legacyAnnotations)[name]; ok {
+				log.Warningf("Skipping %s request for %s: Required annotation %s has value %q, expected %q.", req.Operation, requestName, name, actual, expected)
+				return ah.skipResponse(resp, req, skipReasonRequiredAnnotation, "Skipping %s request for %s: Required annotation %s has value %q, expected %q.", req.Operation, requestName, name, actual, expected)
+			}
+		}
+		return ah.skipResponse(resp, req, skipReasonRequiredAnnotation, "Skipping %s request for %s: Required annotation not present.", req.Operation, requestName)
+	}
+
+	// Load template values from configmap
+	valuesStart := time.Now()
+	values, valuesVersion, valuesErr := ah.loadValues(log, objectMeta, req.Namespace, req.UserInfo, mapValues)
+	if valuesErr == nil {
+		// Configures the required annotation, so isn't available to templates
+		delete(values, requiredAnnotationKey)
+	}
+	// Only objects being templated read the values of their namespace, so
+	// namespace values can't change the required annotation
+	if valuesErr == nil && ah.NamespaceValues {
+		values, valuesVersion, valuesErr = ah.overrideNamespaceValues(log, values, valuesVersion, req.Namespace)
+	}
+	observeDuration(stageValues, valuesStart)
+	if notFound, ok := valuesErr.(*configMapNotFoundError); ok {
+		if ah.AllowMissingValues {
+			return ah.skipResponse(resp, req, skipReasonMissingValues, "Skipping %s request for %s: Values ConfigMap %s not found in namespaces %v.", req.Operation, requestName, notFound.name, notFound.namespaces)
+		}
+		return errorResponse(resp, "Values ConfigMap %s not found in namespaces %v", notFound.name, notFound.namespaces)
+	}
+	if valuesErr != nil {
+		return errorResponse(resp, "Failed to get template values: %v", valuesErr)
+	}
+
+	log.Infof(2, "Processing %s request for %s with values %s", req.Operation, requestName, valuesVersion)
+
+	// Load named templates from configmap
+	partials := map[string]string{}
+	if ah.PartialsMapName != "" {
+		partials, _, err = getValues(ah.client, ah.valuesMapNamespaces(), ah.PartialsMapName)
+		if err != nil {
+			return errorResponse(resp, "Failed to get partials: %v", err)
+		}
+	}
+
+	if ah.DecompressValues {
+		values, err = decompressValues(values)
+		if err != nil {
+			return errorResponse(resp, "Failed to decompress template values: %v", err)
+		}
+		partials, err = decompressValues(partials)
+		if err != nil {
+			return errorResponse(resp, "Failed to decompress partials: %v", err)
+		}
+	}
+
+	if ah.DecodeValues {
+		values, err = decodeValues(values)
+		if err != nil {
+			return errorResponse(resp, "Failed to decode template values: %v", err)
+		}
+	}
+
+	delims, err := getDelims(log, req.Object.Raw, ah.annotationDomain(), ah.legacyAnnotations)
+	if err != nil && ah.LenientDelimiters {
+		log.Warningf("Using default delimiters for %s: Invalid delimiters: %v", requestName, err)
+		delims, err = delimiters{}, nil
+	}
+	if err != nil {
+		return errorResponse(resp, "Invalid delimiters: %v", err)
+	}
+	if policy.Spec.LeftDelim != "" {
+		delims = delimiters{
+			left:  policy.Spec.LeftDelim,
+			right: policy.Spec.RightDelim,
+		}
+	}
+
+	values, restricted, err := restrictValues(values, objectMeta, ah.annotationDomain())
+	if err != nil {
+		return errorResponse(resp, "Invalid %s: %v", domainAnnotation(valuesKeysAnnotation, ah.annotationDomain()), err)
+	}
+	values, err = transformKeys(values, ah.KeyStyle)
+	if err != nil {
+		return errorResponse(resp, "Failed to transform value keys: %v", err)
+	}
+	data := templateContext(values, objectMeta, ah.ExposedAnnotations)
+	if ah.StructuredValuesKey != "" {
+		err = mergeStructuredValues(data, ah.StructuredValuesKey)
+		if err != nil {
+			return errorResponse(resp, "Failed to parse structured values: %v", err)
+		}
+	}
+	data[requestContextKey] = requestContext{
+		UserInfo: req.UserInfo,
+		Kind:     req.Kind,
+	}
+	if ah.RecordPatch {
+		priorPatch, err := getPriorPatch(req, ah.annotationDomain())
+		if err != nil {
+			return errorResponse(resp, "Failed to read prior patch: %v", err)
+		}
+		data[priorPatchContextKey] = priorPatch
+	}
+	parent, err := ah.getParent(objectMeta, req.Namespace, req.UserInfo)
+	if err != nil {
+		return errorResponse(resp, "Failed to get parent object: %v", err)
+	}
+	if parent != nil {
+		data[parentContextKey] = parent
+	}
+
+	engine, err := getEngine(objectMeta, ah.annotationDomain(), ah.TemplateEngine)
+	if err != nil {
+		return errorResponse(resp, "Invalid template engine: %v", err)
+	}
+
+	ignoredPaths := objectIgnoredPaths(objectMeta, ah.annotationDomain(), ah.IgnoredPaths)
+	// Updates of the status subresource can't change the spec, so the status
+	// is templated in its place
+	if req.SubResource == statusSubresource {
+		ignoredPaths = append(ignoredPaths, specPath)
+	}
+	// Guard against objects with so many annotations that removing them from
+	// the template input, one patch at a time, is excessively slow
+	domainAnnotations := countDomainAnnotations(objectMeta.Annotations, ah.annotationDomain(), ah.legacyAnnotations)
+	if ah.MaxAnnotations > 0 && domainAnnotations > ah.MaxAnnotations {
+		return errorResponse(resp, "Object has %d %s annotations, exceeding the maximum of %d", domainAnnotations, ah.annotationDomain(), ah.MaxAnnotations)
+	}
+	templateInput, err := getTemplateInput(req.Object.Raw, ah.annotationDomain(), ah.legacyAnnotations, ah.statusPath(), ignoredPaths, req.SubResource)
+	if err != nil {
+		return errorResponse(resp, "Error creating template input: %v", err)
+	}
+	// Run Templating
+	log.Infof(6, "Input for %s: %s", requestName, templateInput)
+
+	funcs := templateFuncs(ah.EnableSprig)
+	funcs["derive"] = deriveFunc(req.Kind, req.Namespace, objectMeta.Name)
+	// valueFor skips the object's namespace if values may not be read from it
+	valueForNamespace := req.Namespace
+	if !ah.valuesNamespaceAllowed(valueForNamespace, req.Namespace) {
+		valueForNamespace = ""
+	}
+	funcs["valueFor"] = valueForFunc(ah.client, ah.ValuesMapName, valueForNamespace, objectMeta, ah.annotationDomain(), values)
+	funcs["hasGroup"] = hasGroupFunc(req.UserInfo.Groups)
+	funcs["apiVersionIs"] = apiVersionIsFunc(req.Kind)
+	funcs["configMapData"] = configMapDataFunc(ah.client, ah.EnableLookups, ah.lookupAuthorizer(req))
+	funcs["lookup"] = lookupFunc(ah.client, ah.EnableLookups, ah.lookupAuthorizer(req))
+	opts := templateOptions{
+		engine:          engine,
+		delims:          delims,
+		partials:        partials,
+		funcs:           funcs,
+		allowedFuncs:    allowedFuncs(objectMeta, ah.annotationDomain()),
+		missingKeyError: restricted || ah.StrictValues,
+		maxDepth:        ah.MaxTemplateDepth,
+		timeout:         ah.RenderTimeout,
+		cache:           ah.templateCache,
+	}
+	// Warn about deprecated values, without failing the request
+	warnings := []string{}
+	if len(ah.deprecatedKeys) > 0 {
+		deprecatedWarnings, err := deprecatedKeyWarnings(templateInput, opts, ah.deprecatedKeys)
+		if err != nil {
+			log.Infof(4, "Failed to check %s for deprecated values: %v", requestName, err)
+		}
+		warnings = append(warnings, deprecatedWarnings...)
+	}
+	if ah.TrackValueUsage {
+		err = ah.countValueReferences(templateInput, opts, values)
+		if err != nil {
+			log.Infof(4, "Failed to count values referenced by %s: %v", requestName, err)
+		}
+	}
+
+	renderStart := time.Now()
+	var output []byte
+	if isList(templateInput) {
+		var skippedItems []string
+		output, skippedItems, err = ah.renderList(templateInput, data, opts)
+		if len(skippedItems) > 0 {
+			warnings = append(warnings, fmt.Sprintf("Skipped rendering items: %s", strings.Join(skippedItems, ", ")))
+		}
+	} else {
+		output, err = renderTemplate(templateInput, data, opts)
+	}
+	observeDuration(stageRender, renderStart)
+	if err != nil {
+		return errorResponse(resp, "Error rendering template: %v", err)
+	}
+	log.Infof(6, "Output for %s: %s", requestName, output)
+
+	err = validateOutput(log, output)
+	if err != nil {
+		return errorResponse(resp, "Invalid rendered object: %v", err)
+	}
+
+	// Merge any shared template the object refers to onto the rendered object
+	if ref, ok := objectMeta.Annotations[domainAnnotation(templateRefAnnotation, ah.annotationDomain())]; ok {
+		output, err = mergeTemplateRef(log, output, ref, req.Kind, values, data, opts)
+		if err != nil {
+			return errorResponse(resp, "Invalid %s: %v", domainAnnotation(templateRefAnnotation, ah.annotationDomain()), err)
+		}
+	}
+
+	err = validateFields(objectMeta, ah.annotationDomain(), output)
+	if err != nil {
+		return errorResponse(resp, "Invalid rendered field: %v", err)
+	}
+
+	// Leftover delimiters indicate the object was only partially rendered
+	if leftDelim := delims.leftDelim(); bytes.Contains(output, []byte(leftDelim)) {
+		if ah.RequireFullRender {
+			return errorResponse(resp, "Rendered object contains the left delimiter %q", leftDelim)
+		}
+		warnings = append(warnings, fmt.Sprintf("Rendered object contains the left delimiter %q", leftDelim))
+	}
+
+	// Create a JSON Patch
+	// https://tools.ietf.org/html/rfc6902
+	// The patch is always calculated against the incoming object, never the
+	// OldObject, so unrendered templates left on the old object by a previous
+	// write can't produce spurious operations.
+	patchBytes, err := ah.createPatch(req.Object.Raw, output, ignoredPaths, req.SubResource)
+	if err != nil {
+		return errorResponse(resp, "Error creating patch: %v", err)
+	}
+
+	// Append any user supplied patch operations after the computed patch
+	userPatch, err := getUserPatch(req.Object.Raw, ah.annotationDomain(), data, opts)
+	if err != nil {
+		return errorResponse(resp, "Error reading user patch: %v", err)
+	}
+	if userPatch != nil {
+		log.Infof(6, "User patch for %s: %s", requestName, string(userPatch))
+		// Like the templated patch, the user patch may only change the status
+		// if it is kept
+		userPatch, err = ah.filterStatusOps(userPatch, keepStatus(objectMeta, ah.annotationDomain()) || req.SubResource == statusSubresource)
+		if err != nil {
+			return errorResponse(resp, "Invalid user patch: %v", err)
+		}
+		err = ah.checkPatchPaths(userPatch)
+		if err != nil {
+			return errorResponse(resp, "Invalid user patch: %v", err)
+		}
+		patchBytes, err = combinePatches(req.Object.Raw, patchBytes, userPatch)
+		if err != nil {
+			return errorResponse(resp, "Error combining user patch: %v", err)
+		}
+	}
+
+	// Add default annotations and labels the object doesn't already have
+	if len(ah.defaultAnnotations) > 0 || len(ah.defaultLabels) > 0 {
+		patched, err := applyPatch(req.Object.Raw, patchBytes)
+		if err != nil {
+			return errorResponse(resp, "Error applying patch: %v", err)
+		}
+		defaultPatch, err := defaultMetadataPatch(log, patched, data, opts, ah.defaultAnnotations, ah.defaultLabels)
+		if err != nil {
+			return errorResponse(resp, "Error rendering defaults: %v", err)
+		}
+		if defaultPatch != nil {
+			err = ah.checkPatchPaths(defaultPatch)
+			if err != nil {
+				return errorResponse(resp, "Invalid defaults: %v", err)
+			}
+			patchBytes, err = combinePatches(req.Object.Raw, patchBytes, defaultPatch)
+			if err != nil {
+				return errorResponse(resp, "Error combining defaults: %v", err)
+			}
+		}
+	}
+
+	// Only patch the defaults only paths the object doesn't already set
+	if len(ah.DefaultsOnlyPaths) > 0 {
+		patchBytes, err = defaultsOnlyPatch(log, req.Object.Raw, patchBytes, ah.DefaultsOnlyPaths)
+		if err != nil {
+			return errorResponse(resp, "Error filtering defaults only paths: %v", err)
+		}
+	}
+
+	// Record the patch on the object so later requests can refer to it
+	if ah.RecordPatch && string(patchBytes) != "[]" {
+		patchBytes, err = recordPatch(req.Object.Raw, ah.annotationDomain(), patchBytes)
+		if err != nil {
+			return errorResponse(resp, "Error recording patch: %v", err)
+		}
+		err = ah.checkPatchPaths(patchBytes)
+		if err != nil {
+			return errorResponse(resp, "Invalid patch record: %v", err)
+		}
+	}
+
+	// Replace the whole object for clients that can't handle minimal patches
+	if ah.PatchMode == patchModeFullReplace && string(patchBytes) != "[]" {
+		patchBytes, err = fullReplacePatch(req.Object.Raw, patchBytes)
+		if err != nil {
+			return errorResponse(resp, "Error creating full replace patch: %v", err)
+		}
+	}
+
+	// Skip updates where rendering the object reproduces the existing object
+	if ah.SkipUnchanged && req.Operation == admissionv1beta1.Update {
+		unchanged, err := requestUnchanged(req.OldObject.Raw, req.Object.Raw, patchBytes)
+		if err != nil {
+			return errorResponse(resp, "Failed to compare objects: %v", err)
+		}
+		if unchanged {
+			return ah.skipResponse(resp, req, skipReasonUnchanged, "Skipping %s request for %s: Object unchanged.", req.Operation, requestName)
+		}
+	}
+
+	// Guard against templates producing excessively large patches, counting
+	// every operation returned, however it was added
+	if ops := patchOps(patchBytes); ah.MaxPatchOps > 0 && ops > ah.MaxPatchOps {
+		return errorResponse(resp, "Patch has %d operations, exceeding the maximum of %d", ops, ah.MaxPatchOps)
+	}
+
+	// If the patch is non-zero, append it
+	if string(patchBytes) != "[]" {
+		log.Infof(2, "Patching %s", requestName)
+		log.Infof(4, "Patch for %s: %s", requestName, string(patchBytes))
+		resp.Patch = patchBytes
+		resp.PatchType = func() *admissionv1beta1.PatchType {
+			pt := admissionv1beta1.PatchTypeJSONPatch
+			return &pt
+		}()
+	} else {
+		countRequest(req.Operation, outcomeNoChange)
+	}
+
+	if len(warnings) > 0 {
+		for _, warning := range warnings {
+			log.Warningf("Warning for %s: %s", requestName, warning)
+		}
+		if ah.VerboseResponses {
+			resp.Result = &metav1.Status{
+				Status:  metav1.StatusSuccess,
+				Message: strings.Join(warnings, "; "),
+			}
+		}
+	}
+
+	resp.Allowed = true
+	return resp
+}
+
+// templateOptions configures how templates are parsed by renderTemplate.
+type templateOptions struct {
+	engine   string            // Template engine, text unless set to html
+	delims   delimiters        // Delimiters for actions in the input and partials
+	partials map[string]string // Named templates the input may invoke
+	funcs    template.FuncMap  // Functions available to the input and partials
+
+	allowedFuncs map[string]bool // Names of the only functions available, if set
+
+	missingKeyError bool           // Fail rendering when the input references a missing key
+	maxDepth        int            // Maximum nesting of partials, 0 for no limit
+	timeout         time.Duration  // Maximum time to execute the template, 0 for no limit
+	cache           *templateCache // Parsed templates to reuse, if set
+}
+
+// executor is implemented by both html/template and text/template templates.
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// renderTemplate executes the input as a template against data.
+// Each partial is parsed as a named template which the input may invoke.
+func renderTemplate(input []byte, data interface{}, opts templateOptions) ([]byte, error) {
+	rawJSON := &jsonValues{}
+	funcs := template.FuncMap{}
+	for name, f := range opts.funcs {
+		funcs[name] = f
+	}
+	funcs["toJson"] = rawJSON.toJSON
+	funcs["required"] = required
+	funcs = limitFuncs(funcs, opts.allowedFuncs)
+
+	tmpl, err := opts.cache.parse(input, opts, funcs)
+	if err != nil {
+		return nil, err
+	}
+
+	rendered, err := executeTemplate(tmpl, data, opts.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute template: %v", err)
+	}
+
+	output, err := rawJSON.replace(rendered)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert JSON values: %v", err)
+	}
+	return output, nil
+}
+
+// parseHTMLTemplate parses the input and partials with html/template, which
+// escapes values for HTML.
+func parseHTMLTemplate(input []byte, opts templateOptions, funcs template.FuncMap) (*template.Template, error) {
+	tmpl := template.New("object").Delims(opts.delims.left, opts.delims.right).Funcs(funcs)
+	if opts.missingKeyError {
+		tmpl = tmpl.Option("missingkey=error")
+	}
+	for name, partial := range opts.partials {
+		_, err := tmpl.New(name).Parse(partial)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse partial %s: %v", name, err)
+		}
+	}
+
+	_, err := tmpl.Parse(string(input))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %v", err)
+	}
+
+	if opts.delims.trim {
+		for _, t := range tmpl.Templates() {
+			trimActions(t.Tree)
+		}
+	}
+	if opts.maxDepth > 0 {
+		trees := map[string]*parse.Tree{}
+		for _, t := range tmpl.Templates() {
+			trees[t.Name()] = t.Tree
+		}
+		err = checkTemplateDepth(trees, tmpl.Name(), opts.maxDepth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tmpl, nil
+}
+
+// parseTextTemplate parses the input and partials with text/template, which
+// renders values unescaped.
+func parseTextTemplate(input []byte, opts templateOptions, funcs texttemplate.FuncMap) (*texttemplate.Template, error) {
+	tmpl := texttemplate.New("object").Delims(opts.delims.left, opts.delims.right).Funcs(funcs)
+	if opts.missingKeyError {
+		tmpl = tmpl.Option("missingkey=error")
+	}
+	for name, partial := range opts.partials {
+		_, err := tmpl.New(name).Parse(partial)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse partial %s: %v", name, err)
+		}
+	}
+
+	_, err := tmpl.Parse(string(input))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %v", err)
+	}
+
+	if opts.delims.trim {
+		for _, t := range tmpl.Templates() {
+			trimActions(t.Tree)
+		}
+	}
+	if opts.maxDepth > 0 {
+		trees := map[string]*parse.Tree{}
+		for _, t := range tmpl.Templates() {
+			trees[t.Name()] = t.Tree
+		}
+		err = checkTemplateDepth(trees, tmpl.Name(), opts.maxDepth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tmpl, nil
+}
+
+// getEngine returns the template engine requested by the engineAnnotation in
+// the annotation domain, defaulting to defaultEngine.
+func getEngine(objectMeta metav1.ObjectMeta, domain string, defaultEngine string) (string, error) {
+	engine, ok := objectMeta.Annotations[domainAnnotation(engineAnnotation, domain)]
+	if !ok {
+		return defaultEngine, nil
+	}
+
+	err := validateEngine(engine)
+	if err != nil {
+		return "", err
+	}
+	return engine, nil
+}
+
+func validateEngine(engine string) error {
+	if engine != engineHTML && engine != engineText {
+		return fmt.Errorf("invalid template engine %q, must be %q or %q", engine, engineHTML, engineText)
+	}
+	return nil
+}
+
+// kindAllowed determines whether objects of a kind should be templated.
+// Kinds that are neither included or excluded follow the DefaultAction, which
+// if unset, skips them only when IncludeKinds is set.
+func (ah *AdmissionHook) kindAllowed(kind metav1.GroupVersionKind) bool {
+	if kindListed(ah.ExcludeKinds, kind) {
+		return false
+	}
+	if kindListed(ah.IncludeKinds, kind) {
+		return true
+	}
+
+	switch ah.DefaultAction {
+	case defaultActionTemplate:
+		return true
+	case defaultActionSkip:
+		return false
+	default:
+		return len(ah.IncludeKinds) == 0
+	}
+}
+
+// kindListed determines whether a kind is in the list.
+// Kinds may be listed as Kind, matching the kind in any group, or as
+// Kind.group, e.g. Deployment.apps, matching only the kind in that group.
+func kindListed(kinds []string, kind metav1.GroupVersionKind) bool {
+	for _, listed := range kinds {
+		parts := strings.SplitN(listed, ".", 2)
+		if parts[0] != kind.Kind {
+			continue
+		}
+		if len(parts) == 1 || parts[1] == kind.Group {
+			return true
+		}
+	}
+	return false
+}
+
+// getRequiredAnnotation returns the required annotation set in the Values
+// ConfigMap, defaulting to RequiredAnnotation.
+// The ConfigMap is cached, so checking the required annotation doesn't load
+// the values of objects that aren't templated.
+// If the ConfigMap is missing or can't be read, RequiredAnnotation is used, so
+// objects that aren't templated are never rejected because of the values.
+func (ah *AdmissionHook) getRequiredAnnotation(log requestLogger, mapValues func() (map[string]string, string, error)) string {
+	if ah.ValuesMapName == "" {
+		return ah.RequiredAnnotation
+	}
+	values, _, err := mapValues()
+	if err != nil {
+		log.Infof(4, "Failed to read the required annotation from the values, using %q: %v", ah.RequiredAnnotation, err)
+		return ah.RequiredAnnotation
+	}
+	return ah.requiredAnnotation(values)
+}
+
+// requiredAnnotation returns the required annotation set in the values,
+// defaulting to RequiredAnnotation.
+// The key is removed from values so it isn't available to templates.
+func (ah *AdmissionHook) requiredAnnotation(values map[string]string) string {
+	requiredAnnotation, ok := values[requiredAnnotationKey]
+	if !ok {
+		return ah.RequiredAnnotation
+	}
+	delete(values, requiredAnnotationKey)
+	return requiredAnnotation
+}
+
+// requestContext exposes details of the admission request to templates.
+type requestContext struct {
+	UserInfo authenticationv1.UserInfo // The user making the request
+	Kind     metav1.GroupVersionKind   // The kind of the object, at the version requested
+}
+
+// restrictValues limits the values to the keys listed in the object's
+// valuesKeysAnnotation in the annotation domain, if set, reporting whether the
+// values were restricted.
+func restrictValues(values map[string]string, objectMeta metav1.ObjectMeta, domain string) (map[string]string, bool, error) {
+	keys, ok := objectMeta.Annotations[domainAnnotation(valuesKeysAnnotation, domain)]
+	if !ok {
+		return values, false, nil
+	}
+
+	restricted := make(map[string]string)
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		value, ok := values[key]
+		if !ok {
+			return nil, false, fmt.Errorf("value %s not found", key)
+		}
+		restricted[key] = value
+	}
+	return restricted, true, nil
+}
+
+// templateContext builds the data passed to templates.
+// Values are available at the top level and the object's annotations, limited
+// to those in exposedAnnotations, are available under .Annotations.
+// A hash of the values is available under .ValuesHash.
+func templateContext(values map[string]string, objectMeta metav1.ObjectMeta, exposedAnnotations []string) map[string]interface{} {
+	data := make(map[string]interface{}, len(values)+3)
+	for key, value := range values {
+		data[key] = value
+	}
+
+	annotations := make(map[string]string)
+	for _, annotation := range exposedAnnotations {
+		if value, ok := objectMeta.Annotations[annotation]; ok {
+			annotations[annotation] = value
+		}
+	}
+	data[annotationsContextKey] = annotations
+	data[valuesHashContextKey] = valuesHash(values)
+	data[uidContextKey] = string(objectMeta.UID)
+
+	return data
+}
+
+// mergeStructuredValues parses the YAML value of the key in the template
+// context, adding each of its top level fields to the context so nested values
+// can be referenced, e.g. `.database.host`.
+// Flat values, and the fields Quack provides, take precedence over structured
+// values of the same name. The key itself is removed from the context.
+func mergeStructuredValues(data map[string]interface{}, key string) error {
+	raw, ok := data[key].(string)
+	if !ok {
+		return nil
+	}
+	delete(data, key)
+
+	structured := map[string]interface{}{}
+	err := yaml.Unmarshal([]byte(raw), &structured)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal %s: %v", key, err)
+	}
+	for name, value := range structured {
+		if _, ok := data[name]; !ok {
+			data[name] = value
+		}
+	}
+	return nil
+}
+
+// valuesHash returns the hex encoded sha256 of the values.
+// Map keys are sorted when marshalled so the hash is stable.
+func valuesHash(values map[string]string) string {
+	valuesBytes, err := json.Marshal(values)
+	if err != nil {
+		// Marshalling a map of strings can't fail
+		panic(err)
+	}
+	sum := sha256.Sum256(valuesBytes)
+	return hex.EncodeToString(sum[:])
+}
+
+// getValues merges the data of the named configmap in each namespace.
+// Values in later namespaces override those in earlier namespaces.
+// Namespaces without the configmap are skipped.
+// The values are read once per request, so the version of each configmap
+// read is returned to identify the snapshot used.
+func getValues(client kubernetes.Interface, namespaces []string, name string) (map[string]string, string, error) {
+	values := make(map[string]string)
+	versions := []string{}
+	getOpts := metav1.GetOptions{}
+	for _, namespace := range namespaces {
+		cm, err := client.CoreV1().ConfigMaps(namespace).Get(name, getOpts)
+		if apierrors.IsNotFound(err) {
+			glog.V(4).Infof("Configmap %s not found, skipping", podID(namespace, name))
+			continue
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("couldn't get configmap %s: %v", podID(namespace, name), err)
+		}
+
+		versions = append(versions, fmt.Sprintf("%s@%s", podID(namespace, name), cm.ResourceVersion))
+		for key, value := range cm.Data {
+			values[key] = value
+		}
+	}
+
+	if len(versions) == 0 {
+		return nil, "", &configMapNotFoundError{name: name, namespaces: namespaces}
+	}
+	return values, strings.Join(versions, ","), nil
+}
+
+// configMapNotFoundError is returned when a configmap is missing from every
+// namespace it is read from.
+type configMapNotFoundError struct {
+	name       string
+	namespaces []string
+}
+
+func (e *configMapNotFoundError) Error() string {
+	return fmt.Sprintf("couldn't find configmap %s in namespaces %v", e.name, e.namespaces)
+}
+
+// loadValues reads the template values from the Values ConfigMap and, if set,
+// the Values Secret, whose values take precedence.
+// Values from each overlay ConfigMap, in order, override those before them.
+// Objects may read a different Values ConfigMap by setting the
+// values-configmap and values-configmap-namespace annotations, from the
+// namespaces allowed for requests in the namespace, if the user making the
+// request may get it.
+// The Values ConfigMap itself is read with getMapValues.
+func (ah *AdmissionHook) loadValues(log requestLogger, objectMeta metav1.ObjectMeta, namespace string, userInfo authenticationv1.UserInfo, getMapValues func() (map[string]string, string, error)) (map[string]string, string, error) {
+	values := map[string]string{}
+	versions := []string{}
+
+	name, nameOk := objectMeta.Annotations[domainAnnotation(valuesMapAnnotation, ah.annotationDomain())]
+	mapNamespace, namespaceOk := objectMeta.Annotations[domainAnnotation(valuesMapNamespaceAnnotation, ah.annotationDomain())]
+	if !nameOk {
+		name = ah.ValuesMapName
+	}
+	if nameOk || namespaceOk {
+		namespaces := ah.valuesMapNamespaces()
+		if namespaceOk {
+			namespaces = []string{mapNamespace}
+		}
+		err := ah.checkValuesNamespaces(namespace, namespaces...)
+		if err != nil {
+			return nil, "", err
+		}
+		// Quack may read ConfigMaps the user can't, so users may only choose
+		// those they could read themselves
+		for _, mapNamespace := range namespaces {
+			err = ah.checkAccess(userInfo, authorizationv1.ResourceAttributes{
+				Namespace: mapNamespace,
+				Verb:      "get",
+				Version:   "v1",
+				Resource:  "configmaps",
+				Name:      name,
+			})
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		mapValues, version, err := getValues(ah.client, namespaces, name)
+		if err != nil {
+			return nil, "", err
+		}
+		values = mapValues
+		versions = append(versions, version)
+	} else if ah.ValuesMapName != "" {
+		mapValues, version, err := getMapValues()
+		if err != nil {
+			return nil, "", err
+		}
+		values = mapValues
+		versions = append(versions, version)
+	}
+
+	// An empty Values ConfigMap is likely misconfigured, so the fallback is
+	// read in its place
+	if len(versions) > 0 && len(values) == 0 && ah.FallbackValuesMapName != "" {
+		log.Warningf("Values configmap %s is empty, using fallback %s", name, ah.FallbackValuesMapName)
+		fallbackValues, version, err := getValues(ah.client, ah.valuesMapNamespaces(), ah.FallbackValuesMapName)
+		if err != nil {
+			return nil, "", err
+		}
+		values = fallbackValues
+		versions = append(versions, version)
+	}
+
+	for _, overlay := range ah.ValuesMapOverlays {
+		overlayValues, version, err := getValues(ah.client, ah.valuesMapNamespaces(), overlay)
+		if _, notFound := err.(*configMapNotFoundError); notFound && ah.OptionalValuesMapOverlays {
+			log.Infof(4, "Optional values configmap %s not found, skipping", overlay)
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		for key, value := range overlayValues {
+			values[key] = value
+		}
+		versions = append(versions, version)
+	}
+
+	if ah.ValuesSecretName != "" {
+		secretValues, version, err := getSecretValues(ah.client, ah.ValuesSecretNamespace, ah.ValuesSecretName)
+		if err != nil {
+			return nil, "", err
+		}
+		for key, value := range secretValues {
+			values[key] = value
+		}
+		versions = append(versions, version)
+	}
+	return values, strings.Join(versions, ","), nil
 }
 
-// Initialize configures the AdmissionHook.
-//
-// Initializes connection Kubernetes Client
-func (ah *AdmissionHook) Initialize(kubeClientConfig *restclient.Config, stopCh <-chan struct{}) error {
-	// Initialise a Kubernetes client
-	client, err := kubernetes.NewForConfig(kubeClientConfig)
-	if err != nil {
-		return fmt.Errorf("failed to intialise kubernetes clientset: %v", err)
+// valuesNamespaceAllowed determines whether values may be read from the
+// namespace for a request in requestNamespace, so tenants can't read each
+// other's values.
+func (ah *AdmissionHook) valuesNamespaceAllowed(namespace, requestNamespace string) bool {
+	return contains(ah.allowedValuesNamespaces(requestNamespace), namespace)
+}
+
+// valuesMapNamespaces returns the namespaces the Values ConfigMap is read
+// from, in order of precedence, ValuesMapNamespace followed by
+// ValuesMapNamespaces.
+func (ah *AdmissionHook) valuesMapNamespaces() []string {
+	namespaces := []string{}
+	if ah.ValuesMapNamespace != "" {
+		namespaces = append(namespaces, ah.ValuesMapNamespace)
 	}
-	ah.client = client
+	return append(namespaces, ah.ValuesMapNamespaces...)
+}
 
-	// Add lastAppliedConfigPath to ignored paths, unless it's already present
-	if !contains(ah.IgnoredPaths, lastAppliedConfigPath) {
-		ah.IgnoredPaths = append(ah.IgnoredPaths, lastAppliedConfigPath)
+// allowedValuesNamespaces returns the namespaces values may be read from for a
+// request in requestNamespace.
+// Unless AllowedValuesNamespaces is set, these are the namespaces of the Values
+// ConfigMap and Secret, and the namespace of the request.
+func (ah *AdmissionHook) allowedValuesNamespaces(requestNamespace string) []string {
+	if len(ah.AllowedValuesNamespaces) > 0 {
+		return ah.AllowedValuesNamespaces
 	}
 
-	glog.Info("Webhook Initialization Complete.")
+	namespaces := ah.valuesMapNamespaces()
+	if ah.ValuesSecretName != "" {
+		namespaces = append(namespaces, ah.ValuesSecretNamespace)
+	}
+	if requestNamespace != "" {
+		namespaces = append(namespaces, requestNamespace)
+	}
+	return namespaces
+}
+
+// checkValuesNamespaces returns an error naming the first namespace values may
+// not be read from for a request in requestNamespace.
+func (ah *AdmissionHook) checkValuesNamespaces(requestNamespace string, namespaces ...string) error {
+	for _, namespace := range namespaces {
+		if !ah.valuesNamespaceAllowed(namespace, requestNamespace) {
+			return fmt.Errorf("reading values from namespace %q is not allowed, must be one of %v", namespace, ah.allowedValuesNamespaces(requestNamespace))
+		}
+	}
 	return nil
 }
 
-// MutatingResource defines where the Webhook is hosted.
-func (ah *AdmissionHook) MutatingResource() (schema.GroupVersionResource, string) {
-	return schema.GroupVersionResource{
-			Group:    "quack.pusher.com",
-			Version:  "v1alpha1",
-			Resource: "admissionreviews",
-		},
-		"AdmissionReview"
+// getSecretValues reads the data of the named secret as values.
+// The API returns secret data base64 encoded, which is decoded by the client.
+func getSecretValues(client kubernetes.Interface, namespace string, name string) (map[string]string, string, error) {
+	secret, err := client.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, "", fmt.Errorf("couldn't get secret %s: %v", podID(namespace, name), err)
+	}
+
+	values := make(map[string]string, len(secret.Data))
+	for key, value := range secret.Data {
+		values[key] = string(value)
+	}
+	return values, fmt.Sprintf("%s@%s", podID(namespace, name), secret.ResourceVersion), nil
 }
 
-// Admit is the actual business logic of the webhook.
-// This is the method that processes the request to the admission controller.
-//
-// Checks the operation is a create or update operation.
-// Loads the template values from the configmap.
-// Templates the values into the raw object (json) from the admission request.
-// Calculates a JSON Patch to append to the admission response.
-func (ah *AdmissionHook) Admit(req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
-	resp := &admissionv1beta1.AdmissionResponse{}
-	resp.UID = req.UID
-	requestName := fmt.Sprintf("%s %s", req.Kind, podID(req.Namespace, req.Name))
+// decompressValues base64 decodes and gunzips values with keys ending in
+// compressedValueSuffix, storing them under the key without the suffix.
+func decompressValues(values map[string]string) (map[string]string, error) {
+	decompressed := make(map[string]string, len(values))
+	for key, value := range values {
+		if !strings.HasSuffix(key, compressedValueSuffix) {
+			decompressed[key] = value
+			continue
+		}
 
-	// Skip operations that aren't create or update
-	if req.Operation != admissionv1beta1.Create &&
-		req.Operation != admissionv1beta1.Update {
-		glog.V(2).Infof("Skipping %s request for %s", req.Operation, requestName)
-		resp.Allowed = true
-		return resp
+		baseKey := strings.TrimSuffix(key, compressedValueSuffix)
+		if _, ok := values[baseKey]; ok {
+			return nil, fmt.Errorf("both %s and %s are set", key, baseKey)
+		}
+
+		compressed, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %v", key, err)
+		}
+		reader, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress %s: %v", key, err)
+		}
+		valueBytes, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress %s: %v", key, err)
+		}
+		decompressed[baseKey] = string(valueBytes)
+	}
+	return decompressed, nil
+}
+
+// decodeValues base64 decodes values with keys ending in encodedValueSuffix,
+// storing them under the key without the suffix.
+func decodeValues(values map[string]string) (map[string]string, error) {
+	decoded := make(map[string]string, len(values))
+	for key, value := range values {
+		if !strings.HasSuffix(key, encodedValueSuffix) {
+			decoded[key] = value
+			continue
+		}
+
+		baseKey := strings.TrimSuffix(key, encodedValueSuffix)
+		if _, ok := values[baseKey]; ok {
+			return nil, fmt.Errorf("both %s and %s are set", key, baseKey)
+		}
+
+		valueBytes, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %v", key, err)
+		}
+		decoded[baseKey] = string(valueBytes)
+	}
+	return decoded, nil
+}
+
+// annotationDomain returns the AnnotationDomain, defaulting to
+// defaultAnnotationDomain.
+func (ah *AdmissionHook) annotationDomain() string {
+	if ah.AnnotationDomain == "" {
+		return defaultAnnotationDomain
+	}
+	return ah.AnnotationDomain
+}
+
+// annotationPathPrefix returns the JSON Pointer prefix of the paths of
+// annotations in the annotationDomain.
+func (ah *AdmissionHook) annotationPathPrefix() string {
+	return annotationsPath + escapeJSONPointer(ah.annotationDomain())
+}
+
+// isLegacyAnnotationPath determines whether a path is that of a legacy
+// annotation, which is removed from the template input, so mustn't be removed
+// from the object.
+func (ah *AdmissionHook) isLegacyAnnotationPath(path string) bool {
+	for legacy := range ah.legacyAnnotations {
+		if path == annotationsPath+escapeJSONPointer(legacy) {
+			return true
+		}
 	}
+	return false
+}
+
+// domainAnnotation returns the name of an annotation in the
+// defaultAnnotationDomain, e.g. leftDelimAnnotation, within the domain.
+func domainAnnotation(annotation string, domain string) string {
+	return domain + strings.TrimPrefix(annotation, defaultAnnotationDomain)
+}
+
+// escapeJSONPointer escapes a reference token for use in a JSON Pointer.
+// https://tools.ietf.org/html/rfc6901#section-3
+func escapeJSONPointer(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
 
-	// Skip requests that do not have the required annotation
-	annototationPresent, err := requestHasAnnotation(ah.RequiredAnnotation, req.Object.Raw)
+func (ah *AdmissionHook) createPatch(old []byte, new []byte, ignoredPaths []string, subresource string) ([]byte, error) {
+	patch, err := jsonpatch.CreatePatch(old, new)
 	if err != nil {
-		return errorResponse(resp, "Failed to read annotations: %v", err)
+		return nil, fmt.Errorf("error calculating patch: %v", err)
 	}
-	if !annototationPresent {
-		glog.V(2).Infof("Skipping %s request for %s: Required annotation not present.", req.Operation, requestName)
-		resp.Allowed = true
-		return resp
+
+	objectMeta, err := getObjectMeta(old)
+	if err != nil {
+		return nil, fmt.Errorf("error reading object metadata: %v", err)
 	}
+	patchStatus := keepStatus(objectMeta, ah.annotationDomain()) || subresource == statusSubresource
 
-	glog.V(2).Infof("Processing %s request for %s", req.Operation, requestName)
+	allowedOps := []jsonpatch.JsonPatchOperation{}
+	for _, op := range patch {
+		// Don't patch the lastAppliedConfig created by kubectl
+		if op.Path == lastAppliedConfigPath ||
+			strings.HasPrefix(op.Path, ah.annotationPathPrefix()) ||
+			ah.isLegacyAnnotationPath(op.Path) ||
+			contains(ignoredPaths, op.Path) ||
+			(ah.isStatusPath(op.Path) && !patchStatus) ||
+			!ah.patchPathAllowed(op.Path) {
+			continue
+		}
+		allowedOps = append(allowedOps, op)
+	}
 
-	// Load template values from configmap
-	values, err := getValues(ah.client, ah.ValuesMapNamespace, ah.ValuesMapName)
+	// Operations are generated while iterating maps, so their order is random.
+	// Sort them so identical inputs produce identical patches.
+	sortOperations(allowedOps)
+
+	patchBytes, err := json.Marshal(allowedOps)
 	if err != nil {
-		return errorResponse(resp, "Failed to get template values: %v", err)
+		return nil, fmt.Errorf("error marshalling patch: %v", err)
+	}
+	return patchBytes, nil
+}
+
+// statusPath returns the StatusPath, defaulting to defaultStatusPath.
+func (ah *AdmissionHook) statusPath() string {
+	statusPath := strings.TrimSuffix(ah.StatusPath, "/")
+	if statusPath == "" {
+		return defaultStatusPath
+	}
+	return statusPath
+}
+
+// isStatusPath determines whether a path is the StatusPath, or within it.
+func (ah *AdmissionHook) isStatusPath(path string) bool {
+	statusPath := ah.statusPath()
+	return path == statusPath || strings.HasPrefix(path, statusPath+"/")
+}
+
+// filterStatusOps removes operations on the StatusPath from a patch, unless the
+// status is patched, as createPatch does for the templated patch.
+func (ah *AdmissionHook) filterStatusOps(patch []byte, patchStatus bool) ([]byte, error) {
+	if patchStatus {
+		return patch, nil
 	}
 
-	delims, err := getDelims(req.Object.Raw)
+	ops := []json.RawMessage{}
+	err := json.Unmarshal(patch, &ops)
 	if err != nil {
-		return errorResponse(resp, "Invalid delimiters: %v", err)
+		return nil, fmt.Errorf("failed to unmarshal patch: %v", err)
+	}
+	allowedOps := []json.RawMessage{}
+	for _, op := range ops {
+		path := struct {
+			Path string `json:"path"`
+		}{}
+		err = json.Unmarshal(op, &path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal operation: %v", err)
+		}
+		if ah.isStatusPath(path.Path) {
+			continue
+		}
+		allowedOps = append(allowedOps, op)
 	}
 
-	templateInput, err := getTemplateInput(req.Object.Raw, ah.IgnoredPaths)
+	filtered, err := json.Marshal(allowedOps)
 	if err != nil {
-		return errorResponse(resp, "Error creating template input: %v", err)
+		return nil, fmt.Errorf("error marshalling patch: %v", err)
 	}
-	// Run Templating
-	glog.V(6).Infof("Input for %s: %s", requestName, templateInput)
+	return filtered, nil
+}
 
-	output, err := renderTemplate(templateInput, values, delims)
+// patchPathAllowed determines whether a path is within AllowedPatchPaths.
+// All paths are allowed if AllowedPatchPaths is empty.
+func (ah *AdmissionHook) patchPathAllowed(path string) bool {
+	if len(ah.AllowedPatchPaths) == 0 {
+		return true
+	}
+	for _, prefix := range ah.AllowedPatchPaths {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPatchPaths ensures every operation in a patch is within AllowedPatchPaths.
+func (ah *AdmissionHook) checkPatchPaths(patch []byte) error {
+	ops := []struct {
+		Path string `json:"path"`
+	}{}
+	err := json.Unmarshal(patch, &ops)
 	if err != nil {
-		return errorResponse(resp, "Error rendering template: %v", err)
+		return fmt.Errorf("failed to unmarshal patch: %v", err)
+	}
+	for _, op := range ops {
+		if !ah.patchPathAllowed(op.Path) {
+			return fmt.Errorf("path %s is not allowed", op.Path)
+		}
 	}
-	glog.V(6).Infof("Output for %s: %s", requestName, output)
+	return nil
+}
 
-	// Create a JSON Patch
-	// https://tools.ietf.org/html/rfc6902
-	patchBytes, err := ah.createPatch(req.Object.Raw, output)
+// sortOperations orders operations by path.
+// Operations on the elements of an array depend on each other, so are compared
+// by the path of the array itself and keep their relative order.
+func sortOperations(ops []jsonpatch.JsonPatchOperation) {
+	sort.SliceStable(ops, func(i, j int) bool {
+		return operationSortKey(ops[i].Path) < operationSortKey(ops[j].Path)
+	})
+}
+
+func operationSortKey(path string) string {
+	i := strings.LastIndex(path, "/")
+	if _, err := strconv.Atoi(path[i+1:]); err == nil {
+		return path[:i]
+	}
+	return path
+}
+
+// getUserPatch renders the JSON Patch supplied in the jsonPatchAnnotation in
+// the annotation domain.
+// Returns nil if the annotation is not present.
+func getUserPatch(raw []byte, domain string, data interface{}, opts templateOptions) ([]byte, error) {
+	objectMeta, err := getObjectMeta(raw)
 	if err != nil {
-		return errorResponse(resp, "Error creating patch: %v", err)
+		return nil, fmt.Errorf("error reading object metadata: %v", err)
 	}
 
-	// If the patch is non-zero, append it
-	if string(patchBytes) != "[]" {
-		glog.V(2).Infof("Patching %s", requestName)
-		glog.V(4).Infof("Patch for %s: %s", requestName, string(patchBytes))
-		resp.Patch = patchBytes
-		resp.PatchType = func() *admissionv1beta1.PatchType {
-			pt := admissionv1beta1.PatchTypeJSONPatch
-			return &pt
-		}()
+	annotation := domainAnnotation(jsonPatchAnnotation, domain)
+	patchTemplate, ok := objectMeta.Annotations[annotation]
+	if !ok {
+		return nil, nil
 	}
 
-	resp.Allowed = true
-	return resp
+	patch, err := renderTemplate([]byte(patchTemplate), data, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error rendering %s: %v", annotation, err)
+	}
+
+	// Ensure the rendered patch is a valid RFC6902 patch
+	if _, err := mergepatch.DecodePatch(patch); err != nil {
+		return nil, fmt.Errorf("invalid patch in %s: %v", annotation, err)
+	}
+	return patch, nil
 }
 
-func renderTemplate(input []byte, values map[string]string, delims delimiters) ([]byte, error) {
-	tmpl, err := template.New("object").Delims(delims.left, delims.right).Parse(string(input))
+// combinePatches appends the operations in userPatch to those in patch.
+// The combined patch is applied to the original object to validate it.
+func combinePatches(original, patch, userPatch []byte) ([]byte, error) {
+	ops := []json.RawMessage{}
+	err := json.Unmarshal(patch, &ops)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse template: %v", err)
+		return nil, fmt.Errorf("failed to unmarshal patch: %v", err)
 	}
-	buff := new(bytes.Buffer)
-	err = tmpl.Execute(buff, values)
+
+	userOps := []json.RawMessage{}
+	err = json.Unmarshal(userPatch, &userOps)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute template: %v", err)
+		return nil, fmt.Errorf("failed to unmarshal user patch: %v", err)
+	}
+
+	combined, err := json.Marshal(append(ops, userOps...))
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling patch: %v", err)
+	}
+
+	_, err = applyPatch(original, combined)
+	if err != nil {
+		return nil, fmt.Errorf("patch does not apply to object: %v", err)
 	}
-	return buff.Bytes(), nil
+	return combined, nil
 }
 
-func getValues(client *kubernetes.Clientset, namespace string, name string) (map[string]string, error) {
-	getOpts := metav1.GetOptions{}
-	cm, err := client.CoreV1().ConfigMaps(namespace).Get(name, getOpts)
+// getPriorPatch returns the operations of the patch recorded on the object
+// in the patchRecordAnnotation of the annotation domain when it was last
+// admitted, or nil if there is no record.
+// The record is read from the old object for updates, as clients may not send
+// the annotation back.
+func getPriorPatch(req *admissionv1beta1.AdmissionRequest, domain string) ([]interface{}, error) {
+	raw := req.Object.Raw
+	if len(req.OldObject.Raw) > 0 {
+		raw = req.OldObject.Raw
+	}
+	objectMeta, err := getObjectMeta(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	annotation := domainAnnotation(patchRecordAnnotation, domain)
+	record, ok := objectMeta.Annotations[annotation]
+	if !ok {
+		return nil, nil
+	}
+	ops := []interface{}{}
+	err = json.Unmarshal([]byte(record), &ops)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't get configmap: %v", err)
+		return nil, fmt.Errorf("invalid patch in %s: %v", annotation, err)
 	}
-	return cm.Data, nil
+	return ops, nil
 }
 
-func (ah *AdmissionHook) createPatch(old []byte, new []byte) ([]byte, error) {
-	patch, err := jsonpatch.CreatePatch(old, new)
+// recordPatch appends an operation to the patch setting the
+// patchRecordAnnotation in the annotation domain to the patch itself.
+func recordPatch(original []byte, domain string, patch []byte) ([]byte, error) {
+	// The patch may itself add annotations to the object
+	patched, err := applyPatch(original, patch)
 	if err != nil {
-		return nil, fmt.Errorf("error calculating patch: %v", err)
+		return nil, err
+	}
+	objectMeta, err := getObjectMeta(patched)
+	if err != nil {
+		return nil, err
 	}
 
-	allowedOps := []jsonpatch.JsonPatchOperation{}
-	for _, op := range patch {
-		// Don't patch the lastAppliedConfig created by kubectl
-		if op.Path == lastAppliedConfigPath ||
-			strings.HasPrefix(op.Path, quackAnnotationPrefix) ||
-			contains(ah.IgnoredPaths, op.Path) ||
-			strings.HasPrefix(op.Path, "/status") {
-			continue
-		}
-		allowedOps = append(allowedOps, op)
+	ops := []map[string]interface{}{}
+	if objectMeta.Annotations == nil {
+		ops = append(ops, map[string]interface{}{
+			"op":    "add",
+			"path":  "/metadata/annotations",
+			"value": map[string]string{},
+		})
 	}
+	ops = append(ops, map[string]interface{}{
+		"op":    "add",
+		"path":  annotationsPath + escapeJSONPointer(domainAnnotation(patchRecordAnnotation, domain)),
+		"value": string(patch),
+	})
 
-	patchBytes, err := json.Marshal(allowedOps)
+	recordOps, err := json.Marshal(ops)
 	if err != nil {
-		return nil, fmt.Errorf("error marshalling patch: %v", err)
+		return nil, fmt.Errorf("error marshalling record: %v", err)
 	}
-	return patchBytes, nil
+	return combinePatches(original, patch, recordOps)
+}
+
+// objectIgnoredPaths returns the ignored paths along with any listed in the
+// object's ignore-paths annotation in the annotation domain.
+func objectIgnoredPaths(objectMeta metav1.ObjectMeta, domain string, ignoredPaths []string) []string {
+	paths := append([]string{}, ignoredPaths...)
+	return append(paths, splitFields(objectMeta.Annotations[domainAnnotation(ignorePathsAnnotation, domain)])...)
 }
 
-func getTemplateInput(data []byte, ignoredPaths []string) ([]byte, error) {
+// getTemplateInput removes the status at the statusPath, the ignored paths,
+// annotations in the annotation domain and legacy annotations from the
+// object, leaving the template to render.
+// The status is kept for requests to the status subresource.
+func getTemplateInput(data []byte, domain string, legacyAnnotations map[string]string, statusPath string, ignoredPaths []string, subresource string) ([]byte, error) {
 	// Fetch object meta into object
 	objectMeta, err := getObjectMeta(data)
 	if err != nil {
 		return nil, fmt.Errorf("error reading object metadata: %v", err)
 	}
 
-	// We should not modify the status of objects
-	hasStatus, err := requestHasStatus(data)
+	// We should not modify the status of objects, unless the status is set by
+	// users rather than controllers
+	hasStatus, err := requestHasStatus(data, statusPath)
 	if err != nil {
 		return nil, fmt.Errorf("error reading object status: %v", err)
 	}
-	if hasStatus {
+	if hasStatus && !keepStatus(objectMeta, domain) && subresource != statusSubresource {
 		patch := []byte(fmt.Sprintf(`[
-			{"op": "remove", "path": "/status"}
-		]`))
+			{"op": "remove", "path": "%s"}
+		]`, statusPath))
 		data, err = applyPatch(data, patch)
 		if err != nil {
 			return nil, fmt.Errorf("error removing status: %v", err)
@@ -226,12 +1681,11 @@ func getTemplateInput(data []byte, ignoredPaths []string) ([]byte, error) {
 	}
 
 	for annotation := range objectMeta.Annotations {
-		if strings.HasPrefix(annotation, "quack.pusher.com") {
+		if quackAnnotation(annotation, domain, legacyAnnotations) {
 			// Remove annotations from input template
-			escapedAnnotation := strings.Replace(annotation, "/", "~1", -1)
 			patch := []byte(fmt.Sprintf(`[
-				{"op": "remove", "path": "/metadata/annotations/%s"}
-			]`, escapedAnnotation))
+				{"op": "remove", "path": "%s"}
+			]`, annotationsPath+escapeJSONPointer(annotation)))
 			data, err = applyPatch(data, patch)
 			if err != nil {
 				return nil, fmt.Errorf("error removing annotation %s: %v", annotation, err)
@@ -242,7 +1696,64 @@ func getTemplateInput(data []byte, ignoredPaths []string) ([]byte, error) {
 	return data, nil
 }
 
-func requestHasAnnotation(requiredAnnotation string, raw []byte) (bool, error) {
+// countDomainAnnotations counts the annotations prefixed by the domain and the
+// legacy annotations, which are removed from the template input.
+func countDomainAnnotations(annotations map[string]string, domain string, legacyAnnotations map[string]string) int {
+	count := 0
+	for annotation := range annotations {
+		if quackAnnotation(annotation, domain, legacyAnnotations) {
+			count++
+		}
+	}
+	return count
+}
+
+// quackAnnotation returns whether the annotation is read by Quack, either
+// being in the annotation domain or a legacy name of such an annotation.
+func quackAnnotation(annotation, domain string, legacyAnnotations map[string]string) bool {
+	_, legacy := legacyAnnotations[annotation]
+	return legacy || strings.HasPrefix(annotation, domain)
+}
+
+// parsePairs parses a map from pairs given as key=value.
+func parsePairs(pairs []string) (map[string]string, error) {
+	parsed := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid pair %q, must be of the form key=value", pair)
+		}
+		parsed[parts[0]] = parts[1]
+	}
+	return parsed, nil
+}
+
+// migrateAnnotations returns the annotations with any legacy names mapped to
+// their current names.
+// Where both the legacy and current names are set, the current name wins.
+func migrateAnnotations(log requestLogger, annotations, legacyAnnotations map[string]string) map[string]string {
+	if len(legacyAnnotations) == 0 {
+		return annotations
+	}
+
+	migrated := make(map[string]string, len(annotations))
+	for name, value := range annotations {
+		migrated[name] = value
+	}
+	for legacy, current := range legacyAnnotations {
+		value, ok := annotations[legacy]
+		if !ok {
+			continue
+		}
+		log.Warningf("Found legacy annotation %s, use %s instead", legacy, current)
+		if _, ok := annotations[current]; !ok {
+			migrated[current] = value
+		}
+	}
+	return migrated
+}
+
+func requestHasAnnotation(log requestLogger, requiredAnnotation string, raw []byte, legacyAnnotations map[string]string) (bool, error) {
 	if requiredAnnotation == "" {
 		return true, nil
 	}
@@ -253,13 +1764,63 @@ func requestHasAnnotation(requiredAnnotation string, raw []byte) (bool, error) {
 		return false, fmt.Errorf("error reading object metadata: %v", err)
 	}
 
-	glog.V(6).Infof("Requested Object Annotations: %v", objectMeta.Annotations)
+	log.Infof(6, "Requested Object Annotations: %v", objectMeta.Annotations)
+	annotations := migrateAnnotations(log, objectMeta.Annotations, legacyAnnotations)
 
-	// Check required annotation exists in struct
-	if _, ok := objectMeta.Annotations[requiredAnnotation]; ok {
-		return true, nil
+	// Check required annotation exists in struct, with the value if given
+	name, value, matchValue := splitRequiredAnnotation(requiredAnnotation)
+	actual, ok := annotations[name]
+	return ok && (!matchValue || actual == value), nil
+}
+
+// splitRequiredAnnotation splits a required annotation of the form name=value
+// into its name and the value it must have.
+// Annotations without a value only need to be present.
+func splitRequiredAnnotation(requiredAnnotation string) (string, string, bool) {
+	parts := strings.SplitN(requiredAnnotation, "=", 2)
+	if len(parts) == 1 {
+		return parts[0], "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// requestUnchanged compares an updated object, both as sent and as rendered by
+// the patch, with the existing object, ignoring fields bumped by the API server
+// on every write.
+// Comparing the object as sent isn't enough: the existing object was rendered
+// when it was admitted, but templates that remain on it, such as user patches
+// and template refs, may render differently since the values changed.
+func requestUnchanged(old, new, patch []byte) (bool, error) {
+	rendered := new
+	if string(patch) != "[]" {
+		var err error
+		rendered, err = applyPatch(new, patch)
+		if err != nil {
+			return false, fmt.Errorf("failed to render object: %v", err)
+		}
+	}
+
+	var oldObject, newObject, renderedObject map[string]interface{}
+	err := json.Unmarshal(old, &oldObject)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal old object: %v", err)
+	}
+	err = json.Unmarshal(new, &newObject)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal object: %v", err)
+	}
+	err = json.Unmarshal(rendered, &renderedObject)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal rendered object: %v", err)
 	}
-	return false, nil
+
+	for _, object := range []map[string]interface{}{oldObject, newObject, renderedObject} {
+		if metadata, ok := object["metadata"].(map[string]interface{}); ok {
+			delete(metadata, "generation")
+			delete(metadata, "resourceVersion")
+		}
+	}
+	return reflect.DeepEqual(oldObject, newObject) && reflect.DeepEqual(oldObject, renderedObject), nil
 }
 
 func getObjectMeta(raw []byte) (metav1.ObjectMeta, error) {
@@ -275,15 +1836,30 @@ func getObjectMeta(raw []byte) (metav1.ObjectMeta, error) {
 	return requestMeta.ObjectMeta, nil
 }
 
-func requestHasStatus(raw []byte) (bool, error) {
-	requestStatus := struct {
-		Status map[string]interface{} `json:"status"`
-	}{}
-	err := json.Unmarshal(raw, &requestStatus)
+// keepStatus determines whether the object's status should be templated, as
+// requested by its keepStatusAnnotation, or the equivalent
+// disableStatusRemovalAnnotation, in the annotation domain.
+// This is for custom resources whose status is set by users on creation,
+// rather than through the status subresource.
+func keepStatus(objectMeta metav1.ObjectMeta, domain string) bool {
+	return objectMeta.Annotations[domainAnnotation(keepStatusAnnotation, domain)] == "true" ||
+		objectMeta.Annotations[domainAnnotation(disableStatusRemovalAnnotation, domain)] == "true"
+}
+
+// requestHasStatus determines whether the object has a status object at the
+// statusPath.
+func requestHasStatus(raw []byte, statusPath string) (bool, error) {
+	var doc interface{}
+	err := json.Unmarshal(raw, &doc)
 	if err != nil {
 		return false, fmt.Errorf("failed to unmarshal input: %v", err)
 	}
-	return requestStatus.Status != nil, nil
+	status, ok := pointerValue(doc, statusPath)
+	if !ok {
+		return false, nil
+	}
+	_, isObject := status.(map[string]interface{})
+	return isObject, nil
 }
 
 func applyPatch(data, patchBytes []byte) ([]byte, error) {
@@ -303,9 +1879,30 @@ func applyPatch(data, patchBytes []byte) ([]byte, error) {
 type delimiters struct {
 	left  string
 	right string
+	trim  bool // Trim whitespace around every action, as if marked with -
+}
+
+// delimPresets are the delimiters objects can select with the
+// delimPresetAnnotation.
+var delimPresets = map[string]delimiters{
+	"curly":       {left: "{{", right: "}}"},
+	"curly-trim":  {left: "{{", right: "}}", trim: true},
+	"square":      {left: "[[", right: "]]"},
+	"square-trim": {left: "[[", right: "]]", trim: true},
+}
+
+// leftDelim returns the left delimiter, defaulting to the template default.
+func (d delimiters) leftDelim() string {
+	if d.left == "" {
+		return "{{"
+	}
+	return d.left
 }
 
-func getDelims(raw []byte) (delimiters, error) {
+// getDelims reads the delimiters from the left-delim and right-delim
+// annotations in the annotation domain, or the delimiter preset selected by
+// the delim-preset annotation.
+func getDelims(log requestLogger, raw []byte, domain string, legacyAnnotations map[string]string) (delimiters, error) {
 	// Fetch object meta into object
 	requestMeta := struct {
 		metav1.ObjectMeta `json:"metadata"`
@@ -317,14 +1914,29 @@ func getDelims(raw []byte) (delimiters, error) {
 		return delimiters{}, fmt.Errorf("failed ot unmarshal input: %v", err)
 	}
 
-	glog.V(6).Infof("Requested Object Annotations: %v", requestMeta.ObjectMeta.Annotations)
+	log.Infof(6, "Requested Object Annotations: %v", requestMeta.ObjectMeta.Annotations)
+	annotations := migrateAnnotations(log, requestMeta.ObjectMeta.Annotations, legacyAnnotations)
 
-	left, lOk := requestMeta.ObjectMeta.Annotations[leftDelimAnnotation]
-	right, rOk := requestMeta.ObjectMeta.Annotations[rightDelimAnnotation]
+	leftAnnotation := domainAnnotation(leftDelimAnnotation, domain)
+	rightAnnotation := domainAnnotation(rightDelimAnnotation, domain)
+	left, lOk := annotations[leftAnnotation]
+	right, rOk := annotations[rightAnnotation]
+
+	presetAnnotation := domainAnnotation(delimPresetAnnotation, domain)
+	if preset, ok := annotations[presetAnnotation]; ok {
+		if lOk || rOk {
+			return delimiters{}, fmt.Errorf("must not set %s with %s or %s", presetAnnotation, leftAnnotation, rightAnnotation)
+		}
+		delims, ok := delimPresets[preset]
+		if !ok {
+			return delimiters{}, fmt.Errorf("unknown delimiter preset %q", preset)
+		}
+		return delims, nil
+	}
 
 	// If one annotation is set but not the other, this is an error
 	if lOk != rOk {
-		return delimiters{}, fmt.Errorf("must set either both %s and %s, or neither", leftDelimAnnotation, rightDelimAnnotation)
+		return delimiters{}, fmt.Errorf("must set either both %s and %s, or neither", leftAnnotation, rightAnnotation)
 	}
 
 	// lOk == rOk, if neither set, not an error
@@ -342,8 +1954,9 @@ func getDelims(raw []byte) (delimiters, error) {
 	}, nil
 }
 
+// errorResponse rejects the request.
+// The error is logged by admitWithPolicy, along with the request's UID.
 func errorResponse(resp *admissionv1beta1.AdmissionResponse, message string, args ...interface{}) *admissionv1beta1.AdmissionResponse {
-	glog.Errorf(message, args...)
 	resp.Allowed = false
 	resp.Result = &metav1.Status{
 		Status: metav1.StatusFailure, Code: http.StatusInternalServerError, Reason: metav1.StatusReasonInternalError,
@@ -352,6 +1965,30 @@ func errorResponse(resp *admissionv1beta1.AdmissionResponse, message string, arg
 	return resp
 }
 
+// skipResponse allows the request without patching it.
+// The reason for skipping is counted, and the message included in the response
+// if VerboseResponses is set.
+func (ah *AdmissionHook) skipResponse(resp *admissionv1beta1.AdmissionResponse, req *admissionv1beta1.AdmissionRequest, reason string, message string, args ...interface{}) *admissionv1beta1.AdmissionResponse {
+	newRequestLogger(req).Infof(2, message, args...)
+	skippedRequests.WithLabelValues(reason).Inc()
+	countRequest(req.Operation, outcomeSkipped)
+	ah.stats.markSkipped()
+	resp.Allowed = true
+	if ah.VerboseResponses {
+		resp.Result = &metav1.Status{
+			Status:  metav1.StatusSuccess,
+			Message: fmt.Sprintf(message, args...),
+		}
+	}
+	return resp
+}
+
+// requestName describes the object of the request by its kind, namespace and
+// name.
+func requestName(req *admissionv1beta1.AdmissionRequest) string {
+	return fmt.Sprintf("%s %s", req.Kind, podID(req.Namespace, req.Name))
+}
+
 func podID(namespace string, name string) string {
 	if namespace != "" {
 		return fmt.Sprintf("%s/%s", namespace, name)
@@ -368,6 +2005,9 @@ func contains(list []string, item string) bool {
 	return false
 }
 
+// nonExistentPath determines whether a remove operation failed because the
+// key, or its parent, doesn't exist.
 func nonExistentPath(err error) bool {
-	return strings.Contains(err.Error(), "Unable to remove nonexistent key:")
+	return strings.Contains(err.Error(), "Unable to remove nonexistent key:") ||
+		strings.Contains(err.Error(), "doc is missing path:")
 }
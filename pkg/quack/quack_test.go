@@ -1,14 +1,40 @@
 package quack
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	restclient "k8s.io/client-go/rest"
+	clienttesting "k8s.io/client-go/testing"
 )
 
+func newTestAdmissionHook(values map[string]string) *AdmissionHook {
+	return &AdmissionHook{
+		client: fake.NewSimpleClientset(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "quack-values",
+				Namespace: "quack",
+			},
+			Data: values,
+		}),
+		ValuesMapName:      "quack-values",
+		ValuesMapNamespace: "quack",
+	}
+}
+
 func TestRenderTemplate(t *testing.T) {
 	values := map[string]string{
 		"A": "alpha",
@@ -29,7 +55,7 @@ func TestRenderTemplate(t *testing.T) {
 
 	fmt.Printf("Template Test Input: %s\n", string(inputBytes))
 
-	outputBytes, err := renderTemplate(inputBytes, values, delimiters{})
+	outputBytes, err := renderTemplate(inputBytes, values, templateOptions{})
 	if err != nil {
 		assert.FailNowf(t, "methodError", "Failed rendering template: %v", err)
 	}
@@ -67,7 +93,7 @@ func TestRenderTemplateDoesntRemoveQuackAnnotations(t *testing.T) {
 
 	fmt.Printf("Template Test Input: %s\n", string(inputBytes))
 
-	outputBytes, err := renderTemplate(inputBytes, values, delimiters{})
+	outputBytes, err := renderTemplate(inputBytes, values, templateOptions{})
 	if err != nil {
 		assert.FailNowf(t, "methodError", "Failed rendering template: %v", err)
 	}
@@ -109,7 +135,7 @@ func TestRenderTemplateWithDelims(t *testing.T) {
 		right: "]]",
 	}
 
-	outputBytes, err := renderTemplate(inputBytes, values, delims)
+	outputBytes, err := renderTemplate(inputBytes, values, templateOptions{delims: delims})
 	if err != nil {
 		assert.FailNowf(t, "methodError", "Failed rendering template: %v", err)
 	}
@@ -160,16 +186,16 @@ func TestRequestHasAnnotation(t *testing.T) {
 
 	fmt.Printf("Annotation Test Input (with annotation): %s\n", string(objectWithRequiredRaw))
 	fmt.Printf("Annotation Test Input (without annotation): %s\n", string(objectWithoutRequiredRaw))
-	withRequired, err := requestHasAnnotation(requiredAnnotation, objectWithRequiredRaw)
+	withRequired, err := requestHasAnnotation(requestLogger{}, requiredAnnotation, objectWithRequiredRaw, nil)
 	if err != nil {
 		assert.FailNowf(t, "methodError", "Error in requestHasAnnotation: %v", err)
 	}
-	withoutRequired, err := requestHasAnnotation(requiredAnnotation, objectWithoutRequiredRaw)
+	withoutRequired, err := requestHasAnnotation(requestLogger{}, requiredAnnotation, objectWithoutRequiredRaw, nil)
 	if err != nil {
 		assert.FailNowf(t, "methodError", "Error in requestHasAnnotation %v", err)
 	}
 
-	noAnnotation, err := requestHasAnnotation("", objectWithRequiredRaw)
+	noAnnotation, err := requestHasAnnotation(requestLogger{}, "", objectWithRequiredRaw, nil)
 	if err != nil {
 		assert.FailNowf(t, "methodError", "Error in requestHasAnnotation %v", err)
 	}
@@ -210,7 +236,7 @@ func TestGetTemplateInput(t *testing.T) {
 		assert.FailNowf(t, "jsonError", "Failed to marshal input: %v", err)
 	}
 
-	template, err := getTemplateInput(objectRaw, ignoredPaths)
+	template, err := getTemplateInput(objectRaw, defaultAnnotationDomain, nil, defaultStatusPath, ignoredPaths, "")
 	if err != nil {
 		assert.FailNowf(t, "methodError", "Error in getTemplateInput: %v", err)
 	}
@@ -223,6 +249,97 @@ func TestGetTemplateInput(t *testing.T) {
 	assert.Equal(t, objectNoQuackAnnotations, templateObject, "Object should have no quack annotations")
 }
 
+func TestObjectIgnoredPaths(t *testing.T) {
+	ignoredPaths := []string{"/status/foo"}
+	objectMeta := metav1.ObjectMeta{
+		Annotations: map[string]string{
+			ignorePathsAnnotation: "/spec/replicas, /metadata/annotations/x",
+		},
+	}
+
+	paths := objectIgnoredPaths(objectMeta, defaultAnnotationDomain, ignoredPaths)
+	assert.Equal(t, []string{"/status/foo", "/spec/replicas", "/metadata/annotations/x"}, paths, "Object paths should be appended to ignored paths")
+	assert.Equal(t, []string{"/status/foo"}, ignoredPaths, "Ignored paths should not be modified")
+
+	paths = objectIgnoredPaths(metav1.ObjectMeta{}, defaultAnnotationDomain, ignoredPaths)
+	assert.Equal(t, ignoredPaths, paths, "Objects without the annotation should use the ignored paths")
+}
+
+func TestAdmitObjectIgnoredPaths(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/ignore-paths": "/b,/metadata/annotations/x", "x": "{{ .A }}"}}, "a": "{{ .A }}", "b": "{{ .A }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[{"op": "replace", "path": "/a", "value": "alpha"}]`, string(resp.Patch), "Paths listed in the annotation should not be patched")
+}
+
+func TestAdmitIgnoredPaths(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.IgnoredPaths = []string{"/spec/managed", "/metadata/annotations/example.com~1owner"}
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"example.com/owner": "{{ .A }}"}}, "spec": {"a": "{{ .A }}", "managed": {"b": "{{ .A }}"}}}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[{"op": "replace", "path": "/spec/a", "value": "alpha"}]`, string(resp.Patch), "Ignored paths should not be templated or patched")
+}
+
+func TestAdmitIgnoredPathsPreserveCertificates(t *testing.T) {
+	// Encoded certificates may contain the delimiters, so can't be templated
+	cert := "-----BEGIN CERTIFICATE-----\\n" + strings.Repeat("MIIB{{x}}Q==", 1000) + "\\n-----END CERTIFICATE-----"
+	secret := []byte(`{
+		"kind": "Secret",
+		"metadata": {"name": "foo", "labels": {"app": "{{ .A }}"}},
+		"type": "kubernetes.io/tls",
+		"stringData": {"tls.crt": "` + cert + `", "tls.key": "` + cert + `"}
+	}`)
+
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.RequireFullRender = true
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		Operation: admissionv1beta1.Create,
+		Object:    runtime.RawExtension{Raw: secret},
+	})
+	assert.False(t, resp.Allowed, "Certificates should break templating unless ignored")
+
+	ah.IgnoredPaths = []string{"/stringData/tls.crt", "/stringData/tls.key"}
+	resp = ah.Admit(&admissionv1beta1.AdmissionRequest{
+		Operation: admissionv1beta1.Create,
+		Object:    runtime.RawExtension{Raw: secret},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[{"op": "replace", "path": "/metadata/labels/app", "value": "alpha"}]`, string(resp.Patch), "Certificates should be preserved verbatim")
+}
+
+func TestGetTemplateInputRemovesAllQuackAnnotations(t *testing.T) {
+	input := []byte(`{"metadata": {"name": "foo", "annotations": {"annotation": "value", "quack.pusher.com/left-delim": "[[", "quack.pusher.com/right-delim": "]]", "quack.pusher.com/engine": "text"}}}`)
+
+	template, err := getTemplateInput(input, defaultAnnotationDomain, nil, defaultStatusPath, []string{}, "")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in getTemplateInput: %v", err)
+	}
+	assert.JSONEq(t, `{"metadata": {"name": "foo", "annotations": {"annotation": "value"}}}`, string(template), "Every quack annotation should be removed")
+}
+
+func TestGetTemplateInputWithoutQuackAnnotations(t *testing.T) {
+	input := []byte(`{"metadata": {"name": "foo", "annotations": {"annotation": "value"}}, "a": "{{ .A }}"}`)
+
+	template, err := getTemplateInput(input, defaultAnnotationDomain, nil, defaultStatusPath, []string{}, "")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in getTemplateInput: %v", err)
+	}
+	assert.Equal(t, input, template, "Objects without quack annotations should be unchanged")
+}
+
 func TestGetTemplateInputRemovesIgnoredPaths(t *testing.T) {
 	type testObject struct {
 		metav1.ObjectMeta `json:"metadata"`
@@ -259,7 +376,7 @@ func TestGetTemplateInputRemovesIgnoredPaths(t *testing.T) {
 		assert.FailNowf(t, "jsonError", "Failed to marshal input: %v", err)
 	}
 
-	template, err := getTemplateInput(objectRaw, ignoredPaths)
+	template, err := getTemplateInput(objectRaw, defaultAnnotationDomain, nil, defaultStatusPath, ignoredPaths, "")
 	if err != nil {
 		assert.FailNowf(t, "methodError", "Error in getTemplateInput: %v", err)
 	}
@@ -273,7 +390,7 @@ func TestGetTemplateInputRemovesIgnoredPaths(t *testing.T) {
 	}
 	assert.Equal(t, objectNoOtherAnnotation, templateObject, "Object should have no ignored paths")
 
-	template, err = getTemplateInput(objectNoOtherRaw, ignoredPaths)
+	template, err = getTemplateInput(objectNoOtherRaw, defaultAnnotationDomain, nil, defaultStatusPath, ignoredPaths, "")
 	if err != nil {
 		assert.FailNowf(t, "methodError", "Error in getTemplateInput: %v", err)
 	}
@@ -311,7 +428,7 @@ func TestGetTemplateInputRemovesStatus(t *testing.T) {
 	}
 	ignoredPaths := []string{}
 
-	template, err := getTemplateInput(objectRaw, ignoredPaths)
+	template, err := getTemplateInput(objectRaw, defaultAnnotationDomain, nil, defaultStatusPath, ignoredPaths, "")
 	if err != nil {
 		assert.FailNowf(t, "methodError", "Error in getTemplateInput: %v", err)
 	}
@@ -388,17 +505,17 @@ func TestGetDelims(t *testing.T) {
 		assert.FailNowf(t, "jsonError", "Failed to marshal 'with empty delimeter' input: %v", err)
 	}
 
-	withNoAnnotations, err := getDelims(objectWithNoAnnotationsRaw)
+	withNoAnnotations, err := getDelims(requestLogger{}, objectWithNoAnnotationsRaw, defaultAnnotationDomain, nil)
 	if err != nil {
 		assert.FailNowf(t, "methodError", "Error in getDelims: %v", err)
 	}
-	withSetDelimters, err := getDelims(objectWithSetDelimitersRaw)
+	withSetDelimters, err := getDelims(requestLogger{}, objectWithSetDelimitersRaw, defaultAnnotationDomain, nil)
 	if err != nil {
 		assert.FailNowf(t, "methodError", "Error in getDelims: %v", err)
 	}
-	withLeftDelimeter, leftErr := getDelims(objectWithLeftDelimiterRaw)
-	withRightDelimeter, rightErr := getDelims(objectWithRightDelimiterRaw)
-	withEmptyDelimeters, emptyErr := getDelims(objectWithEmptyDelimitersRaw)
+	withLeftDelimeter, leftErr := getDelims(requestLogger{}, objectWithLeftDelimiterRaw, defaultAnnotationDomain, nil)
+	withRightDelimeter, rightErr := getDelims(requestLogger{}, objectWithRightDelimiterRaw, defaultAnnotationDomain, nil)
+	withEmptyDelimeters, emptyErr := getDelims(requestLogger{}, objectWithEmptyDelimitersRaw, defaultAnnotationDomain, nil)
 
 	assert.Equal(t, delimiters{}, withNoAnnotations, "Object with no annotations should return empty delimiters")
 	assert.Equal(t, delimiters{left: "[[", right: "]]"}, withSetDelimters, "Object with set delimiters should return `left: [[, right: ]]`")
@@ -410,6 +527,116 @@ func TestGetDelims(t *testing.T) {
 	assert.NotNil(t, emptyErr, "Object with empty left delimiter should return error")
 }
 
+func TestGetDelimsLegacyAnnotations(t *testing.T) {
+	legacyAnnotations := map[string]string{
+		"pusher.com/left-delim":  leftDelimAnnotation,
+		"pusher.com/right-delim": rightDelimAnnotation,
+	}
+
+	legacy := []byte(`{"metadata": {"annotations": {"pusher.com/left-delim": "[[", "pusher.com/right-delim": "]]"}}}`)
+	delims, err := getDelims(requestLogger{}, legacy, defaultAnnotationDomain, legacyAnnotations)
+	assert.Nil(t, err, "Object with legacy delimiters should not return error")
+	assert.Equal(t, delimiters{left: "[[", right: "]]"}, delims, "Legacy delimiters should be mapped to current delimiters")
+
+	delims, err = getDelims(requestLogger{}, legacy, defaultAnnotationDomain, nil)
+	assert.Nil(t, err, "Object with unmapped legacy delimiters should not return error")
+	assert.Equal(t, delimiters{}, delims, "Legacy delimiters should be ignored when not mapped")
+
+	mixed := []byte(`{"metadata": {"annotations": {"pusher.com/left-delim": "[[", "quack.pusher.com/right-delim": "]]"}}}`)
+	delims, err = getDelims(requestLogger{}, mixed, defaultAnnotationDomain, legacyAnnotations)
+	assert.Nil(t, err, "Object with legacy and current delimiters should not return error")
+	assert.Equal(t, delimiters{left: "[[", right: "]]"}, delims, "Legacy and current delimiters should be combined")
+
+	both := []byte(`{"metadata": {"annotations": {"pusher.com/left-delim": "[[", "pusher.com/right-delim": "]]", "quack.pusher.com/left-delim": "<<", "quack.pusher.com/right-delim": ">>"}}}`)
+	delims, err = getDelims(requestLogger{}, both, defaultAnnotationDomain, legacyAnnotations)
+	assert.Nil(t, err, "Object with legacy and current delimiters should not return error")
+	assert.Equal(t, delimiters{left: "<<", right: ">>"}, delims, "Current delimiters should take precedence over legacy delimiters")
+}
+
+func TestRequestHasAnnotationValue(t *testing.T) {
+	raw := []byte(`{"metadata": {"annotations": {"quack.pusher.com/template": "true"}}}`)
+
+	present, err := requestHasAnnotation(requestLogger{}, "quack.pusher.com/template=true", raw, nil)
+	assert.Nil(t, err, "Object with annotation should not return error")
+	assert.True(t, present, "Annotation with the required value should be present")
+
+	present, err = requestHasAnnotation(requestLogger{}, "quack.pusher.com/template=false", raw, nil)
+	assert.Nil(t, err, "Object with annotation should not return error")
+	assert.False(t, present, "Annotation with another value should not be present")
+
+	disabled := []byte(`{"metadata": {"annotations": {"quack.pusher.com/template": "false"}}}`)
+	present, err = requestHasAnnotation(requestLogger{}, "quack.pusher.com/template", disabled, nil)
+	assert.Nil(t, err, "Object with annotation should not return error")
+	assert.True(t, present, "Annotation without a required value should be present with any value")
+
+	present, err = requestHasAnnotation(requestLogger{}, "quack.pusher.com/template=true", disabled, nil)
+	assert.Nil(t, err, "Object with annotation should not return error")
+	assert.False(t, present, "Annotation set to false should not match a required value of true")
+}
+
+func TestAdmitWarnAnnotationMismatch(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.RequiredAnnotation = "quack.pusher.com/template=true"
+	ah.VerboseResponses = true
+
+	admit := func(annotations string) *admissionv1beta1.AdmissionResponse {
+		return ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Operation: admissionv1beta1.Create,
+			Object: runtime.RawExtension{
+				Raw: []byte(fmt.Sprintf(`{"metadata": {"name": "foo", "annotations": {%s}}, "a": "{{ .A }}"}`, annotations)),
+			},
+		})
+	}
+
+	resp := admit(`"quack.pusher.com/template": "true"`)
+	assert.JSONEq(t, `[{"op": "replace", "path": "/a", "value": "alpha"}]`, string(resp.Patch), "Object with the required value should be templated")
+
+	resp = admit(`"quack.pusher.com/template": "tru"`)
+	assert.Nil(t, resp.Patch, "Object with a mismatched value should not be templated")
+	assert.Contains(t, resp.Result.Message, "Required annotation not present", "Mismatch should not be reported unless enabled")
+
+	ah.WarnAnnotationMismatch = true
+	resp = admit(`"quack.pusher.com/template": "tru"`)
+	assert.True(t, resp.Allowed, "Object with a mismatched value should be allowed")
+	assert.Nil(t, resp.Patch, "Object with a mismatched value should not be templated")
+	assert.Contains(t, resp.Result.Message, `has value "tru", expected "true"`, "Mismatch should be reported")
+
+	resp = admit(``)
+	assert.Contains(t, resp.Result.Message, "Required annotation not present", "Missing annotation should not be reported as a mismatch")
+}
+
+func TestRequestHasLegacyAnnotation(t *testing.T) {
+	legacyAnnotations := map[string]string{"pusher.com/template": "quack.pusher.com/template"}
+	raw := []byte(`{"metadata": {"annotations": {"pusher.com/template": "true"}}}`)
+
+	present, err := requestHasAnnotation(requestLogger{}, "quack.pusher.com/template", raw, legacyAnnotations)
+	assert.Nil(t, err, "Object with legacy annotation should not return error")
+	assert.True(t, present, "Legacy annotation should be mapped to the required annotation")
+
+	present, err = requestHasAnnotation(requestLogger{}, "quack.pusher.com/template", raw, nil)
+	assert.Nil(t, err, "Object with legacy annotation should not return error")
+	assert.False(t, present, "Legacy annotation should be ignored when not mapped")
+}
+
+func TestAdmitLegacyAnnotations(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.legacyAnnotations = map[string]string{
+		"pusher.com/left-delim":  "quack.pusher.com/left-delim",
+		"pusher.com/right-delim": "quack.pusher.com/right-delim",
+	}
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"pusher.com/left-delim": "[[", "pusher.com/right-delim": "]]"}}, "a": "[[ .A ]]"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[{"op": "replace", "path": "/a", "value": "alpha"}]`, string(resp.Patch), "Legacy annotations should not be templated or patched")
+}
+
 func TestRequestHasStatus(t *testing.T) {
 	withStatus := `{
 			"status": {
@@ -417,14 +644,1979 @@ func TestRequestHasStatus(t *testing.T) {
 				"baz": 3
 			}
 		}`
-	hasStatus, err := requestHasStatus([]byte(withStatus))
+	hasStatus, err := requestHasStatus([]byte(withStatus), defaultStatusPath)
 	assert.Equal(t, nil, err, "Error should not have occurred")
 	assert.Equal(t, true, hasStatus, "Expected object with status to return true")
 
 	withoutStatus := `{
 				"foo": "bar"
 			}`
-	hasStatus, err = requestHasStatus([]byte(withoutStatus))
+	hasStatus, err = requestHasStatus([]byte(withoutStatus), defaultStatusPath)
 	assert.Equal(t, nil, err, "Error should not have occurred")
 	assert.Equal(t, false, hasStatus, "Expected object without status to return false")
 }
+
+func TestUserPatchCombinesWithTemplatedChange(t *testing.T) {
+	ah := &AdmissionHook{}
+	values := map[string]string{
+		"A":    "alpha",
+		"Team": "platform",
+	}
+	object := []byte(`{
+		"metadata": {
+			"annotations": {
+				"quack.pusher.com/json-patch": "[{\"op\": \"add\", \"path\": \"/metadata/labels\", \"value\": {\"team\": \"{{ .Team }}\"}}]"
+			}
+		},
+		"foo": "{{ .A }}"
+	}`)
+
+	templateInput, err := getTemplateInput(object, defaultAnnotationDomain, nil, defaultStatusPath, []string{}, "")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in getTemplateInput: %v", err)
+	}
+	output, err := renderTemplate(templateInput, values, templateOptions{})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Failed rendering template: %v", err)
+	}
+	patch, err := ah.createPatch(object, output, ah.IgnoredPaths, "")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in createPatch: %v", err)
+	}
+
+	userPatch, err := getUserPatch(object, defaultAnnotationDomain, values, templateOptions{})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in getUserPatch: %v", err)
+	}
+	combined, err := combinePatches(object, patch, userPatch)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in combinePatches: %v", err)
+	}
+
+	ops := []map[string]interface{}{}
+	err = json.Unmarshal(combined, &ops)
+	if err != nil {
+		assert.FailNowf(t, "jsonError", "Failed to unmarshal patch: %v", err)
+	}
+	assert.Len(t, ops, 2, "Patch should contain the computed and user operations")
+	assert.Equal(t, "/foo", ops[0]["path"], "Computed operations should come first")
+	assert.Equal(t, "/metadata/labels", ops[1]["path"], "User operations should come last")
+
+	patched, err := applyPatch(object, combined)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error applying patch: %v", err)
+	}
+	result := struct {
+		metav1.ObjectMeta `json:"metadata"`
+		Foo               string `json:"foo"`
+	}{}
+	err = json.Unmarshal(patched, &result)
+	if err != nil {
+		assert.FailNowf(t, "jsonError", "Failed to unmarshal patched object: %v", err)
+	}
+	assert.Equal(t, "alpha", result.Foo, "Templated field should be rendered")
+	assert.Equal(t, map[string]string{"team": "platform"}, result.Labels, "User patch should be templated and applied")
+}
+
+func TestGetUserPatchInvalid(t *testing.T) {
+	object := []byte(`{
+		"metadata": {
+			"annotations": {
+				"quack.pusher.com/json-patch": "{\"op\": \"add\"}"
+			}
+		}
+	}`)
+	_, err := getUserPatch(object, defaultAnnotationDomain, map[string]string{}, templateOptions{})
+	assert.NotNil(t, err, "Malformed user patch should return an error")
+
+	noPatch, err := getUserPatch([]byte(`{"metadata": {}}`), defaultAnnotationDomain, map[string]string{}, templateOptions{})
+	assert.Nil(t, err, "Error should not have occurred")
+	assert.Nil(t, noPatch, "Object without user patch should return nil")
+}
+
+func TestAdmitUpdatePatchesIncomingObject(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+
+	// The live object was rendered by a previous write, and has since been
+	// scaled by another client
+	live := []byte(`{"metadata": {"name": "foo"}, "alpha": "alpha", "replicas": 5}`)
+	incoming := []byte(`{"metadata": {"name": "foo"}, "alpha": "{{ .A }}", "replicas": 3}`)
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "update-uid",
+		Operation: admissionv1beta1.Update,
+		Object:    runtime.RawExtension{Raw: incoming},
+		OldObject: runtime.RawExtension{Raw: live},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[{"op": "replace", "path": "/alpha", "value": "alpha"}]`, string(resp.Patch), "Patch should be computed against the incoming object")
+
+	patched, err := applyPatch(incoming, resp.Patch)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in applyPatch: %v", err)
+	}
+	assert.JSONEq(t, `{"metadata": {"name": "foo"}, "alpha": "alpha", "replicas": 3}`, string(patched), "Patched object should be fully rendered")
+
+	// A patch computed against the live object would leave the template
+	// unrendered, as the live object already holds the rendered value, and
+	// would revert the incoming change to replicas
+	livePatch, err := ah.createPatch(live, []byte(`{"metadata": {"name": "foo"}, "alpha": "alpha", "replicas": 3}`), ah.IgnoredPaths, "")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in createPatch: %v", err)
+	}
+	assert.JSONEq(t, `[{"op": "replace", "path": "/replicas", "value": 3}]`, string(livePatch), "Patch against the live object should not render the template")
+}
+
+func TestAdmitUpdateWithUnrenderedOldObject(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{
+		"A": "alpha",
+		"B": "beta",
+	})
+
+	req := &admissionv1beta1.AdmissionRequest{
+		UID:       "update-uid",
+		Operation: admissionv1beta1.Update,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "alpha": "{{ .A }}", "beta": "beta"}`),
+		},
+		OldObject: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "alpha": "{{ .A }}", "beta": "{{ .B }}"}`),
+		},
+	}
+
+	resp := ah.Admit(req)
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.Equal(t, req.UID, resp.UID, "Response UID should match request")
+
+	ops := []map[string]interface{}{}
+	err := json.Unmarshal(resp.Patch, &ops)
+	if err != nil {
+		assert.FailNowf(t, "jsonError", "Failed to unmarshal patch: %v", err)
+	}
+	assert.Equal(t, []map[string]interface{}{
+		{"op": "replace", "path": "/alpha", "value": "alpha"},
+	}, ops, "Patch should only reflect rendering of the new object")
+}
+
+func TestTemplateContextExposedAnnotations(t *testing.T) {
+	values := map[string]string{
+		"A": "alpha",
+	}
+	objectMeta := metav1.ObjectMeta{
+		Annotations: map[string]string{
+			"team":   "platform",
+			"secret": "hunter2",
+		},
+	}
+
+	data := templateContext(values, objectMeta, []string{"team", "missing"})
+	assert.Equal(t, "alpha", data["A"], "Values should be available at the top level")
+	assert.Equal(t, map[string]string{"team": "platform"}, data[annotationsContextKey], "Only allowlisted annotations should be exposed")
+
+	data = templateContext(values, objectMeta, []string{})
+	assert.Equal(t, map[string]string{}, data[annotationsContextKey], "No annotations should be exposed by default")
+
+	input := []byte(`{"team": "{{ .Annotations.team }}", "secret": "{{ .Annotations.secret }}"}`)
+	outputBytes, err := renderTemplate(input, templateContext(values, objectMeta, []string{"team"}), templateOptions{})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Failed rendering template: %v", err)
+	}
+	output := map[string]string{}
+	err = json.Unmarshal(outputBytes, &output)
+	if err != nil {
+		assert.FailNowf(t, "jsonError", "Failed to unmarshal template output: %v", err)
+	}
+	assert.Equal(t, "platform", output["team"], "Allowlisted annotation should be rendered")
+	assert.NotEqual(t, "hunter2", output["secret"], "Annotation not in the allowlist should not be rendered")
+}
+
+func TestRenderTemplateWithDefine(t *testing.T) {
+	values := map[string]string{
+		"A": "alpha",
+	}
+	input := []byte(`{
+		"greeting": "{{- define ` + "`greeting`" + ` -}}hello {{ .A }}{{- end -}}",
+		"alpha": "{{- template ` + "`greeting`" + ` . -}}",
+		"beta": "{{- block ` + "`farewell`" + ` . -}}goodbye {{ .A }}{{- end -}}"
+	}`)
+
+	outputBytes, err := renderTemplate(input, values, templateOptions{})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Failed rendering template: %v", err)
+	}
+
+	output := map[string]string{}
+	err = json.Unmarshal(outputBytes, &output)
+	if err != nil {
+		assert.FailNowf(t, "jsonError", "Failed to unmarshal template output: %v", err)
+	}
+	assert.Equal(t, "", output["greeting"], "Define should render nothing in place")
+	assert.Equal(t, "hello alpha", output["alpha"], "Defined template should be invoked")
+	assert.Equal(t, "goodbye alpha", output["beta"], "Block should render its default content")
+}
+
+func TestRenderTemplateWithPartials(t *testing.T) {
+	values := map[string]string{
+		"A": "alpha",
+	}
+	partials := map[string]string{
+		"greeting": "hello {{ .A }}",
+		"farewell": "{{- define `farewell` -}}goodbye {{ .A }}{{- end -}}",
+	}
+	input := []byte("{\"alpha\": \"{{ template `greeting` . }}\", \"beta\": \"{{ template `farewell` . }}\"}")
+
+	outputBytes, err := renderTemplate(input, values, templateOptions{partials: partials})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Failed rendering template: %v", err)
+	}
+
+	output := map[string]string{}
+	err = json.Unmarshal(outputBytes, &output)
+	if err != nil {
+		assert.FailNowf(t, "jsonError", "Failed to unmarshal template output: %v", err)
+	}
+	assert.Equal(t, "hello alpha", output["alpha"], "Partial should be invoked by its key")
+	assert.Equal(t, "goodbye alpha", output["beta"], "Templates defined within a partial should be invoked")
+
+	_, err = renderTemplate(input, values, templateOptions{partials: map[string]string{"greeting": "{{ .A "}})
+	assert.NotNil(t, err, "Invalid partial should return an error")
+}
+
+func TestAdmitSkipsUnchangedUpdate(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.SkipUnchanged = true
+
+	req := &admissionv1beta1.AdmissionRequest{
+		UID:       "update-uid",
+		Operation: admissionv1beta1.Update,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "generation": 2, "resourceVersion": "2"}, "spec": {"alpha": "alpha"}}`),
+		},
+		OldObject: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "generation": 1, "resourceVersion": "1"}, "spec": {"alpha": "alpha"}}`),
+		},
+	}
+
+	before := skippedCount(t, skipReasonUnchanged)
+	resp := ah.Admit(req)
+	assert.True(t, resp.Allowed, "Unchanged update should be allowed")
+	assert.Nil(t, resp.Patch, "Unchanged update should not be patched")
+	assert.Equal(t, before+1, skippedCount(t, skipReasonUnchanged), "Unchanged update should be skipped")
+
+	req.Object.Raw = []byte(`{"metadata": {"name": "foo", "generation": 2, "resourceVersion": "2"}, "spec": {"alpha": "{{ .A }}"}}`)
+	resp = ah.Admit(req)
+	assert.True(t, resp.Allowed, "Changed update should be allowed")
+	assert.NotNil(t, resp.Patch, "Update rendering to the existing object should still be patched")
+	assert.Equal(t, before+1, skippedCount(t, skipReasonUnchanged), "Update sent with templates should not be skipped")
+
+	// The object as sent is unchanged, but its user patch now renders a
+	// different value
+	object := `{"metadata": {"name": "foo", "generation": %d, "annotations": {"quack.pusher.com/json-patch": "[{\"op\": \"replace\", \"path\": \"/spec/alpha\", \"value\": \"{{ .A }}\"}]"}}, "spec": {"alpha": "old"}}`
+	req.OldObject.Raw = []byte(fmt.Sprintf(object, 1))
+	req.Object.Raw = []byte(fmt.Sprintf(object, 2))
+	resp = ah.Admit(req)
+	assert.True(t, resp.Allowed, "Update rendering differently should be allowed")
+	assert.JSONEq(t, `[{"op": "replace", "path": "/spec/alpha", "value": "alpha"}]`, string(resp.Patch), "Update rendering differently should be patched")
+
+	ah.SkipUnchanged = false
+	req.Object.Raw = []byte(`{"metadata": {"name": "foo", "generation": 2}, "spec": {"alpha": "alpha"}}`)
+	req.OldObject.Raw = []byte(`{"metadata": {"name": "foo", "generation": 1}, "spec": {"alpha": "alpha"}}`)
+	before = skippedCount(t, skipReasonUnchanged)
+	resp = ah.Admit(req)
+	assert.True(t, resp.Allowed, "Unchanged update should be allowed by default")
+	assert.Equal(t, before, skippedCount(t, skipReasonUnchanged), "Unchanged update should be processed by default")
+}
+
+func TestValuesMapNamespaces(t *testing.T) {
+	ah := &AdmissionHook{ValuesMapNamespace: "quack"}
+	assert.Equal(t, []string{"quack"}, ah.valuesMapNamespaces(), "ValuesMapNamespace should be read alone by default")
+
+	ah.ValuesMapNamespaces = []string{"central", "team"}
+	assert.Equal(t, []string{"quack", "central", "team"}, ah.valuesMapNamespaces(), "ValuesMapNamespaces should override ValuesMapNamespace")
+
+	ah.ValuesMapNamespace = ""
+	assert.Equal(t, []string{"central", "team"}, ah.valuesMapNamespaces(), "Unset ValuesMapNamespace should be skipped")
+}
+
+func TestGetValuesMergesNamespaces(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "quack-values",
+				Namespace:       "central",
+				ResourceVersion: "1",
+			},
+			Data: map[string]string{
+				"A": "alpha",
+				"B": "beta",
+			},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "quack-values",
+				Namespace:       "team",
+				ResourceVersion: "2",
+			},
+			Data: map[string]string{
+				"B": "team-beta",
+				"C": "gamma",
+			},
+		},
+	)
+
+	values, version, err := getValues(client, []string{"central", "missing", "team"}, "quack-values")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in getValues: %v", err)
+	}
+	assert.Equal(t, map[string]string{
+		"A": "alpha",
+		"B": "team-beta",
+		"C": "gamma",
+	}, values, "Later namespaces should override earlier namespaces")
+	assert.Equal(t, "central/quack-values@1,team/quack-values@2", version, "Version should identify each configmap read")
+
+	values, _, err = getValues(client, []string{"team", "central"}, "quack-values")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in getValues: %v", err)
+	}
+	assert.Equal(t, "beta", values["B"], "Later namespaces should override earlier namespaces")
+
+	_, _, err = getValues(client, []string{"missing"}, "quack-values")
+	assert.NotNil(t, err, "Configmap missing from every namespace should return an error")
+}
+
+func TestLoadValues(t *testing.T) {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "quack-values",
+			Namespace:       "quack",
+			ResourceVersion: "1",
+		},
+		Data: map[string]string{
+			"A": "alpha",
+			"B": "beta",
+		},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "quack-secrets",
+			Namespace:       "secrets",
+			ResourceVersion: "2",
+		},
+		Data: map[string][]byte{
+			"B": []byte("secret-beta"),
+			"C": []byte("secret-gamma"),
+		},
+	}
+
+	ah := &AdmissionHook{
+		client:             fake.NewSimpleClientset(configMap),
+		ValuesMapName:      "quack-values",
+		ValuesMapNamespace: "quack",
+	}
+	values, version, err := ah.loadValues(requestLogger{}, metav1.ObjectMeta{}, "", authenticationv1.UserInfo{}, ah.getMapValues)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in loadValues: %v", err)
+	}
+	assert.Equal(t, map[string]string{"A": "alpha", "B": "beta"}, values, "Values should be loaded from the configmap")
+	assert.Equal(t, "quack/quack-values@1", version, "Version should identify the configmap")
+
+	ah = &AdmissionHook{
+		client:                fake.NewSimpleClientset(secret),
+		ValuesSecretName:      "quack-secrets",
+		ValuesSecretNamespace: "secrets",
+	}
+	values, version, err = ah.loadValues(requestLogger{}, metav1.ObjectMeta{}, "", authenticationv1.UserInfo{}, ah.getMapValues)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in loadValues: %v", err)
+	}
+	assert.Equal(t, map[string]string{"B": "secret-beta", "C": "secret-gamma"}, values, "Values should be loaded from the secret")
+	assert.Equal(t, "secrets/quack-secrets@2", version, "Version should identify the secret")
+
+	ah = &AdmissionHook{
+		client:                fake.NewSimpleClientset(configMap, secret),
+		ValuesMapName:         "quack-values",
+		ValuesMapNamespace:    "quack",
+		ValuesSecretName:      "quack-secrets",
+		ValuesSecretNamespace: "secrets",
+	}
+	values, version, err = ah.loadValues(requestLogger{}, metav1.ObjectMeta{}, "", authenticationv1.UserInfo{}, ah.getMapValues)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in loadValues: %v", err)
+	}
+	assert.Equal(t, map[string]string{"A": "alpha", "B": "secret-beta", "C": "secret-gamma"}, values, "Secret values should override configmap values")
+	assert.Equal(t, "quack/quack-values@1,secrets/quack-secrets@2", version, "Version should identify the configmap and secret")
+
+	ah.client = fake.NewSimpleClientset(configMap)
+	_, _, err = ah.loadValues(requestLogger{}, metav1.ObjectMeta{}, "", authenticationv1.UserInfo{}, ah.getMapValues)
+	assert.NotNil(t, err, "Missing secret should return an error")
+}
+
+func TestLoadValuesOverlays(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "quack-values", Namespace: "quack"},
+			Data:       map[string]string{"A": "alpha", "B": "beta", "C": "gamma"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "staging-values", Namespace: "quack"},
+			Data:       map[string]string{"B": "staging-beta", "C": "staging-gamma"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "local-values", Namespace: "quack"},
+			Data:       map[string]string{"C": "local-gamma"},
+		},
+	)
+	ah := &AdmissionHook{
+		client:             client,
+		ValuesMapName:      "quack-values",
+		ValuesMapNamespace: "quack",
+		ValuesMapOverlays:  []string{"staging-values"},
+	}
+
+	values, _, err := ah.loadValues(requestLogger{}, metav1.ObjectMeta{}, "", authenticationv1.UserInfo{}, ah.getMapValues)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in loadValues: %v", err)
+	}
+	assert.Equal(t, map[string]string{"A": "alpha", "B": "staging-beta", "C": "staging-gamma"}, values, "Overlay values should override the configmap")
+
+	ah.ValuesMapOverlays = []string{"staging-values", "local-values"}
+	values, _, err = ah.loadValues(requestLogger{}, metav1.ObjectMeta{}, "", authenticationv1.UserInfo{}, ah.getMapValues)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in loadValues: %v", err)
+	}
+	assert.Equal(t, map[string]string{"A": "alpha", "B": "staging-beta", "C": "local-gamma"}, values, "Later overlays should take precedence")
+
+	ah.ValuesMapOverlays = []string{"staging-values", "missing-values"}
+	_, _, err = ah.loadValues(requestLogger{}, metav1.ObjectMeta{}, "", authenticationv1.UserInfo{}, ah.getMapValues)
+	assert.NotNil(t, err, "Missing overlay should return an error")
+
+	ah.OptionalValuesMapOverlays = true
+	values, _, err = ah.loadValues(requestLogger{}, metav1.ObjectMeta{}, "", authenticationv1.UserInfo{}, ah.getMapValues)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in loadValues: %v", err)
+	}
+	assert.Equal(t, map[string]string{"A": "alpha", "B": "staging-beta", "C": "staging-gamma"}, values, "Missing optional overlay should be skipped")
+}
+
+func TestLoadValuesFallback(t *testing.T) {
+	fallback := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "fallback-values", Namespace: "quack", ResourceVersion: "2"},
+		Data:       map[string]string{"A": "fallback-alpha"},
+	}
+
+	for data, expected := range map[string]string{"": "fallback-alpha", "alpha": "alpha"} {
+		primary := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "quack-values", Namespace: "quack", ResourceVersion: "1"},
+		}
+		if data != "" {
+			primary.Data = map[string]string{"A": data}
+		}
+		ah := &AdmissionHook{
+			client:                fake.NewSimpleClientset(primary, fallback),
+			ValuesMapName:         "quack-values",
+			ValuesMapNamespace:    "quack",
+			FallbackValuesMapName: "fallback-values",
+		}
+
+		values, _, err := ah.loadValues(requestLogger{}, metav1.ObjectMeta{}, "", authenticationv1.UserInfo{}, ah.getMapValues)
+		if err != nil {
+			assert.FailNowf(t, "methodError", "Error in loadValues: %v", err)
+		}
+		assert.Equal(t, map[string]string{"A": expected}, values, "Fallback should only be used if the configmap is empty")
+	}
+
+	ah := &AdmissionHook{
+		client: fake.NewSimpleClientset(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "quack-values", Namespace: "quack"},
+		}),
+		ValuesMapName:         "quack-values",
+		ValuesMapNamespace:    "quack",
+		FallbackValuesMapName: "fallback-values",
+	}
+	_, _, err := ah.loadValues(requestLogger{}, metav1.ObjectMeta{}, "", authenticationv1.UserInfo{}, ah.getMapValues)
+	assert.NotNil(t, err, "Missing fallback should return an error")
+}
+
+func TestAdmitValuesConfigMapAnnotations(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.client = fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "quack-values", Namespace: "quack"},
+			Data:       map[string]string{"A": "alpha"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "team-values", Namespace: "quack"},
+			Data:       map[string]string{"A": "team-alpha"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "quack-values", Namespace: "team"},
+			Data:       map[string]string{"A": "team-namespace-alpha"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "team-values", Namespace: "team"},
+			Data:       map[string]string{"A": "team-namespace-team-alpha"},
+		},
+	)
+	allowAccess(ah)
+
+	for annotations, expected := range map[string]string{
+		``: "alpha",
+		`"quack.pusher.com/values-configmap": "team-values"`:                                                        "team-alpha",
+		`"quack.pusher.com/values-configmap-namespace": "team"`:                                                     "team-namespace-alpha",
+		`"quack.pusher.com/values-configmap": "team-values", "quack.pusher.com/values-configmap-namespace": "team"`: "team-namespace-team-alpha",
+	} {
+		resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Namespace: "team",
+			Operation: admissionv1beta1.Create,
+			UserInfo:  authenticationv1.UserInfo{Username: "mallard"},
+			Object: runtime.RawExtension{
+				Raw: []byte(fmt.Sprintf(`{"metadata": {"name": "foo", "annotations": {%s}}, "a": "{{ .A }}"}`, annotations)),
+			},
+		})
+		assert.True(t, resp.Allowed, "Request should be allowed")
+		assert.JSONEq(t, fmt.Sprintf(`[{"op": "replace", "path": "/a", "value": "%s"}]`, expected), string(resp.Patch), "Values should be read from the annotated configmap")
+		assert.NotContains(t, string(resp.Patch), "values-configmap", "Override annotations should not be patched")
+	}
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		UserInfo:  authenticationv1.UserInfo{Username: "mallard"},
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/values-configmap": "missing"}}, "a": "{{ .A }}"}`),
+		},
+	})
+	assert.False(t, resp.Allowed, "Missing annotated configmap should be rejected")
+
+	resp = ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Namespace: "team",
+		Operation: admissionv1beta1.Create,
+		UserInfo:  authenticationv1.UserInfo{Username: "drake"},
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/values-configmap": "team-values"}}, "a": "{{ .A }}"}`),
+		},
+	})
+	assert.False(t, resp.Allowed, "Request should be rejected")
+	assert.Contains(t, resp.Result.Message, "user drake may not get configmaps quack/team-values", "Users should only read values from configmaps they may get")
+	assert.Nil(t, resp.Patch, "Values the user may not get should not be templated")
+}
+
+func TestLoadValuesAllowedNamespaces(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.client = fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "quack-values", Namespace: "quack"},
+			Data:       map[string]string{"A": "alpha"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "quack-values", Namespace: "team-a"},
+			Data:       map[string]string{"A": "team-a-alpha"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "quack-values", Namespace: "team-b"},
+			Data:       map[string]string{"A": "team-b-alpha"},
+		},
+	)
+	allowAccess(ah)
+	user := authenticationv1.UserInfo{Username: "mallard"}
+	ah.AllowedValuesNamespaces = []string{"quack", "team-a"}
+
+	values, _, err := ah.loadValues(requestLogger{}, metav1.ObjectMeta{
+		Annotations: map[string]string{valuesMapNamespaceAnnotation: "team-a"},
+	}, "", user, ah.getMapValues)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in loadValues: %v", err)
+	}
+	assert.Equal(t, "team-a-alpha", values["A"], "Values should be read from an allowed namespace")
+
+	_, _, err = ah.loadValues(requestLogger{}, metav1.ObjectMeta{
+		Annotations: map[string]string{valuesMapNamespaceAnnotation: "team-b"},
+	}, "", user, ah.getMapValues)
+	if assert.NotNil(t, err, "Reading values from a disallowed namespace should return an error") {
+		assert.Contains(t, err.Error(), `namespace "team-b" is not allowed`, "Error should name the namespace")
+	}
+
+	ah.AllowedValuesNamespaces = []string{"team-a"}
+	assert.NotNil(t, ah.initialize(ah.client), "Values ConfigMap in a disallowed namespace should fail to initialize")
+
+	ah.AllowedValuesNamespaces = []string{"quack"}
+	ah.ValuesSecretName = "quack-secrets"
+	ah.ValuesSecretNamespace = "secrets"
+	assert.NotNil(t, ah.initialize(ah.client), "Values Secret in a disallowed namespace should fail to initialize")
+
+	ah.AllowedValuesNamespaces = []string{}
+	assert.Nil(t, ah.initialize(ah.client), "Values ConfigMap and Secret namespaces should be allowed by default")
+
+	ah.ValuesSecretName = ""
+
+	values, _, err = ah.loadValues(requestLogger{}, metav1.ObjectMeta{
+		Annotations: map[string]string{valuesMapNamespaceAnnotation: "team-a"},
+	}, "team-a", user, ah.getMapValues)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in loadValues: %v", err)
+	}
+	assert.Equal(t, "team-a-alpha", values["A"], "Values should be read from the namespace of the request by default")
+
+	_, _, err = ah.loadValues(requestLogger{}, metav1.ObjectMeta{
+		Annotations: map[string]string{valuesMapNamespaceAnnotation: "team-b"},
+	}, "team-a", user, ah.getMapValues)
+	if assert.NotNil(t, err, "Reading values from another namespace should return an error by default") {
+		assert.Contains(t, err.Error(), `namespace "team-b" is not allowed, must be one of [quack team-a]`, "Error should list the default namespaces")
+	}
+}
+
+func TestAdmitNamespaceValues(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+	ah.client = fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "quack-values", Namespace: "quack"},
+			Data:       map[string]string{"A": "alpha", "B": "beta"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "quack-values", Namespace: "team-a"},
+			Data:       map[string]string{"A": "team-a-alpha"},
+		},
+	)
+	ah.NamespaceValues = true
+
+	for namespace, expected := range map[string]string{
+		"team-a": `[{"op": "replace", "path": "/a", "value": "team-a-alpha"}, {"op": "replace", "path": "/b", "value": "beta"}]`,
+		"team-b": `[{"op": "replace", "path": "/a", "value": "alpha"}, {"op": "replace", "path": "/b", "value": "beta"}]`,
+	} {
+		resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Namespace: namespace,
+			Operation: admissionv1beta1.Create,
+			Object: runtime.RawExtension{
+				Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}", "b": "{{ .B }}"}`),
+			},
+		})
+		assert.True(t, resp.Allowed, "Request in %s should be allowed", namespace)
+		assert.JSONEq(t, expected, string(resp.Patch), "Namespace values in %s should override global values", namespace)
+	}
+
+	ah.NamespaceValues = false
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Namespace: "team-a",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`),
+		},
+	})
+	assert.JSONEq(t, `[{"op": "replace", "path": "/a", "value": "alpha"}]`, string(resp.Patch), "Namespace values should not be read unless enabled")
+}
+
+func TestAdmitMissingValues(t *testing.T) {
+	req := &admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`),
+		},
+	}
+
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.ValuesMapName = "missing-values"
+	resp := ah.Admit(req)
+	assert.False(t, resp.Allowed, "Missing values should be rejected")
+	if assert.NotNil(t, resp.Result, "Response should include a result") {
+		assert.Equal(t, "Values ConfigMap missing-values not found in namespaces [quack]", resp.Result.Message, "Message should name the missing configmap")
+	}
+
+	ah.AllowMissingValues = true
+	resp = ah.Admit(req)
+	assert.True(t, resp.Allowed, "Missing values should be allowed with AllowMissingValues")
+	assert.Empty(t, resp.Patch, "Object should be admitted unchanged")
+
+	// Other failures to read values are always rejected
+	ah = newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.AllowMissingValues = true
+	ah.client.(*fake.Clientset).PrependReactor("get", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("connection refused")
+	})
+	resp = ah.Admit(req)
+	assert.False(t, resp.Allowed, "Failing to read values should be rejected")
+	if assert.NotNil(t, resp.Result, "Response should include a result") {
+		assert.Contains(t, resp.Result.Message, "Failed to get template values", "Message should describe the failure")
+		assert.Contains(t, resp.Result.Message, "connection refused", "Message should include the error")
+	}
+}
+
+func TestAdmitUsesSingleValuesSnapshot(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	client := ah.client.(*fake.Clientset)
+
+	// Each read of the values returns a newer version, as if the configmap
+	// were updated while the request was being templated
+	gets := 0
+	client.PrependReactor("get", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		getAction := action.(clienttesting.GetAction)
+		if getAction.GetNamespace() != "quack" || getAction.GetName() != "quack-values" {
+			return false, nil, nil
+		}
+		gets++
+		return true, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "quack-values",
+				Namespace:       "quack",
+				ResourceVersion: fmt.Sprintf("%d", gets),
+			},
+			Data: map[string]string{"A": fmt.Sprintf("alpha-%d", gets)},
+		}, nil
+	})
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Namespace: "team",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}", "b": "{{ valueFor ` + "`A`" + ` }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.Equal(t, 1, gets, "Values should be read once per request")
+	assert.Contains(t, string(resp.Patch), `{"op":"replace","path":"/a","value":"alpha-1"}`, "Values should come from the snapshot")
+	assert.Contains(t, string(resp.Patch), `{"op":"replace","path":"/b","value":"alpha-1"}`, "valueFor should use the snapshot")
+}
+
+func TestAdmitSkipResponseMessage(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+	ah.RequiredAnnotation = "quack.pusher.com/template"
+
+	req := &admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}}`),
+		},
+	}
+
+	resp := ah.Admit(req)
+	assert.True(t, resp.Allowed, "Skipped request should be allowed")
+	assert.Nil(t, resp.Result, "Skipped request should not have a result by default")
+
+	ah.VerboseResponses = true
+	resp = ah.Admit(req)
+	assert.True(t, resp.Allowed, "Skipped request should be allowed")
+	if assert.NotNil(t, resp.Result, "Skipped request should have a result with verbose responses") {
+		assert.Contains(t, resp.Result.Message, "Required annotation not present", "Result should explain the skip")
+	}
+
+	req.Operation = admissionv1beta1.Delete
+	resp = ah.Admit(req)
+	if assert.NotNil(t, resp.Result, "Skipped request should have a result with verbose responses") {
+		assert.Contains(t, resp.Result.Message, "Operation not templated", "Result should explain the skip")
+	}
+}
+
+func TestAdmitMaxPatchOps(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{
+		"A": "alpha",
+		"B": "beta",
+	})
+	ah.MaxPatchOps = 1
+
+	req := &admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}", "b": "{{ .B }}"}`),
+		},
+	}
+
+	resp := ah.Admit(req)
+	assert.False(t, resp.Allowed, "Request exceeding the maximum operations should be denied")
+	if assert.NotNil(t, resp.Result, "Denied request should have a result") {
+		assert.Contains(t, resp.Result.Message, "exceeding the maximum of 1", "Result should describe the limit")
+	}
+
+	ah.MaxPatchOps = 2
+	req.Object.Raw = []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}", "b": "beta"}`)
+	resp = ah.Admit(req)
+	assert.True(t, resp.Allowed, "Request within the maximum operations should be allowed")
+
+	// Operations added after templating count towards the limit
+	req.Object.Raw = []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/json-patch": "[{\"op\": \"add\", \"path\": \"/c\", \"value\": \"gamma\"}, {\"op\": \"add\", \"path\": \"/d\", \"value\": \"delta\"}]"}}, "a": "{{ .A }}"}`)
+	resp = ah.Admit(req)
+	assert.False(t, resp.Allowed, "User patch operations should count towards the maximum")
+
+	ah.RecordPatch = true
+	req.Object.Raw = []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`)
+	resp = ah.Admit(req)
+	assert.False(t, resp.Allowed, "Patch record operations should count towards the maximum")
+
+	ah.MaxPatchOps = 0
+	resp = ah.Admit(req)
+	assert.True(t, resp.Allowed, "Patch should not be limited by default")
+}
+
+func TestAdmitMaxAnnotations(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.MaxAnnotations = 2
+
+	admit := func(annotations string) *admissionv1beta1.AdmissionResponse {
+		return ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Operation: admissionv1beta1.Create,
+			Object: runtime.RawExtension{
+				Raw: []byte(fmt.Sprintf(`{"metadata": {"name": "foo", "annotations": {%s}}, "a": "{{ .A }}"}`, annotations)),
+			},
+		})
+	}
+
+	resp := admit(`"quack.pusher.com/a": "1", "quack.pusher.com/b": "2", "example.com/c": "3"`)
+	assert.True(t, resp.Allowed, "Object within the maximum annotations should be allowed")
+	assert.JSONEq(t, `[{"op": "replace", "path": "/a", "value": "alpha"}]`, string(resp.Patch), "Object within the maximum annotations should be templated")
+
+	resp = admit(`"quack.pusher.com/a": "1", "quack.pusher.com/b": "2", "quack.pusher.com/c": "3"`)
+	assert.False(t, resp.Allowed, "Object exceeding the maximum annotations should be denied")
+	if assert.NotNil(t, resp.Result, "Denied request should have a result") {
+		assert.Contains(t, resp.Result.Message, "3 quack.pusher.com annotations, exceeding the maximum of 2", "Result should describe the limit")
+	}
+
+	ah.FailurePolicy = "Ignore"
+	resp = admit(`"quack.pusher.com/a": "1", "quack.pusher.com/b": "2", "quack.pusher.com/c": "3"`)
+	assert.True(t, resp.Allowed, "Object exceeding the maximum annotations should be allowed by the Ignore failure policy")
+	assert.Nil(t, resp.Patch, "Object exceeding the maximum annotations should not be templated")
+}
+
+func TestAdmitRequiredAnnotationFromValues(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{
+		"A":                   "alpha",
+		requiredAnnotationKey: "quack.pusher.com/template",
+	})
+
+	req := &admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`),
+		},
+	}
+	resp := ah.Admit(req)
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.Nil(t, resp.Patch, "Object without the configured annotation should not be patched")
+
+	req.Object.Raw = []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/template": "true"}}, "a": "{{ .A }}", "b": "{{ index . ` + "`quack.required-annotation`" + ` }}"}`)
+	resp = ah.Admit(req)
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	ops := []map[string]interface{}{}
+	err := json.Unmarshal(resp.Patch, &ops)
+	if err != nil {
+		assert.FailNowf(t, "jsonError", "Failed to unmarshal patch: %v", err)
+	}
+	assert.Contains(t, ops, map[string]interface{}{"op": "replace", "path": "/a", "value": "alpha"}, "Object with the configured annotation should be patched")
+	assert.NotContains(t, ops, map[string]interface{}{"op": "replace", "path": "/b", "value": "quack.pusher.com/template"}, "Reserved key should not be available to templates")
+
+	// The configured annotation overrides the flag
+	ah.RequiredAnnotation = "other"
+	resp = ah.Admit(req)
+	assert.NotNil(t, resp.Patch, "Values should override the flag")
+}
+
+func TestAdmitRequiredAnnotationWithoutValues(t *testing.T) {
+	ah := &AdmissionHook{
+		client:             fake.NewSimpleClientset(),
+		ValuesMapName:      "quack-values",
+		ValuesMapNamespace: "quack",
+		RequiredAnnotation: "quack.pusher.com/template",
+	}
+
+	req := &admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`),
+		},
+	}
+	resp := ah.Admit(req)
+	assert.True(t, resp.Allowed, "Object without the required annotation should be allowed when values are missing")
+
+	ah.client.(*fake.Clientset).PrependReactor("get", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("connection refused")
+	})
+	resp = ah.Admit(req)
+	assert.True(t, resp.Allowed, "Object without the required annotation should be allowed when values can't be read")
+
+	req.Object.Raw = []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/template": "true"}}, "a": "{{ .A }}"}`)
+	resp = ah.Admit(req)
+	assert.False(t, resp.Allowed, "Object with the required annotation should be rejected when values can't be read")
+}
+
+func TestAdmitRequiredAnnotationSkipsValues(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.RequiredAnnotation = "quack.pusher.com/template"
+	gets := 0
+	ah.client.(*fake.Clientset).PrependReactor("get", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if action.(clienttesting.GetAction).GetName() == "team-values" {
+			gets++
+		}
+		return false, nil, nil
+	})
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/values-configmap": "team-values"}}, "a": "{{ .A }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Object without the required annotation should be allowed")
+	assert.Nil(t, resp.Patch, "Object without the required annotation should not be patched")
+	assert.Equal(t, 0, gets, "Values should not be loaded for objects without the required annotation")
+	for _, action := range ah.client.(*fake.Clientset).Actions() {
+		assert.False(t, action.Matches("create", "subjectaccessreviews"), "Access to values should not be reviewed for objects without the required annotation")
+	}
+}
+
+func TestAdmitSkipAnnotation(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.RequiredAnnotation = "quack.pusher.com/template"
+
+	req := &admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/template": "true", "quack.pusher.com/skip": "true"}}, "a": "{{ .A }}"}`),
+		},
+	}
+	resp := ah.Admit(req)
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.Nil(t, resp.Patch, "Object opting out should not be patched")
+	assert.Nil(t, resp.PatchType, "Object opting out should not set a patch type")
+
+	req.Object.Raw = []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/template": "true", "quack.pusher.com/skip": "false"}}, "a": "{{ .A }}"}`)
+	resp = ah.Admit(req)
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/a", "value": "alpha"}
+	]`, string(resp.Patch), "Object not opting out should be patched, without patching the skip annotation")
+}
+
+func TestRequiredAnnotation(t *testing.T) {
+	ah := &AdmissionHook{RequiredAnnotation: "flag"}
+
+	values := map[string]string{"A": "alpha"}
+	assert.Equal(t, "flag", ah.requiredAnnotation(values), "Flag should be used when values don't set the annotation")
+
+	values[requiredAnnotationKey] = "configmap"
+	assert.Equal(t, "configmap", ah.requiredAnnotation(values), "Values should override the flag")
+	assert.Equal(t, map[string]string{"A": "alpha"}, values, "Reserved key should be removed from values")
+
+	values[requiredAnnotationKey] = ""
+	assert.Equal(t, "", ah.requiredAnnotation(values), "Empty value should disable the requirement")
+}
+
+func TestAdmitObjectUID(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "uid": "{{ .UID }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[{"op": "replace", "path": "/uid", "value": ""}]`, string(resp.Patch), "UID should be empty on create")
+
+	resp = ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "update-uid",
+		Operation: admissionv1beta1.Update,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "uid": "2d1e7d2a-0f4e-11e8-b642-0ed5f89f718b"}, "uid": "{{ .UID }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[{"op": "replace", "path": "/uid", "value": "2d1e7d2a-0f4e-11e8-b642-0ed5f89f718b"}]`, string(resp.Patch), "UID should be the object's UID on update")
+}
+
+func TestTemplateContextValuesHash(t *testing.T) {
+	values := map[string]string{
+		"A": "alpha",
+		"B": "beta",
+	}
+	sameValues := map[string]string{
+		"B": "beta",
+		"A": "alpha",
+	}
+	changedValues := map[string]string{
+		"A": "alpha",
+		"B": "gamma",
+	}
+
+	hash := templateContext(values, metav1.ObjectMeta{}, []string{})[valuesHashContextKey]
+	assert.Len(t, hash, 64, "Hash should be a hex encoded sha256")
+	assert.Equal(t, hash, templateContext(sameValues, metav1.ObjectMeta{}, []string{})[valuesHashContextKey], "Hash should be stable for the same values")
+	assert.NotEqual(t, hash, templateContext(changedValues, metav1.ObjectMeta{}, []string{})[valuesHashContextKey], "Hash should change when values change")
+
+	outputBytes, err := renderTemplate([]byte(`{"hash": "{{ .ValuesHash }}"}`), templateContext(values, metav1.ObjectMeta{}, []string{}), templateOptions{})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Failed rendering template: %v", err)
+	}
+	assert.JSONEq(t, fmt.Sprintf(`{"hash": "%s"}`, hash), string(outputBytes), "Hash should be rendered")
+}
+
+func TestKindAllowed(t *testing.T) {
+	configMap := metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	deployment := metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+	event := metav1.GroupVersionKind{Version: "v1", Kind: "Event"}
+
+	ah := &AdmissionHook{}
+	assert.True(t, ah.kindAllowed(event), "All kinds should be templated by default")
+
+	ah = &AdmissionHook{ExcludeKinds: []string{"Event"}}
+	assert.False(t, ah.kindAllowed(event), "Excluded kind should be skipped")
+	assert.True(t, ah.kindAllowed(configMap), "Unlisted kind should be templated without includes")
+
+	ah = &AdmissionHook{IncludeKinds: []string{"ConfigMap"}}
+	assert.True(t, ah.kindAllowed(configMap), "Included kind should be templated")
+	assert.False(t, ah.kindAllowed(deployment), "Unlisted kind should be skipped with includes")
+
+	ah = &AdmissionHook{IncludeKinds: []string{"ConfigMap"}, DefaultAction: defaultActionTemplate}
+	assert.True(t, ah.kindAllowed(deployment), "Unlisted kind should be templated with the template default action")
+
+	ah = &AdmissionHook{ExcludeKinds: []string{"Event"}, DefaultAction: defaultActionSkip}
+	assert.False(t, ah.kindAllowed(deployment), "Unlisted kind should be skipped with the skip default action")
+	assert.False(t, ah.kindAllowed(event), "Excluded kind should be skipped")
+
+	ah = &AdmissionHook{IncludeKinds: []string{"Deployment.apps"}}
+	assert.True(t, ah.kindAllowed(deployment), "Included kind should be templated in its group")
+	assert.False(t, ah.kindAllowed(metav1.GroupVersionKind{Group: "extensions", Version: "v1beta1", Kind: "Deployment"}), "Included kind should be skipped in other groups")
+
+	ah = &AdmissionHook{ExcludeKinds: []string{"Event.events.k8s.io"}}
+	assert.False(t, ah.kindAllowed(metav1.GroupVersionKind{Group: "events.k8s.io", Version: "v1beta1", Kind: "Event"}), "Excluded kind should be skipped in its group")
+	assert.True(t, ah.kindAllowed(event), "Excluded kind should be templated in other groups")
+}
+
+func TestAdmitExcludedKindSkipsValues(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.IncludeKinds = []string{"ConfigMap", "Deployment.apps"}
+	gets := 0
+	ah.client.(*fake.Clientset).PrependReactor("get", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		gets++
+		return false, nil, nil
+	})
+
+	req := &admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Event"},
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`),
+		},
+	}
+	resp := ah.Admit(req)
+	assert.True(t, resp.Allowed, "Excluded kind should be allowed")
+	assert.Nil(t, resp.Patch, "Excluded kind should not be patched")
+	assert.Equal(t, 0, gets, "Values should not be read for excluded kinds")
+
+	req.Kind = metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+	resp = ah.Admit(req)
+	assert.True(t, resp.Allowed, "Included kind should be allowed")
+	assert.NotNil(t, resp.Patch, "Included kind should be patched")
+	assert.Equal(t, 1, gets, "Values should be read for included kinds")
+}
+
+func TestAdmitDefaultActionSkip(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{
+		"A": "alpha",
+	})
+	ah.IncludeKinds = []string{"ConfigMap"}
+	ah.DefaultAction = defaultActionSkip
+
+	req := &admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`),
+		},
+	}
+	resp := ah.Admit(req)
+	assert.True(t, resp.Allowed, "Unlisted kind should be allowed")
+	assert.Nil(t, resp.Patch, "Unlisted kind should not be patched")
+
+	req.Kind = metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	resp = ah.Admit(req)
+	assert.True(t, resp.Allowed, "Included kind should be allowed")
+	assert.NotNil(t, resp.Patch, "Included kind should be patched")
+}
+
+func TestInitializeInvalidDefaultAction(t *testing.T) {
+	ah := &AdmissionHook{DefaultAction: "deny"}
+	err := ah.Initialize(&restclient.Config{}, make(chan struct{}))
+	assert.NotNil(t, err, "Invalid default action should return an error")
+
+	ah = &AdmissionHook{DefaultAction: defaultActionSkip}
+	err = ah.Initialize(&restclient.Config{}, make(chan struct{}))
+	assert.Nil(t, err, "Valid default action should not return an error")
+}
+
+func TestCreatePatchIsStable(t *testing.T) {
+	ah := &AdmissionHook{}
+	old := map[string]interface{}{}
+	new := map[string]interface{}{}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%d", i)
+		old[key] = map[string]string{"value": "{{ .A }}", "static": "static"}
+		new[key] = map[string]string{"value": "alpha", "static": "static"}
+	}
+	old["list"] = []string{"a", "b"}
+	new["list"] = []string{"a", "c", "d"}
+
+	oldBytes, err := json.Marshal(old)
+	if err != nil {
+		assert.FailNowf(t, "jsonError", "Failed to marshal input: %v", err)
+	}
+	newBytes, err := json.Marshal(new)
+	if err != nil {
+		assert.FailNowf(t, "jsonError", "Failed to marshal input: %v", err)
+	}
+
+	patch, err := ah.createPatch(oldBytes, newBytes, ah.IgnoredPaths, "")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in createPatch: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		repeated, err := ah.createPatch(oldBytes, newBytes, ah.IgnoredPaths, "")
+		if err != nil {
+			assert.FailNowf(t, "methodError", "Error in createPatch: %v", err)
+		}
+		assert.Equal(t, string(patch), string(repeated), "Identical inputs should produce identical patches")
+	}
+
+	ops := []map[string]interface{}{}
+	err = json.Unmarshal(patch, &ops)
+	if err != nil {
+		assert.FailNowf(t, "jsonError", "Failed to unmarshal patch: %v", err)
+	}
+	assert.Len(t, ops, 53, "Patch should only contain operations for changed values")
+	assert.Equal(t, []map[string]interface{}{
+		{"op": "remove", "path": "/list/1"},
+		{"op": "add", "path": "/list/1", "value": "c"},
+		{"op": "add", "path": "/list/2", "value": "d"},
+	}, ops[50:], "Array operations should keep their relative order")
+
+	patched, err := applyPatch(oldBytes, patch)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error applying patch: %v", err)
+	}
+	assert.JSONEq(t, string(newBytes), string(patched), "Patch should produce the rendered object")
+}
+
+func TestCreatePatchIgnoresKeyOrder(t *testing.T) {
+	ah := &AdmissionHook{}
+	patch, err := ah.createPatch([]byte(`{"b": "beta", "a": "{{ .A }}", "c": "gamma"}`), []byte(`{"a": "alpha", "c": "gamma", "b": "beta"}`), ah.IgnoredPaths, "")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in createPatch: %v", err)
+	}
+	assert.JSONEq(t, `[{"op": "replace", "path": "/a", "value": "alpha"}]`, string(patch), "Reordered keys should not produce operations")
+}
+
+func TestCreatePatchAllowedPatchPaths(t *testing.T) {
+	ah := &AdmissionHook{
+		AllowedPatchPaths: []string{"/metadata/annotations", "/spec/template/metadata/"},
+	}
+	old := []byte(`{
+		"metadata": {"annotations": {"a": "{{ .A }}"}, "annotationsExtra": "{{ .A }}", "labels": {"a": "{{ .A }}"}},
+		"spec": {"replicas": "{{ .A }}", "template": {"metadata": {"labels": {"a": "{{ .A }}"}}}}
+	}`)
+	new := []byte(`{
+		"metadata": {"annotations": {"a": "alpha"}, "annotationsExtra": "alpha", "labels": {"a": "alpha"}},
+		"spec": {"replicas": "alpha", "template": {"metadata": {"labels": {"a": "alpha"}}}}
+	}`)
+
+	patch, err := ah.createPatch(old, new, ah.IgnoredPaths, "")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in createPatch: %v", err)
+	}
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/metadata/annotations/a", "value": "alpha"},
+		{"op": "replace", "path": "/spec/template/metadata/labels/a", "value": "alpha"}
+	]`, string(patch), "Only operations within the allowed paths should be kept")
+
+	assert.Nil(t, ah.checkPatchPaths([]byte(`[{"op": "add", "path": "/metadata/annotations/b", "value": "beta"}]`)), "Patch within the allowed paths should be valid")
+	assert.NotNil(t, ah.checkPatchPaths([]byte(`[{"op": "add", "path": "/spec/replicas", "value": 1}]`)), "Patch outside the allowed paths should be invalid")
+
+	ah.AllowedPatchPaths = []string{}
+	patch, err = ah.createPatch(old, new, ah.IgnoredPaths, "")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in createPatch: %v", err)
+	}
+	ops := []map[string]interface{}{}
+	err = json.Unmarshal(patch, &ops)
+	if err != nil {
+		assert.FailNowf(t, "jsonError", "Failed to unmarshal patch: %v", err)
+	}
+	assert.Len(t, ops, 5, "All paths should be allowed by default")
+}
+
+func compressValue(t *testing.T, value string) string {
+	buff := new(bytes.Buffer)
+	writer := gzip.NewWriter(buff)
+	_, err := writer.Write([]byte(value))
+	if err != nil {
+		assert.FailNowf(t, "gzipError", "Failed to compress value: %v", err)
+	}
+	err = writer.Close()
+	if err != nil {
+		assert.FailNowf(t, "gzipError", "Failed to compress value: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(buff.Bytes())
+}
+
+func TestDecompressValues(t *testing.T) {
+	values := map[string]string{
+		"A":    "alpha",
+		"B.gz": compressValue(t, "beta"),
+	}
+
+	decompressed, err := decompressValues(values)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in decompressValues: %v", err)
+	}
+	assert.Equal(t, map[string]string{
+		"A": "alpha",
+		"B": "beta",
+	}, decompressed, "Compressed values should be decompressed under the base key")
+
+	_, err = decompressValues(map[string]string{"B.gz": "not base64"})
+	assert.NotNil(t, err, "Invalid base64 should return an error")
+
+	_, err = decompressValues(map[string]string{"B.gz": base64.StdEncoding.EncodeToString([]byte("beta"))})
+	assert.NotNil(t, err, "Invalid gzip should return an error")
+
+	_, err = decompressValues(map[string]string{"B": "beta", "B.gz": compressValue(t, "beta")})
+	assert.NotNil(t, err, "Conflicting keys should return an error")
+}
+
+func TestAdmitDecompressValues(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{
+		"A.gz": compressValue(t, "alpha"),
+	})
+	ah.DecompressValues = true
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[{"op": "replace", "path": "/a", "value": "alpha"}]`, string(resp.Patch), "Decompressed value should be templated")
+}
+
+func TestDecodeValues(t *testing.T) {
+	values := map[string]string{
+		"A":     "alpha",
+		"B.b64": base64.StdEncoding.EncodeToString([]byte("-----BEGIN CERTIFICATE-----\nbeta")),
+	}
+
+	decoded, err := decodeValues(values)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in decodeValues: %v", err)
+	}
+	assert.Equal(t, map[string]string{
+		"A": "alpha",
+		"B": "-----BEGIN CERTIFICATE-----\nbeta",
+	}, decoded, "Encoded values should be decoded under the base key")
+
+	_, err = decodeValues(map[string]string{"B.b64": "not base64"})
+	if assert.NotNil(t, err, "Invalid base64 should return an error") {
+		assert.Contains(t, err.Error(), "B.b64", "Error should name the key")
+	}
+
+	_, err = decodeValues(map[string]string{"B": "beta", "B.b64": base64.StdEncoding.EncodeToString([]byte("beta"))})
+	assert.NotNil(t, err, "Conflicting keys should return an error")
+}
+
+func TestAdmitDecodeValues(t *testing.T) {
+	for encoded, allowed := range map[string]bool{base64.StdEncoding.EncodeToString([]byte("alpha")): true, "not base64": false} {
+		ah := newTestAdmissionHook(map[string]string{"A.b64": encoded})
+		ah.DecodeValues = true
+
+		resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Operation: admissionv1beta1.Create,
+			Object: runtime.RawExtension{
+				Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`),
+			},
+		})
+		assert.Equal(t, allowed, resp.Allowed, "Decoding %q should be allowed: %v", encoded, allowed)
+		if allowed {
+			assert.JSONEq(t, `[{"op": "replace", "path": "/a", "value": "alpha"}]`, string(resp.Patch), "Decoded value should be templated")
+		} else if assert.NotNil(t, resp.Result, "Response should include a result") {
+			assert.Contains(t, resp.Result.Message, "failed to decode A.b64", "Message should name the key")
+		}
+	}
+}
+
+func TestRenderTemplateEngines(t *testing.T) {
+	input := []byte(`{"a": "{{ .A }}"}`)
+	values := map[string]string{"A": "<b>"}
+
+	htmlOutput, err := renderTemplate(input, values, templateOptions{engine: engineHTML})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in renderTemplate: %v", err)
+	}
+	assert.Equal(t, `{"a": "&lt;b&gt;"}`, string(htmlOutput), "html engine should escape values")
+
+	textOutput, err := renderTemplate(input, values, templateOptions{engine: engineText})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in renderTemplate: %v", err)
+	}
+	assert.Equal(t, `{"a": "<b>"}`, string(textOutput), "text engine should not escape values")
+}
+
+func TestRenderTemplateVerbatimValues(t *testing.T) {
+	values := map[string]string{
+		"A": "a&b",
+		"B": "https://x?y=1&z=2",
+		"C": "<b>",
+		"D": "'quoted'",
+		"E": `"double quoted"`,
+	}
+	input := []byte(`{"a": "{{ .A }}", "b": "{{ .B }}", "c": "{{ .C }}", "d": "{{ .D }}", "e": "{{ .E | toJson }}"}`)
+
+	output, err := renderTemplate(input, values, templateOptions{})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in renderTemplate: %v", err)
+	}
+
+	rendered := map[string]string{}
+	err = json.Unmarshal(output, &rendered)
+	if err != nil {
+		assert.FailNowf(t, "jsonError", "Error unmarshalling output: %v", err)
+	}
+	for key, value := range values {
+		assert.Equal(t, value, rendered[strings.ToLower(key)], "Values should be rendered verbatim by default")
+	}
+}
+
+func TestGetEngine(t *testing.T) {
+	engine, err := getEngine(metav1.ObjectMeta{}, defaultAnnotationDomain, engineHTML)
+	assert.Nil(t, err, "Missing annotation should not return an error")
+	assert.Equal(t, engineHTML, engine, "Engine should default when annotation missing")
+
+	engine, err = getEngine(metav1.ObjectMeta{Annotations: map[string]string{engineAnnotation: "text"}}, defaultAnnotationDomain, engineHTML)
+	assert.Nil(t, err, "Valid annotation should not return an error")
+	assert.Equal(t, engineText, engine, "Engine should be read from annotation")
+
+	_, err = getEngine(metav1.ObjectMeta{Annotations: map[string]string{engineAnnotation: "cel"}}, defaultAnnotationDomain, engineHTML)
+	assert.NotNil(t, err, "Unknown engine should return an error")
+}
+
+func TestAdmitEngineAnnotation(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "<b>"})
+	err := ah.initialize(ah.client)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in initialize: %v", err)
+	}
+
+	for engine, expected := range map[string]string{
+		engineHTML: "&lt;b&gt;",
+		engineText: "<b>",
+	} {
+		resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Operation: admissionv1beta1.Create,
+			Object: runtime.RawExtension{
+				Raw: []byte(fmt.Sprintf(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/engine": "%s"}}, "a": "{{ .A }}"}`, engine)),
+			},
+		})
+		assert.True(t, resp.Allowed, "Request should be allowed")
+		// The engine annotation must not be removed by the patch
+		patch := fmt.Sprintf(`[{"op": "replace", "path": "/a", "value": %q}]`, expected)
+		assert.JSONEq(t, patch, string(resp.Patch), "Value should be rendered by the %s engine", engine)
+	}
+}
+
+func TestInitializeInvalidEngine(t *testing.T) {
+	ah := &AdmissionHook{TemplateEngine: "cel"}
+	err := ah.initialize(fake.NewSimpleClientset())
+	assert.NotNil(t, err, "Invalid template engine should return an error")
+}
+
+func TestAdmitNilObject(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+
+	for _, operation := range []admissionv1beta1.Operation{
+		admissionv1beta1.Create,
+		admissionv1beta1.Update,
+		admissionv1beta1.Delete,
+	} {
+		resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "nil-object-uid",
+			Operation: operation,
+		})
+		assert.True(t, resp.Allowed, "%s request without an object should be allowed", operation)
+		assert.Nil(t, resp.Patch, "%s request without an object should not be patched", operation)
+		assert.Nil(t, resp.Result, "%s request without an object should not fail", operation)
+	}
+}
+
+func TestAdmitRecordPatch(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+	ah.RecordPatch = true
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ if .PriorPatch }}again{{ else }}first{{ end }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/a", "value": "first"},
+		{"op": "add", "path": "/metadata/annotations", "value": {}},
+		{"op": "add", "path": "/metadata/annotations/quack.pusher.com~1patch", "value": "[{\"op\":\"replace\",\"path\":\"/a\",\"value\":\"first\"}]"}
+	]`, string(resp.Patch), "Patch should be recorded on the object")
+
+	ah.AllowedPatchPaths = []string{"/a"}
+	resp = ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ if .PriorPatch }}again{{ else }}first{{ end }}"}`),
+		},
+	})
+	assert.False(t, resp.Allowed, "Patch record outside the allowed patch paths should be denied")
+}
+
+func TestAdmitPriorPatch(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+	ah.RecordPatch = true
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "update-uid",
+		Operation: admissionv1beta1.Update,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {}}, "a": "{{ range .PriorPatch }}{{ .value }}{{ end }}-again"}`),
+		},
+		OldObject: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/patch": "[{\"op\":\"replace\",\"path\":\"/a\",\"value\":\"first\"}]"}}, "a": "first"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/a", "value": "first-again"},
+		{"op": "add", "path": "/metadata/annotations/quack.pusher.com~1patch", "value": "[{\"op\":\"replace\",\"path\":\"/a\",\"value\":\"first-again\"}]"}
+	]`, string(resp.Patch), "Prior patch should be available to the template")
+}
+
+func TestGetPriorPatchInvalid(t *testing.T) {
+	_, err := getPriorPatch(&admissionv1beta1.AdmissionRequest{
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"annotations": {"quack.pusher.com/patch": "not a patch"}}}`),
+		},
+	}, defaultAnnotationDomain)
+	assert.NotNil(t, err, "Invalid patch record should return an error")
+}
+
+func TestServingPath(t *testing.T) {
+	ah := &AdmissionHook{}
+	gvr, _ := ah.MutatingResource()
+	assert.Equal(t, "/apis/quack.pusher.com/v1alpha1/admissionreviews", servingPath(gvr), "Webhook should be served at the default path")
+
+	ah.WebhookResource = "templates"
+	gvr, _ = ah.MutatingResource()
+	assert.Equal(t, "/apis/quack.pusher.com/v1alpha1/templates", servingPath(gvr), "Webhook should be served at the configured resource")
+}
+
+func TestRestrictValues(t *testing.T) {
+	values := map[string]string{"A": "alpha", "B": "beta", "C": "gamma"}
+
+	unrestricted, restricted, err := restrictValues(values, metav1.ObjectMeta{}, defaultAnnotationDomain)
+	assert.Nil(t, err, "Missing annotation should not return an error")
+	assert.False(t, restricted, "Missing annotation should not restrict values")
+	assert.Equal(t, values, unrestricted, "Missing annotation should return all values")
+
+	subset, restricted, err := restrictValues(values, metav1.ObjectMeta{
+		Annotations: map[string]string{valuesKeysAnnotation: "A, B"},
+	}, defaultAnnotationDomain)
+	assert.Nil(t, err, "Valid annotation should not return an error")
+	assert.True(t, restricted, "Annotation should restrict values")
+	assert.Equal(t, map[string]string{"A": "alpha", "B": "beta"}, subset, "Values should be limited to listed keys")
+
+	_, _, err = restrictValues(values, metav1.ObjectMeta{
+		Annotations: map[string]string{valuesKeysAnnotation: "A,D"},
+	}, defaultAnnotationDomain)
+	assert.NotNil(t, err, "Listing a missing key should return an error")
+}
+
+func TestAdmitValuesKeys(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha", "B": "beta"})
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/values-keys": "A"}}, "a": "{{ .A }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request referencing listed keys should be allowed")
+	assert.JSONEq(t, `[{"op": "replace", "path": "/a", "value": "alpha"}]`, string(resp.Patch), "Listed key should be templated and the annotation kept out of the patch")
+
+	resp = ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/values-keys": "A"}}, "b": "{{ .B }}"}`),
+		},
+	})
+	assert.False(t, resp.Allowed, "Request referencing excluded keys should not be allowed")
+}
+
+func TestCreatePatchAnnotationDomain(t *testing.T) {
+	old := []byte(`{"metadata": {"annotations": {"quack.pusher.com/a": "{{ .A }}", "templating.example.com/a": "{{ .A }}"}}}`)
+	new := []byte(`{"metadata": {"annotations": {"quack.pusher.com/a": "alpha", "templating.example.com/a": "alpha"}}}`)
+
+	ah := &AdmissionHook{}
+	patch, err := ah.createPatch(old, new, ah.IgnoredPaths, "")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in createPatch: %v", err)
+	}
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/metadata/annotations/templating.example.com~1a", "value": "alpha"}
+	]`, string(patch), "Operations on default domain annotations should be filtered")
+
+	ah.AnnotationDomain = "templating.example.com"
+	patch, err = ah.createPatch(old, new, ah.IgnoredPaths, "")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in createPatch: %v", err)
+	}
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/metadata/annotations/quack.pusher.com~1a", "value": "alpha"}
+	]`, string(patch), "Operations on custom domain annotations should be filtered")
+}
+
+func TestGetDelimsAnnotationDomain(t *testing.T) {
+	object := []byte(`{"metadata": {"annotations": {"templating.example.com/left-delim": "[[", "templating.example.com/right-delim": "]]"}}}`)
+
+	delims, err := getDelims(requestLogger{}, object, "templating.example.com", nil)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in getDelims: %v", err)
+	}
+	assert.Equal(t, delimiters{left: "[[", right: "]]"}, delims, "Delimiters should be read from the custom domain")
+
+	delims, err = getDelims(requestLogger{}, object, defaultAnnotationDomain, nil)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in getDelims: %v", err)
+	}
+	assert.Equal(t, delimiters{}, delims, "Delimiters in other domains should be ignored")
+}
+
+func TestGetTemplateInputAnnotationDomain(t *testing.T) {
+	input := []byte(`{"metadata": {"annotations": {"quack.pusher.com/a": "{{ .A }}", "templating.example.com/a": "{{ .A }}"}}}`)
+
+	template, err := getTemplateInput(input, "templating.example.com", nil, defaultStatusPath, []string{}, "")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in getTemplateInput: %v", err)
+	}
+	assert.JSONEq(t, `{"metadata": {"annotations": {"quack.pusher.com/a": "{{ .A }}"}}}`, string(template), "Only annotations in the custom domain should be removed")
+}
+
+func TestGetTemplateInputEscapesAnnotations(t *testing.T) {
+	input := []byte(`{"metadata": {"annotations": {"quack.pusher.com/a~1b": "{{ .A }}", "example.com/c": "{{ .C }}"}}}`)
+
+	template, err := getTemplateInput(input, defaultAnnotationDomain, nil, defaultStatusPath, []string{}, "")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in getTemplateInput: %v", err)
+	}
+	assert.JSONEq(t, `{"metadata": {"annotations": {"example.com/c": "{{ .C }}"}}}`, string(template), "Annotations containing tildes should be removed")
+}
+
+func TestAdmitAnnotationDomain(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha", "B": "beta", "C": "gamma"})
+	ah.AnnotationDomain = "templating.example.com"
+	ah.RecordPatch = true
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{
+				"metadata": {
+					"name": "foo",
+					"annotations": {
+						"templating.example.com/json-patch": "[{\"op\": \"add\", \"path\": \"/b\", \"value\": \"{{ .B }}\"}]",
+						"templating.example.com/ignore-paths": "/c",
+						"templating.example.com/values-keys": "A, B",
+						"templating.example.com/keep-status": "true",
+						"quack.pusher.com/ignore-paths": "/a"
+					}
+				},
+				"a": "{{ .A }}",
+				"c": "{{ .C }}",
+				"status": {"phase": "{{ .A }}"}
+			}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed: %v", resp.Result)
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/a", "value": "alpha"},
+		{"op": "replace", "path": "/status/phase", "value": "alpha"},
+		{"op": "add", "path": "/b", "value": "beta"},
+		{"op": "add", "path": "/metadata/annotations/templating.example.com~1patch", "value": "[{\"op\":\"replace\",\"path\":\"/a\",\"value\":\"alpha\"},{\"op\":\"replace\",\"path\":\"/status/phase\",\"value\":\"alpha\"},{\"op\":\"add\",\"path\":\"/b\",\"value\":\"beta\"}]"}
+	]`, string(resp.Patch), "Annotations should be read from the custom domain only")
+}
+
+func TestEscapeJSONPointer(t *testing.T) {
+	assert.Equal(t, "quack.pusher.com", escapeJSONPointer("quack.pusher.com"), "Dots should not be escaped")
+	assert.Equal(t, "example.com~1quack~0", escapeJSONPointer("example.com/quack~"), "Slashes and tildes should be escaped")
+}
+
+func TestGetTemplateInputKeepStatus(t *testing.T) {
+	input := []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/keep-status": "true"}}, "status": {"phase": "{{ .Phase }}"}}`)
+
+	template, err := getTemplateInput(input, defaultAnnotationDomain, nil, defaultStatusPath, []string{}, "")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in getTemplateInput: %v", err)
+	}
+	assert.JSONEq(t, `{"metadata": {"name": "foo", "annotations": {}}, "status": {"phase": "{{ .Phase }}"}}`, string(template), "Status should be kept")
+}
+
+func TestAdmitKeepStatus(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"Phase": "Pending"})
+
+	for annotations, expected := range map[string]string{
+		`"quack.pusher.com/keep-status": "true"`:            `[{"op": "replace", "path": "/status/phase", "value": "Pending"}]`,
+		`"quack.pusher.com/disable-status-removal": "true"`: `[{"op": "replace", "path": "/status/phase", "value": "Pending"}]`,
+		`"quack.pusher.com/disable-status-removal": "no"`:   `[]`,
+		``: `[]`,
+	} {
+		resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Kind:      metav1.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Job"},
+			Operation: admissionv1beta1.Create,
+			Object: runtime.RawExtension{
+				Raw: []byte(fmt.Sprintf(`{"metadata": {"name": "foo", "annotations": {%s}}, "status": {"phase": "{{ .Phase }}"}}`, annotations)),
+			},
+		})
+		assert.True(t, resp.Allowed, "Request should be allowed")
+		patch := string(resp.Patch)
+		if patch == "" {
+			patch = "[]"
+		}
+		assert.JSONEq(t, expected, patch, "Status should only be templated when kept")
+		assert.NotContains(t, patch, "quack.pusher.com", "Annotations should not be patched")
+	}
+}
+
+func TestAdmitStatusSubresource(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"Phase": "Pending", "Replicas": "3"})
+	object := []byte(`{"metadata": {"name": "foo"}, "spec": {"replicas": "{{ .Replicas }}"}, "status": {"phase": "{{ .Phase }}"}}`)
+
+	for subresource, expected := range map[string]string{
+		"":       `[{"op": "replace", "path": "/spec/replicas", "value": "3"}]`,
+		"status": `[{"op": "replace", "path": "/status/phase", "value": "Pending"}]`,
+	} {
+		resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:         "update-uid",
+			Kind:        metav1.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Job"},
+			SubResource: subresource,
+			Operation:   admissionv1beta1.Update,
+			Object:      runtime.RawExtension{Raw: object},
+			OldObject:   runtime.RawExtension{Raw: object},
+		})
+		assert.True(t, resp.Allowed, "Request should be allowed")
+		assert.JSONEq(t, expected, string(resp.Patch), "Only the spec or status should be templated for subresource %q", subresource)
+	}
+}
+
+func TestCreatePatchFiltersStatus(t *testing.T) {
+	old := []byte(`{"metadata": {"name": "foo"}, "status": {"phase": "{{ .Phase }}"}, "statusMessage": "{{ .Phase }}", "state": {"phase": "{{ .Phase }}"}}`)
+	new := []byte(`{"metadata": {"name": "foo"}, "status": {"phase": "Pending"}, "statusMessage": "Pending", "state": {"phase": "Pending"}}`)
+
+	ah := &AdmissionHook{}
+	patch, err := ah.createPatch(old, new, ah.IgnoredPaths, "")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in createPatch: %v", err)
+	}
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/state/phase", "value": "Pending"},
+		{"op": "replace", "path": "/statusMessage", "value": "Pending"}
+	]`, string(patch), "Operations within the status should be filtered by default")
+
+	ah.StatusPath = "/state"
+	patch, err = ah.createPatch(old, new, ah.IgnoredPaths, "")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in createPatch: %v", err)
+	}
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/status/phase", "value": "Pending"},
+		{"op": "replace", "path": "/statusMessage", "value": "Pending"}
+	]`, string(patch), "Operations within the configured status path should be filtered")
+
+	old = []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/keep-status": "true"}}, "state": {"phase": "{{ .Phase }}"}}`)
+	new = []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/keep-status": "true"}}, "state": {"phase": "Pending"}}`)
+	patch, err = ah.createPatch(old, new, ah.IgnoredPaths, "")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in createPatch: %v", err)
+	}
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/state/phase", "value": "Pending"}
+	]`, string(patch), "Kept status should be patched")
+}
+
+func TestAdmitStatusPath(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"Phase": "Pending"})
+	ah.StatusPath = "/state"
+
+	admit := func(annotations string) *admissionv1beta1.AdmissionResponse {
+		return ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Operation: admissionv1beta1.Create,
+			Object: runtime.RawExtension{
+				Raw: []byte(`{
+					"metadata": {"name": "foo", "annotations": {` + annotations + `}},
+					"status": {"phase": "{{ .Phase }}"},
+					"state": {"phase": "{{ .Phase }}"}
+				}`),
+			},
+		})
+	}
+
+	resp := admit(`"quack.pusher.com/json-patch": "[{\"op\": \"add\", \"path\": \"/state/owner\", \"value\": \"mallard\"}]"`)
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/status/phase", "value": "Pending"}
+	]`, string(resp.Patch), "Neither the template nor the user patch should change the configured status path")
+
+	resp = admit(`"quack.pusher.com/keep-status": "true", "quack.pusher.com/json-patch": "[{\"op\": \"add\", \"path\": \"/state/owner\", \"value\": \"mallard\"}]"`)
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/state/phase", "value": "Pending"},
+		{"op": "replace", "path": "/status/phase", "value": "Pending"},
+		{"op": "add", "path": "/state/owner", "value": "mallard"}
+	]`, string(resp.Patch), "Kept status should be templated and patched")
+}
+
+func TestGetTemplateInputIgnoredPathWithoutParent(t *testing.T) {
+	input := []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`)
+
+	output, err := getTemplateInput(input, defaultAnnotationDomain, nil, defaultStatusPath, []string{lastAppliedConfigPath}, "")
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in getTemplateInput: %v", err)
+	}
+	assert.JSONEq(t, string(input), string(output), "Ignored path without a parent should be skipped")
+}
+
+func TestParsePairs(t *testing.T) {
+	pairs, err := parsePairs([]string{"Region=AWSRegion", "Template={{ .A }}={{ .B }}"})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in parsePairs: %v", err)
+	}
+	assert.Equal(t, map[string]string{"Region": "AWSRegion", "Template": "{{ .A }}={{ .B }}"}, pairs, "Pairs should be parsed")
+
+	_, err = parsePairs([]string{"Region"})
+	assert.NotNil(t, err, "Pair without a value should return an error")
+
+	_, err = parsePairs([]string{"=AWSRegion"})
+	assert.NotNil(t, err, "Pair without a key should return an error")
+}
+
+func TestAdmitLenientDelimiters(t *testing.T) {
+	for _, lenient := range []bool{false, true} {
+		ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+		ah.LenientDelimiters = lenient
+
+		resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Operation: admissionv1beta1.Create,
+			Object: runtime.RawExtension{
+				Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/left-delim": "[["}}, "a": "{{ .A }}"}`),
+			},
+		})
+		assert.Equal(t, lenient, resp.Allowed, "Invalid delimiters should only be allowed when lenient")
+		if lenient {
+			assert.JSONEq(t, `[{"op": "replace", "path": "/a", "value": "alpha"}]`, string(resp.Patch), "Default delimiters should be used when lenient")
+		}
+	}
+}
+
+func TestAdmitUserGroups(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+	object := []byte(`{"metadata": {"name": "foo"}, "team": "{{ if hasGroup ` + "`team-a`" + ` }}a{{ else }}other{{ end }}", "groups": "{{ len .Request.UserInfo.Groups }}"}`)
+
+	for group, team := range map[string]string{"team-a": "a", "team-b": "other"} {
+		resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Operation: admissionv1beta1.Create,
+			UserInfo: authenticationv1.UserInfo{
+				Username: "user",
+				Groups:   []string{group, "system:authenticated"},
+			},
+			Object: runtime.RawExtension{
+				Raw: object,
+			},
+		})
+		assert.True(t, resp.Allowed, "Request should be allowed")
+		assert.JSONEq(t, fmt.Sprintf(`[
+			{"op": "replace", "path": "/groups", "value": "2"},
+			{"op": "replace", "path": "/team", "value": %q}
+		]`, team), string(resp.Patch), "Value should be templated from the groups of %s", group)
+	}
+}
+
+func TestAdmitAPIVersion(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+	object := []byte(`{"metadata": {"name": "foo"}, "selector": "{{ if apiVersionIs ` + "`apps/v1`" + ` }}required{{ else }}defaulted{{ end }}", "group": "{{ .Request.Kind.Group }}", "version": "{{ .Request.Kind.Version }}"}`)
+
+	for version, selector := range map[string]string{"v1": "required", "v1beta1": "defaulted"} {
+		resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Kind:      metav1.GroupVersionKind{Group: "apps", Version: version, Kind: "Deployment"},
+			Operation: admissionv1beta1.Create,
+			Object: runtime.RawExtension{
+				Raw: object,
+			},
+		})
+		assert.True(t, resp.Allowed, "Request should be allowed")
+		assert.JSONEq(t, fmt.Sprintf(`[
+			{"op": "replace", "path": "/group", "value": "apps"},
+			{"op": "replace", "path": "/selector", "value": %q},
+			{"op": "replace", "path": "/version", "value": %q}
+		]`, selector, version), string(resp.Patch), "Value should be templated from apiVersion apps/%s", version)
+	}
+}
+
+func TestAdmitRequireFullRender(t *testing.T) {
+	rendered := []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`)
+	leftover := []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}", "b": "{{ ` + "`{{`" + ` }} .B }}"}`)
+	leftoverCustom := []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/left-delim": "[[", "quack.pusher.com/right-delim": "]]"}}, "a": "[[ .A ]]", "b": "[[ ` + "`[[`" + ` ]] .B ]]"}`)
+
+	for _, require := range []bool{false, true} {
+		ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+		ah.RequireFullRender = require
+		ah.VerboseResponses = true
+
+		resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: rendered},
+		})
+		assert.True(t, resp.Allowed, "Fully rendered object should be allowed")
+		assert.Nil(t, resp.Result, "Fully rendered object should not warn")
+
+		for _, object := range [][]byte{leftover, leftoverCustom} {
+			resp = ah.Admit(&admissionv1beta1.AdmissionRequest{
+				UID:       "create-uid",
+				Operation: admissionv1beta1.Create,
+				Object:    runtime.RawExtension{Raw: object},
+			})
+			assert.Equal(t, !require, resp.Allowed, "Partially rendered object should only be allowed if full render not required")
+			assert.Contains(t, resp.Result.Message, "left delimiter", "Partially rendered object should be reported")
+		}
+	}
+}
+
+func TestAdmitFailureCode(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+	req := &admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A "}`),
+		},
+	}
+
+	resp := ah.Admit(req)
+	assert.False(t, resp.Allowed, "Invalid template should be rejected")
+	assert.Equal(t, int32(http.StatusInternalServerError), resp.Result.Code, "Failure code should default to 500")
+
+	ah.FailureCode = http.StatusBadRequest
+	resp = ah.Admit(req)
+	assert.False(t, resp.Allowed, "Invalid template should be rejected")
+	assert.Equal(t, int32(http.StatusBadRequest), resp.Result.Code, "Configured failure code should be returned")
+
+	ah.FailureCode = http.StatusOK
+	err := ah.initialize(ah.client)
+	assert.NotNil(t, err, "Non error failure code should be rejected")
+}
+
+func TestAdmitFailurePolicy(t *testing.T) {
+	req := &admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A "}`),
+		},
+	}
+
+	for failurePolicy, allowed := range map[string]bool{"": false, failurePolicyFail: false, failurePolicyIgnore: true} {
+		ah := newTestAdmissionHook(map[string]string{})
+		ah.FailurePolicy = failurePolicy
+		err := ah.initialize(ah.client)
+		if err != nil {
+			assert.FailNowf(t, "methodError", "Error in initialize: %v", err)
+		}
+
+		resp := ah.Admit(req)
+		assert.Equal(t, allowed, resp.Allowed, "Invalid template should follow the failure policy %q", failurePolicy)
+		assert.Nil(t, resp.Patch, "Invalid template should not be patched with failure policy %q", failurePolicy)
+		assert.Nil(t, resp.PatchType, "Invalid template should not set a patch type with failure policy %q", failurePolicy)
+	}
+
+	ah := &AdmissionHook{FailurePolicy: "Retry"}
+	err := ah.initialize(nil)
+	assert.NotNil(t, err, "Invalid failure policy should return an error")
+}
+
+func TestAdmitStrictValues(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	req := &admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}", "b": "{{ .NotInConfigMap }}"}`),
+		},
+	}
+
+	resp := ah.Admit(req)
+	assert.True(t, resp.Allowed, "Missing value should be allowed unless strict")
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/a", "value": "alpha"},
+		{"op": "replace", "path": "/b", "value": "<no value>"}
+	]`, string(resp.Patch), "Missing value should render as <no value> unless strict")
+
+	ah.StrictValues = true
+	resp = ah.Admit(req)
+	assert.False(t, resp.Allowed, "Missing value should be rejected when strict")
+	assert.Contains(t, resp.Result.Message, "NotInConfigMap", "Response should name the missing key")
+}
+
+func TestAdmitStructuredValues(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{
+		"A":           "alpha",
+		"port":        "flat-port",
+		"values.yaml": "database:\n  host: db.example.com\n  port: 5432\nport: structured-port\n",
+	})
+	ah.StructuredValuesKey = "values.yaml"
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}", "host": "{{ .database.host }}", "dbPort": "{{ .database.port }}", "port": "{{ .port }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/a", "value": "alpha"},
+		{"op": "replace", "path": "/dbPort", "value": "5432"},
+		{"op": "replace", "path": "/host", "value": "db.example.com"},
+		{"op": "replace", "path": "/port", "value": "flat-port"}
+	]`, string(resp.Patch), "Nested values should be rendered, with flat values taking precedence")
+
+	data := map[string]interface{}{"values.yaml": "- not a map"}
+	err := mergeStructuredValues(data, "values.yaml")
+	assert.NotNil(t, err, "Structured values that aren't a map should return an error")
+}
@@ -0,0 +1,34 @@
+package quack
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// Render renders a single YAML or JSON manifest as if it were being created,
+// without a cluster, returning the rendered object as JSON and the patch
+// Quack would apply to it.
+// Requests for values are served from objects, which should include the
+// values ConfigMap.
+func (ah *AdmissionHook) Render(manifest []byte, objects ...runtime.Object) ([]byte, []byte, error) {
+	err := ah.initialize(fake.NewSimpleClientset(objects...))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	raw, resp, err := ah.admitManifest(manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(resp.Patch) == 0 {
+		return raw, []byte("[]"), nil
+	}
+
+	rendered, err := applyPatch(raw, resp.Patch)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to apply patch: %v", err)
+	}
+	return rendered, resp.Patch, nil
+}
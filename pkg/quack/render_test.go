@@ -0,0 +1,51 @@
+package quack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRender(t *testing.T) {
+	values := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "quack-values",
+			Namespace: "quack",
+		},
+		Data: map[string]string{
+			"ClusterName": "alpha",
+		},
+	}
+	manifest := []byte(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cluster-info
+data:
+  cluster: "{{ .ClusterName }}"
+  static: value
+`)
+
+	ah := &AdmissionHook{
+		ValuesMapName:      "quack-values",
+		ValuesMapNamespace: "quack",
+	}
+	rendered, patch, err := ah.Render(manifest, values)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in Render: %v", err)
+	}
+	assert.JSONEq(t, `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "cluster-info"}, "data": {"cluster": "alpha", "static": "value"}}`, string(rendered), "Object should be rendered")
+	assert.JSONEq(t, `[{"op": "replace", "path": "/data/cluster", "value": "alpha"}]`, string(patch), "Patch should template the object")
+
+	rendered, patch, err = ah.Render([]byte(`{"kind": "ConfigMap", "metadata": {"name": "static"}}`), values)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in Render: %v", err)
+	}
+	assert.JSONEq(t, `{"kind": "ConfigMap", "metadata": {"name": "static"}}`, string(rendered), "Object without templates should be unchanged")
+	assert.JSONEq(t, `[]`, string(patch), "Object without templates should have an empty patch")
+
+	_, _, err = ah.Render([]byte(`{"kind": "ConfigMap", "metadata": {"name": "invalid"}, "a": "{{ .A "}`), values)
+	assert.NotNil(t, err, "Object failing to render should return an error")
+}
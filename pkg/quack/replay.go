@@ -0,0 +1,41 @@
+package quack
+
+import (
+	"encoding/json"
+	"fmt"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// admissionV1APIVersion is the API version of admission.k8s.io/v1
+// AdmissionReviews, which share the format of v1beta1 for the fields used by
+// Quack, so are decoded as v1beta1.
+const admissionV1APIVersion = "admission.k8s.io/v1"
+
+// Replay runs a recorded AdmissionReview through Admit without a cluster.
+// Requests for values are served from objects, which should include the
+// values ConfigMap.
+// Both v1beta1 and v1 AdmissionReviews are accepted.
+func (ah *AdmissionHook) Replay(review []byte, objects ...runtime.Object) (*admissionv1beta1.AdmissionResponse, error) {
+	admissionReview := admissionv1beta1.AdmissionReview{}
+	err := json.Unmarshal(review, &admissionReview)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal admission review: %v", err)
+	}
+	switch admissionReview.APIVersion {
+	case "", admissionv1beta1.SchemeGroupVersion.String(), admissionV1APIVersion:
+	default:
+		return nil, fmt.Errorf("unsupported admission review version %q", admissionReview.APIVersion)
+	}
+	if admissionReview.Request == nil {
+		return nil, fmt.Errorf("admission review has no request")
+	}
+
+	err = ah.initialize(fake.NewSimpleClientset(objects...))
+	if err != nil {
+		return nil, err
+	}
+	return ah.Admit(admissionReview.Request), nil
+}
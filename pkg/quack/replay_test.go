@@ -0,0 +1,89 @@
+package quack
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReplay(t *testing.T) {
+	review, err := ioutil.ReadFile("testdata/replay/review.json")
+	if err != nil {
+		assert.FailNowf(t, "fileError", "Failed to read fixture: %v", err)
+	}
+	values := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "quack-values",
+			Namespace: "quack",
+		},
+		Data: map[string]string{
+			"ClusterName": "alpha",
+		},
+	}
+
+	ah := &AdmissionHook{
+		ValuesMapName:      "quack-values",
+		ValuesMapNamespace: "quack",
+		RequiredAnnotation: "quack.pusher.com/template",
+	}
+	resp, err := ah.Replay(review, values)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in Replay: %v", err)
+	}
+
+	assert.True(t, resp.Allowed, "Replayed request should be allowed")
+	assert.Equal(t, "4264aaf1-1a8e-11e8-a5e2-0a5e3b9fd3b4", string(resp.UID), "Response UID should match the recorded request")
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/data/cluster", "value": "alpha"},
+		{"op": "replace", "path": "/data/domain", "value": "alpha.example.com"}
+	]`, string(resp.Patch), "Patch should template the recorded object")
+}
+
+func TestReplayAdmissionV1(t *testing.T) {
+	values := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "quack-values",
+			Namespace: "quack",
+		},
+		Data: map[string]string{
+			"ClusterName": "alpha",
+		},
+	}
+
+	patches := map[string][]byte{}
+	for _, fixture := range []string{"review.json", "review-v1.json"} {
+		review, err := ioutil.ReadFile("testdata/replay/" + fixture)
+		if err != nil {
+			assert.FailNowf(t, "fileError", "Failed to read fixture: %v", err)
+		}
+
+		ah := &AdmissionHook{
+			ValuesMapName:      "quack-values",
+			ValuesMapNamespace: "quack",
+		}
+		resp, err := ah.Replay(review, values)
+		if err != nil {
+			assert.FailNowf(t, "methodError", "Error in Replay: %v", err)
+		}
+		assert.True(t, resp.Allowed, "Replayed request should be allowed")
+		assert.Equal(t, "4264aaf1-1a8e-11e8-a5e2-0a5e3b9fd3b4", string(resp.UID), "Response UID should match the recorded request")
+		assert.NotNil(t, resp.PatchType, "Patch type should be set, as required by v1")
+		patches[fixture] = resp.Patch
+	}
+	assert.JSONEq(t, string(patches["review.json"]), string(patches["review-v1.json"]), "v1 and v1beta1 reviews should produce the same patch")
+}
+
+func TestReplayInvalidReview(t *testing.T) {
+	ah := &AdmissionHook{}
+	_, err := ah.Replay([]byte(`{"kind": "AdmissionReview"}`))
+	assert.NotNil(t, err, "Review without a request should return an error")
+
+	_, err = ah.Replay([]byte(`{"kind": "AdmissionReview", "apiVersion": "admission.k8s.io/v2", "request": {}}`))
+	assert.NotNil(t, err, "Review of an unsupported version should return an error")
+
+	_, err = ah.Replay([]byte(`not json`))
+	assert.NotNil(t, err, "Invalid review should return an error")
+}
@@ -0,0 +1,65 @@
+package quack
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+)
+
+// admissionStats counts the outcomes of requests since startup.
+type admissionStats struct {
+	mutex     sync.Mutex
+	processed uint64
+	patched   uint64
+	skipped   uint64
+	errored   uint64
+}
+
+// record counts a request by its response.
+// Skipped requests, and failures allowed by the failure policy, are counted
+// separately by markSkipped and markErrored, as they can't be told apart from
+// requests templated without changes by their response.
+func (s *admissionStats) record(resp *admissionv1beta1.AdmissionResponse) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.processed++
+	switch decision(resp) {
+	case decisionPatched:
+		s.patched++
+	case decisionDenied:
+		s.errored++
+	}
+}
+
+func (s *admissionStats) markSkipped() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.skipped++
+}
+
+func (s *admissionStats) markErrored() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.errored++
+}
+
+// summary describes the counts, to be logged at shutdown.
+func (s *admissionStats) summary() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return fmt.Sprintf("Processed %d admissions: %d patched, %d skipped, %d errored", s.processed, s.patched, s.skipped, s.errored)
+}
+
+// LogSummary logs the summary of requests processed since startup, to be
+// called once the admission server has stopped.
+// Nothing is logged unless the webhook was initialized, e.g. when a
+// subcommand was run instead of the server.
+func (ah *AdmissionHook) LogSummary() {
+	if atomic.LoadInt32(&ah.initialized) == 0 {
+		return
+	}
+	glog.Info(ah.stats.summary())
+}
@@ -0,0 +1,38 @@
+package quack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestAdmissionStatsSummary(t *testing.T) {
+	stats := &admissionStats{
+		processed: 10,
+		patched:   4,
+		skipped:   3,
+		errored:   2,
+	}
+	assert.Equal(t, "Processed 10 admissions: 4 patched, 3 skipped, 2 errored", stats.summary(), "Summary should include each count")
+}
+
+func TestAdmitRecordsStats(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+
+	for _, req := range []*admissionv1beta1.AdmissionRequest{
+		{Operation: admissionv1beta1.Create, Object: runtime.RawExtension{Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A }}"}`)}},
+		{Operation: admissionv1beta1.Create, Object: runtime.RawExtension{Raw: []byte(`{"metadata": {"name": "foo"}, "a": "alpha"}`)}},
+		{Operation: admissionv1beta1.Create, Object: runtime.RawExtension{Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A "}`)}},
+		{Operation: admissionv1beta1.Delete},
+	} {
+		ah.Admit(req)
+	}
+	assert.Equal(t, "Processed 4 admissions: 1 patched, 1 skipped, 1 errored", ah.stats.summary(), "Each request should be counted by its outcome")
+
+	ah.FailurePolicy = failurePolicyIgnore
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{Operation: admissionv1beta1.Create, Object: runtime.RawExtension{Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .A "}`)}})
+	assert.True(t, resp.Allowed, "Failure should be ignored")
+	assert.Equal(t, "Processed 5 admissions: 1 patched, 1 skipped, 2 errored", ah.stats.summary(), "Failures ignored by the failure policy should be counted as errored")
+}
@@ -0,0 +1,139 @@
+package quack
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"sort"
+	texttemplate "text/template"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Results of looking up templates in the templateCache, used to label
+// templateCacheLookups.
+const (
+	cacheResultHit  = "hit"
+	cacheResultMiss = "miss"
+)
+
+// templateCacheLookups counts lookups of parsed templates by whether they were
+// cached.
+var templateCacheLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "quack_template_cache_lookups_total",
+		Help: "Number of templates looked up in the template cache, by whether they were cached (hit) or parsed (miss).",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(templateCacheLookups)
+	registry.MustRegister(templateCacheLookups)
+}
+
+// templateCache holds the templates most recently parsed by renderTemplate,
+// so objects admitted repeatedly with the same content aren't parsed again.
+// Cached templates are never executed; each render executes a clone, bound to
+// the functions of its request.
+type templateCache struct {
+	templates *lru.Cache
+}
+
+// newTemplateCache creates a cache of at most size templates, evicting the
+// least recently used.
+func newTemplateCache(size int) (*templateCache, error) {
+	templates, err := lru.New(size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create template cache: %v", err)
+	}
+	return &templateCache{templates: templates}, nil
+}
+
+// parse parses the input and partials as parseHTMLTemplate or
+// parseTextTemplate would, reusing the template parsed for identical input and
+// options if cached.
+// A nil cache parses every template.
+func (c *templateCache) parse(input []byte, opts templateOptions, funcs template.FuncMap) (executor, error) {
+	if c == nil {
+		return parseTemplate(input, opts, funcs)
+	}
+
+	key := templateCacheKey(input, opts, funcs)
+	cached, ok := c.templates.Get(key)
+	if ok {
+		templateCacheLookups.WithLabelValues(cacheResultHit).Inc()
+	} else {
+		templateCacheLookups.WithLabelValues(cacheResultMiss).Inc()
+		parsed, err := parseTemplate(input, opts, funcs)
+		if err != nil {
+			return nil, err
+		}
+		c.templates.Add(key, parsed)
+		cached = parsed
+	}
+
+	switch tmpl := cached.(type) {
+	case *template.Template:
+		// html/template escapes templates when first executed, so only
+		// clones, which copy the parse trees, may be executed
+		clone, err := tmpl.Clone()
+		if err != nil {
+			return nil, fmt.Errorf("failed to clone cached template: %v", err)
+		}
+		return clone.Funcs(funcs), nil
+	case *texttemplate.Template:
+		clone, err := tmpl.Clone()
+		if err != nil {
+			return nil, fmt.Errorf("failed to clone cached template: %v", err)
+		}
+		return clone.Funcs(texttemplate.FuncMap(funcs)), nil
+	default:
+		return nil, fmt.Errorf("unexpected cached template %T", cached)
+	}
+}
+
+// parseTemplate parses the input and partials with the engine of the options.
+func parseTemplate(input []byte, opts templateOptions, funcs template.FuncMap) (executor, error) {
+	switch opts.engine {
+	case engineHTML:
+		return parseHTMLTemplate(input, opts, funcs)
+	default:
+		return parseTextTemplate(input, opts, texttemplate.FuncMap(funcs))
+	}
+}
+
+// templateCacheKey hashes everything parsing depends on: the input, partials,
+// parsing options and the names of the functions, which must be defined for
+// the input to parse.
+// The functions themselves are only called when executed, so are replaced in
+// each clone of the cached template.
+func templateCacheKey(input []byte, opts templateOptions, funcs template.FuncMap) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%q %q %q %t %t %d\n", opts.engine, opts.delims.left, opts.delims.right, opts.delims.trim, opts.missingKeyError, opts.maxDepth)
+
+	names := []string{}
+	for name := range opts.partials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(hash, "partial %q %q\n", name, opts.partials[name])
+	}
+
+	names = []string{}
+	for name := range funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// Written directly, as Sprig adds over a hundred functions to hash
+	for _, name := range names {
+		hash.Write([]byte(name))
+		hash.Write([]byte{0})
+	}
+
+	hash.Write(input)
+	return hex.EncodeToString(hash.Sum(nil))
+}
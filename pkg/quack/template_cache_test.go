@@ -0,0 +1,101 @@
+package quack
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func cacheLookups(t *testing.T, result string) float64 {
+	metric := &dto.Metric{}
+	err := templateCacheLookups.WithLabelValues(result).Write(metric)
+	if err != nil {
+		assert.FailNowf(t, "metricError", "Failed to read metric: %v", err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestRenderTemplateCached(t *testing.T) {
+	cache, err := newTemplateCache(2)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in newTemplateCache: %v", err)
+	}
+	input := []byte(`{"a": "{{ .A }}", "b": "{{ toJson .B }}", "c": "{{ upper .A }}"}`)
+
+	for _, engine := range []string{engineText, engineHTML} {
+		hits, misses := cacheLookups(t, cacheResultHit), cacheLookups(t, cacheResultMiss)
+		opts := templateOptions{engine: engine, funcs: templateFuncs(true), cache: cache}
+
+		output, err := renderTemplate(input, map[string]interface{}{"A": "alpha", "B": 1}, opts)
+		if err != nil {
+			assert.FailNowf(t, "methodError", "Error in renderTemplate: %v", err)
+		}
+		assert.Equal(t, `{"a": "alpha", "b": 1, "c": "ALPHA"}`, string(output), "Template should render with %s", engine)
+		assert.Equal(t, misses+1, cacheLookups(t, cacheResultMiss), "First render should parse the template with %s", engine)
+
+		output, err = renderTemplate(input, map[string]interface{}{"A": "beta", "B": 2}, opts)
+		if err != nil {
+			assert.FailNowf(t, "methodError", "Error in renderTemplate: %v", err)
+		}
+		assert.Equal(t, `{"a": "beta", "b": 2, "c": "BETA"}`, string(output), "Cached template should render new data with %s", engine)
+		assert.Equal(t, hits+1, cacheLookups(t, cacheResultHit), "Identical input should reuse the cached template with %s", engine)
+
+		opts.delims = delimiters{left: "[[", right: "]]"}
+		output, err = renderTemplate(input, map[string]interface{}{"A": "alpha"}, opts)
+		if err != nil {
+			assert.FailNowf(t, "methodError", "Error in renderTemplate: %v", err)
+		}
+		assert.Equal(t, string(input), string(output), "Template should not be reused with other delimiters with %s", engine)
+		assert.Equal(t, misses+2, cacheLookups(t, cacheResultMiss), "Other delimiters should parse the template with %s", engine)
+	}
+}
+
+func TestRenderTemplateCachedFuncs(t *testing.T) {
+	cache, err := newTemplateCache(1)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in newTemplateCache: %v", err)
+	}
+	input := []byte(`{"group": "{{ hasGroup "team-a" }}"}`)
+
+	for groups, expected := range map[string]string{"team-a": "true", "team-b": "false"} {
+		funcs := templateFuncs(false)
+		funcs["hasGroup"] = hasGroupFunc([]string{groups})
+		output, err := renderTemplate(input, nil, templateOptions{funcs: funcs, cache: cache})
+		if err != nil {
+			assert.FailNowf(t, "methodError", "Error in renderTemplate: %v", err)
+		}
+		assert.Equal(t, `{"group": "`+expected+`"}`, string(output), "Cached template should call the functions of each render")
+	}
+}
+
+func BenchmarkRenderTemplate(b *testing.B) {
+	// Templates of objects are typically larger than the functions available
+	// to them, which are bound to every render, cached or not
+	container := `{"name": "{{ .Name }}-%d", "image": "{{ .Registry }}/{{ .Image }}:{{ .Tag }}", "env": [{"name": "TEAM", "value": "{{ .Team | lower }}"}]}`
+	containers := []string{}
+	for i := 0; i < 20; i++ {
+		containers = append(containers, fmt.Sprintf(container, i))
+	}
+	input := []byte(`{"metadata": {"name": "{{ .Name }}"}, "spec": {"replicas": {{ .Replicas }}, "containers": [` + strings.Join(containers, ", ") + `]}}`)
+	data := map[string]interface{}{"Name": "foo", "Team": "Ducks", "Replicas": 3, "Registry": "quay.io", "Image": "quack", "Tag": "v1"}
+	cache, err := newTemplateCache(10)
+	if err != nil {
+		b.Fatalf("Error in newTemplateCache: %v", err)
+	}
+
+	for name, cache := range map[string]*templateCache{"Uncached": nil, "Cached": cache} {
+		b.Run(name, func(b *testing.B) {
+			opts := templateOptions{funcs: templateFuncs(true), cache: cache}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := renderTemplate(input, data, opts)
+				if err != nil {
+					b.Fatalf("Error in renderTemplate: %v", err)
+				}
+			}
+		})
+	}
+}
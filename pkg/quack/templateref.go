@@ -0,0 +1,60 @@
+package quack
+
+import (
+	"fmt"
+
+	mergepatch "github.com/evanphx/json-patch"
+	"github.com/ghodss/yaml"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+const templateRefAnnotation = "quack.pusher.com/template-ref"
+
+// mergeTemplateRef renders the template held in the values key named by the
+// object's template-ref annotation, and merges it onto the rendered object of
+// the kind, so objects can share templates from a library.
+// The template may be written as YAML or JSON.
+func mergeTemplateRef(log requestLogger, output []byte, ref string, kind metav1.GroupVersionKind, values map[string]string, data interface{}, opts templateOptions) ([]byte, error) {
+	refTemplate, ok := values[ref]
+	if !ok {
+		return nil, fmt.Errorf("no value for %s", ref)
+	}
+
+	rendered, err := renderTemplate([]byte(refTemplate), data, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error rendering %s: %v", ref, err)
+	}
+	refJSON, err := yaml.YAMLToJSON(rendered)
+	if err != nil {
+		return nil, fmt.Errorf("rendered %s is not valid YAML: %v", ref, err)
+	}
+	err = validateOutput(log, refJSON)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", ref, err)
+	}
+
+	merged, err := mergeObject(output, refJSON, kind)
+	if err != nil {
+		return nil, fmt.Errorf("error merging %s: %v", ref, err)
+	}
+	return merged, nil
+}
+
+// mergeObject merges the patch onto the object as a strategic merge patch, so
+// lists such as containers are merged by their keys, as kubectl apply would.
+// Kinds the client doesn't know, such as custom resources, have no patch
+// strategy, so are merged as a JSON Merge Patch, replacing lists whole.
+func mergeObject(object []byte, patch []byte, kind metav1.GroupVersionKind) ([]byte, error) {
+	dataStruct, err := scheme.Scheme.New(schema.GroupVersionKind{Group: kind.Group, Version: kind.Version, Kind: kind.Kind})
+	if runtime.IsNotRegisteredError(err) {
+		return mergepatch.MergePatch(object, patch)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strategicpatch.StrategicMergePatch(object, patch, dataStruct)
+}
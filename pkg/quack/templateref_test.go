@@ -0,0 +1,79 @@
+package quack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestMergeTemplateRef(t *testing.T) {
+	values := map[string]string{
+		"yaml-template": "spec:\n  replicas: {{ .Replicas }}\n  paused: null\n",
+		"json-template": `{"spec": {"replicas": {{ .Replicas }}}}`,
+		"list-template": "- a\n- b\n",
+	}
+	output := []byte(`{"spec": {"replicas": 1, "paused": true, "selector": {"app": "foo"}}}`)
+	data := map[string]string{"Replicas": "3"}
+
+	merged, err := mergeTemplateRef(requestLogger{}, output, "yaml-template", metav1.GroupVersionKind{}, values, data, templateOptions{})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in mergeTemplateRef: %v", err)
+	}
+	assert.JSONEq(t, `{"spec": {"replicas": 3, "selector": {"app": "foo"}}}`, string(merged), "YAML template should be merged onto the object")
+
+	merged, err = mergeTemplateRef(requestLogger{}, output, "json-template", metav1.GroupVersionKind{}, values, data, templateOptions{})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in mergeTemplateRef: %v", err)
+	}
+	assert.JSONEq(t, `{"spec": {"replicas": 3, "paused": true, "selector": {"app": "foo"}}}`, string(merged), "JSON template should be merged onto the object")
+
+	_, err = mergeTemplateRef(requestLogger{}, output, "missing-template", metav1.GroupVersionKind{}, values, data, templateOptions{})
+	assert.NotNil(t, err, "Missing template should return an error")
+
+	_, err = mergeTemplateRef(requestLogger{}, output, "list-template", metav1.GroupVersionKind{}, values, data, templateOptions{})
+	assert.NotNil(t, err, "Template that isn't an object should return an error")
+}
+
+func TestMergeTemplateRefLists(t *testing.T) {
+	values := map[string]string{
+		"sidecar-template": "spec:\n  containers:\n  - name: proxy\n    image: proxy:{{ .Tag }}\n",
+	}
+	output := []byte(`{"spec": {"containers": [{"name": "app", "image": "app:1"}, {"name": "proxy", "image": "proxy:1"}]}}`)
+	data := map[string]string{"Tag": "2"}
+
+	merged, err := mergeTemplateRef(requestLogger{}, output, "sidecar-template", metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}, values, data, templateOptions{})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in mergeTemplateRef: %v", err)
+	}
+	assert.JSONEq(t, `{"spec": {"containers": [{"name": "app", "image": "app:1"}, {"name": "proxy", "image": "proxy:2"}]}}`, string(merged), "Lists of built in kinds should be merged by their keys")
+
+	merged, err = mergeTemplateRef(requestLogger{}, output, "sidecar-template", metav1.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}, values, data, templateOptions{})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in mergeTemplateRef: %v", err)
+	}
+	assert.JSONEq(t, `{"spec": {"containers": [{"name": "proxy", "image": "proxy:2"}]}}`, string(merged), "Lists of other kinds should be replaced")
+}
+
+func TestAdmitTemplateRef(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{
+		"App":                 "foo",
+		"Replicas":            "3",
+		"deployment-template": "spec:\n  replicas: {{ .Replicas }}\n  template:\n    metadata:\n      labels:\n        app: \"{{ .App }}\"\n",
+	})
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/template-ref": "deployment-template"}}, "spec": {"replicas": 1}}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/spec/replicas", "value": 3},
+		{"op": "add", "path": "/spec/template", "value": {"metadata": {"labels": {"app": "foo"}}}}
+	]`, string(resp.Patch), "Referenced template should be rendered and merged onto the object")
+}
@@ -0,0 +1,52 @@
+package quack
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+)
+
+// executeTemplate executes the template against data, failing if execution
+// takes longer than the timeout, if set.
+// Templates can't be interrupted, so on timeout execution continues in the
+// background until its next write, which fails, or the function it is blocked
+// in returns.
+func executeTemplate(tmpl executor, data interface{}, timeout time.Duration) ([]byte, error) {
+	if timeout <= 0 {
+		buff := new(bytes.Buffer)
+		err := tmpl.Execute(buff, data)
+		return buff.Bytes(), err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	writer := &contextWriter{ctx: ctx}
+	// Buffered so the goroutine can exit once we've stopped waiting for it
+	done := make(chan error, 1)
+	go func() {
+		done <- tmpl.Execute(writer, data)
+	}()
+
+	select {
+	case err := <-done:
+		return writer.buff.Bytes(), err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
+// contextWriter buffers writes until its context is done, after which writes
+// fail.
+type contextWriter struct {
+	ctx  context.Context
+	buff bytes.Buffer
+}
+
+func (w *contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.buff.Write(p)
+}
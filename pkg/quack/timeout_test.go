@@ -0,0 +1,46 @@
+package quack
+
+import (
+	"context"
+	"html/template"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderTemplateTimeout(t *testing.T) {
+	funcs := template.FuncMap{
+		"slow": func() string {
+			time.Sleep(10 * time.Millisecond)
+			return "x"
+		},
+	}
+	items := make([]int, 1000)
+	input := []byte(`{"a": "{{ range .Items }}{{ slow }}{{ end }}"}`)
+
+	start := time.Now()
+	_, err := renderTemplate(input, map[string]interface{}{"Items": items}, templateOptions{funcs: funcs, timeout: 50 * time.Millisecond})
+	if assert.NotNil(t, err, "Template exceeding the timeout should return an error") {
+		assert.Contains(t, err.Error(), "timed out after 50ms", "Error should report the timeout")
+	}
+	assert.True(t, time.Since(start) < time.Second, "Rendering should stop waiting at the timeout")
+
+	output, err := renderTemplate(input, map[string]interface{}{"Items": items[:2]}, templateOptions{funcs: funcs, timeout: time.Second})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in renderTemplate: %v", err)
+	}
+	assert.Equal(t, `{"a": "xx"}`, string(output), "Template within the timeout should render")
+}
+
+func TestContextWriter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := &contextWriter{ctx: ctx}
+
+	_, err := writer.Write([]byte("a"))
+	assert.Nil(t, err, "Write before the context is done should succeed")
+	cancel()
+	_, err = writer.Write([]byte("b"))
+	assert.NotNil(t, err, "Write after the context is done should fail, stopping execution")
+	assert.Equal(t, "a", writer.buff.String(), "Only writes before the context is done should be buffered")
+}
@@ -0,0 +1,49 @@
+package quack
+
+import (
+	"bytes"
+	"text/template/parse"
+)
+
+// spaceChars are the characters trimmed by trim markers.
+const spaceChars = " \t\r\n"
+
+// trimActions trims whitespace from text adjacent to every action in the
+// tree, as if each action were written with trim markers, e.g. `{{- .A -}}`.
+func trimActions(tree *parse.Tree) {
+	if tree == nil {
+		return
+	}
+	trimList(tree.Root, false)
+}
+
+// trimList trims the text nodes of the list adjacent to actions.
+// Lists within actions, such as the body of an if, are bounded by actions, so
+// text at either end of them is trimmed. The root list is bounded by the start
+// and end of the template, so is not.
+func trimList(list *parse.ListNode, bounded bool) {
+	if list == nil {
+		return
+	}
+
+	for i, node := range list.Nodes {
+		switch n := node.(type) {
+		case *parse.TextNode:
+			if i > 0 || bounded {
+				n.Text = bytes.TrimLeft(n.Text, spaceChars)
+			}
+			if i < len(list.Nodes)-1 || bounded {
+				n.Text = bytes.TrimRight(n.Text, spaceChars)
+			}
+		case *parse.IfNode:
+			trimList(n.List, true)
+			trimList(n.ElseList, true)
+		case *parse.RangeNode:
+			trimList(n.List, true)
+			trimList(n.ElseList, true)
+		case *parse.WithNode:
+			trimList(n.List, true)
+			trimList(n.ElseList, true)
+		}
+	}
+}
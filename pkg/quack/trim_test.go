@@ -0,0 +1,58 @@
+package quack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestRenderTemplateTrim(t *testing.T) {
+	input := []byte("{\"a\": \"  [[ .A ]]  \", \"b\": \"\n  [[ if .A ]]\n    yes\n  [[ else ]]\n    no\n  [[ end ]]\n\", \"c\": \"[[ range .Items ]] [[ . ]] , [[ end ]]\"}")
+	data := map[string]interface{}{"A": "alpha", "Items": []string{"x", "y"}}
+
+	for _, engine := range []string{engineText, engineHTML} {
+		output, err := renderTemplate(input, data, templateOptions{engine: engine, delims: delimPresets["square-trim"]})
+		if err != nil {
+			assert.FailNowf(t, "methodError", "Error in renderTemplate: %v", err)
+		}
+		assert.Equal(t, `{"a": "alpha", "b": "yes", "c": "x,y,"}`, string(output), "Whitespace around actions should be trimmed with %s", engine)
+
+		output, err = renderTemplate(input, data, templateOptions{engine: engine, delims: delimPresets["square"]})
+		if err != nil {
+			assert.FailNowf(t, "methodError", "Error in renderTemplate: %v", err)
+		}
+		assert.Equal(t, "{\"a\": \"  alpha  \", \"b\": \"\n  \n    yes\n  \n\", \"c\": \" x ,  y , \"}", string(output), "Whitespace should be kept without trimming with %s", engine)
+	}
+}
+
+func TestGetDelimsPreset(t *testing.T) {
+	delims, err := getDelims(requestLogger{}, []byte(`{"metadata": {"annotations": {"quack.pusher.com/delim-preset": "curly-trim"}}}`), defaultAnnotationDomain, nil)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in getDelims: %v", err)
+	}
+	assert.Equal(t, delimiters{left: "{{", right: "}}", trim: true}, delims, "Preset should set delimiters and trimming")
+
+	_, err = getDelims(requestLogger{}, []byte(`{"metadata": {"annotations": {"quack.pusher.com/delim-preset": "round"}}}`), defaultAnnotationDomain, nil)
+	assert.NotNil(t, err, "Unknown preset should return an error")
+
+	_, err = getDelims(requestLogger{}, []byte(`{"metadata": {"annotations": {"quack.pusher.com/delim-preset": "square", "quack.pusher.com/left-delim": "<<", "quack.pusher.com/right-delim": ">>"}}}`), defaultAnnotationDomain, nil)
+	assert.NotNil(t, err, "Preset with delimiter annotations should return an error")
+}
+
+func TestAdmitDelimPreset(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"quack.pusher.com/delim-preset": "curly-trim"}}, "a": " {{ .A }} "}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/a", "value": "alpha"}
+	]`, string(resp.Patch), "Object selecting a trim preset should be rendered trimmed")
+}
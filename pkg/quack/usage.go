@@ -0,0 +1,67 @@
+package quack
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// valueReferences counts the objects referencing each value, so unused values
+// can be found and pruned.
+var valueReferences = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "quack_value_references_total",
+		Help: "Number of objects templated which referenced a value, by key, or other for values missing from the Values ConfigMap. Keys of the Values ConfigMap are reported from zero, so unused values can be found.",
+	},
+	[]string{"key"},
+)
+
+func init() {
+	prometheus.MustRegister(valueReferences)
+	registry.MustRegister(valueReferences)
+}
+
+// countValueReferences counts the values referenced by the input, labelling
+// only those of the global Values ConfigMap by key.
+func (ah *AdmissionHook) countValueReferences(input []byte, opts templateOptions, values map[string]string) error {
+	globalValues := map[string]string{}
+	if ah.ValuesMapName != "" {
+		mapValues, _, err := ah.getMapValues()
+		if err != nil {
+			return err
+		}
+		globalValues = mapValues
+	}
+	return countValueReferences(input, opts, values, globalValues)
+}
+
+// otherValuesKey labels references to values that aren't in the global
+// Values ConfigMap.
+const otherValuesKey = "other"
+
+// countValueReferences counts a reference to each of the values referenced by
+// the input or its partials.
+// Every value is counted from zero so values never referenced are reported.
+// Only keys of the global values are counted by key, as other values come
+// from ConfigMaps tenants control, so would allow any number of series.
+// References to any other values are counted once under otherValuesKey.
+func countValueReferences(input []byte, opts templateOptions, values map[string]string, globalValues map[string]string) error {
+	referenced, err := templateKeys(input, opts)
+	if err != nil {
+		return err
+	}
+	other := valueReferences.WithLabelValues(otherValuesKey)
+	referencedOther := false
+	for key := range values {
+		if _, ok := globalValues[key]; !ok {
+			referencedOther = referencedOther || referenced[key]
+			continue
+		}
+		counter := valueReferences.WithLabelValues(key)
+		if referenced[key] {
+			counter.Inc()
+		}
+	}
+	if referencedOther {
+		other.Inc()
+	}
+	return nil
+}
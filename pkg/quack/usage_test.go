@@ -0,0 +1,103 @@
+package quack
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func referencesCount(t *testing.T, key string) float64 {
+	metric := &dto.Metric{}
+	err := valueReferences.WithLabelValues(key).Write(metric)
+	if err != nil {
+		assert.FailNowf(t, "metricError", "Failed to read metric: %v", err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+// reportedKeys returns the keys with a quack_value_references_total series.
+func reportedKeys(t *testing.T) []string {
+	families, err := registry.Gather()
+	if err != nil {
+		assert.FailNowf(t, "metricError", "Failed to gather metrics: %v", err)
+	}
+	keys := []string{}
+	for _, family := range families {
+		if family.GetName() != "quack_value_references_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				keys = append(keys, label.GetValue())
+			}
+		}
+	}
+	return keys
+}
+
+func TestAdmitTrackValueUsage(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"UsageUsed": "alpha", "UsageUnused": "beta"})
+	ah.TrackValueUsage = true
+	usedBefore := referencesCount(t, "UsageUsed")
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .UsageUsed }}{{ .UsageUsed }}", "b": "{{ .UsageMissing }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+
+	assert.Equal(t, usedBefore+1, referencesCount(t, "UsageUsed"), "Referenced value should be counted once per object")
+	keys := reportedKeys(t)
+	assert.Contains(t, keys, "UsageUnused", "Unreferenced values should be reported")
+	assert.NotContains(t, keys, "UsageMissing", "Keys missing from the values should not be reported")
+}
+
+func TestCountValueReferencesPartials(t *testing.T) {
+	before := referencesCount(t, "UsageInPartial")
+	err := countValueReferences([]byte(`{"a": "{{ template "partial" . }}"}`), templateOptions{
+		partials: map[string]string{"partial": "{{ $.UsageInPartial }}"},
+	}, map[string]string{"UsageInPartial": "alpha"}, map[string]string{"UsageInPartial": "alpha"})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in countValueReferences: %v", err)
+	}
+	assert.Equal(t, before+1, referencesCount(t, "UsageInPartial"), "Values referenced by partials should be counted")
+}
+
+func TestAdmitTrackValueUsageNamespaceValues(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{})
+	ah.client = fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "quack-values", Namespace: "quack"},
+			Data:       map[string]string{"UsageGlobal": "alpha"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "quack-values", Namespace: "team-a"},
+			Data:       map[string]string{"UsageTenant": "beta"},
+		},
+	)
+	ah.NamespaceValues = true
+	ah.TrackValueUsage = true
+	otherBefore := referencesCount(t, otherValuesKey)
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		Namespace: "team-a",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo"}, "a": "{{ .UsageGlobal }}", "b": "{{ .UsageTenant }}"}`),
+		},
+	})
+	assert.True(t, resp.Allowed, "Request should be allowed")
+
+	assert.Equal(t, otherBefore+1, referencesCount(t, otherValuesKey), "Values missing from the global values should be counted as other")
+	keys := reportedKeys(t)
+	assert.Contains(t, keys, "UsageGlobal", "Global values should be reported by key")
+	assert.NotContains(t, keys, "UsageTenant", "Values missing from the global values should not be reported by key")
+}
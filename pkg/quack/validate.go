@@ -0,0 +1,163 @@
+package quack
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// outputSnippetLength is the number of bytes either side of a syntax error
+// logged for malformed output.
+const outputSnippetLength = 40
+
+// validateOutput checks the rendered output is still a JSON object, so
+// templates which break the JSON structure are reported clearly rather than
+// by an opaque error, or a nonsensical patch, from the patch library.
+// The output may contain secret values, so is left out of the error, and only
+// logged at high verbosity.
+func validateOutput(log requestLogger, output []byte) error {
+	var doc interface{}
+	err := json.Unmarshal(output, &doc)
+	if err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			log.Infof(6, "Malformed rendered output at offset %d: %s", syntaxErr.Offset, outputSnippet(output, int(syntaxErr.Offset)))
+			return fmt.Errorf("rendered output is not valid JSON: %v at offset %d", err, syntaxErr.Offset)
+		}
+		log.Infof(6, "Malformed rendered output: %s", outputSnippet(output, len(output)))
+		return fmt.Errorf("rendered output is not valid JSON: %v", err)
+	}
+	if _, ok := doc.(map[string]interface{}); !ok {
+		log.Infof(6, "Rendered output is not an object: %s", outputSnippet(output, 0))
+		return fmt.Errorf("rendered output is not a JSON object")
+	}
+	return nil
+}
+
+// outputSnippet returns the output surrounding the offset, quoted, for
+// logging.
+func outputSnippet(output []byte, offset int) string {
+	start := offset - outputSnippetLength
+	if start < 0 {
+		start = 0
+	}
+	end := offset + outputSnippetLength
+	if end > len(output) {
+		end = len(output)
+	}
+	snippet := strconv.Quote(string(output[start:end]))
+	if start > 0 {
+		snippet = "..." + snippet
+	}
+	if end < len(output) {
+		snippet = snippet + "..."
+	}
+	return snippet
+}
+
+// validateFields checks the fields listed in the object's
+// quantityFieldsAnnotation and durationFieldsAnnotation, in the annotation
+// domain, parse as quantities and durations once rendered.
+// Fields are given as comma separated JSON Pointers.
+func validateFields(objectMeta metav1.ObjectMeta, domain string, output []byte) error {
+	quantityFields := splitFields(objectMeta.Annotations[domainAnnotation(quantityFieldsAnnotation, domain)])
+	durationFields := splitFields(objectMeta.Annotations[domainAnnotation(durationFieldsAnnotation, domain)])
+	if len(quantityFields) == 0 && len(durationFields) == 0 {
+		return nil
+	}
+
+	var doc interface{}
+	err := json.Unmarshal(output, &doc)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal output: %v", err)
+	}
+
+	for _, field := range quantityFields {
+		value, err := fieldValue(doc, field)
+		if err != nil {
+			return err
+		}
+		_, err = resource.ParseQuantity(value)
+		if err != nil {
+			return fmt.Errorf("field %s is not a valid quantity: %q", field, value)
+		}
+	}
+
+	for _, field := range durationFields {
+		value, err := fieldValue(doc, field)
+		if err != nil {
+			return err
+		}
+		_, err = time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("field %s is not a valid duration: %q", field, value)
+		}
+	}
+	return nil
+}
+
+func splitFields(fields string) []string {
+	split := []string{}
+	for _, field := range strings.Split(fields, ",") {
+		field = strings.TrimSpace(field)
+		if field != "" {
+			split = append(split, field)
+		}
+	}
+	return split
+}
+
+// fieldValue returns the value at a JSON Pointer in the document as a string.
+func fieldValue(doc interface{}, pointer string) (string, error) {
+	if !strings.HasPrefix(pointer, "/") {
+		return "", fmt.Errorf("field %s must be a JSON Pointer", pointer)
+	}
+
+	current, ok := pointerValue(doc, pointer)
+	if !ok {
+		return "", fmt.Errorf("field %s not found", pointer)
+	}
+
+	switch value := current.(type) {
+	case string:
+		return value, nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("field %s is not a string or number", pointer)
+	}
+}
+
+// pointerValue returns the value at a JSON Pointer in the document, and whether
+// it was found.
+func pointerValue(doc interface{}, pointer string) (interface{}, bool) {
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, false
+	}
+
+	current := doc
+	for _, token := range strings.Split(pointer[1:], "/") {
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			current = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
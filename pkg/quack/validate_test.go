@@ -0,0 +1,97 @@
+package quack
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestValidateOutput(t *testing.T) {
+	assert.Nil(t, validateOutput(requestLogger{}, []byte(`{"metadata": {"name": "foo"}}`)), "Valid object should not return an error")
+
+	err := validateOutput(requestLogger{}, []byte(`{"metadata": {"name": "foo", "annotations": {"a": "say "hi""}}}`))
+	if assert.NotNil(t, err, "Invalid JSON should return an error") {
+		assert.Contains(t, err.Error(), "rendered output is not valid JSON", "Error should describe the output")
+		assert.Contains(t, err.Error(), "at offset", "Error should locate the syntax error")
+		assert.NotContains(t, err.Error(), "say", "Error should not include the output, which may contain secrets")
+	}
+
+	err = validateOutput(requestLogger{}, []byte(`{"metadata": {"name": "foo"}`))
+	assert.NotNil(t, err, "Truncated JSON should return an error")
+
+	err = validateOutput(requestLogger{}, []byte(`["foo"]`))
+	if assert.NotNil(t, err, "Non-object JSON should return an error") {
+		assert.Contains(t, err.Error(), "not a JSON object", "Error should describe the output")
+	}
+}
+
+func TestAdmitInvalidOutput(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"Greeting": `say "hi"`})
+
+	resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+		UID:       "create-uid",
+		Operation: admissionv1beta1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{"metadata": {"name": "foo", "annotations": {"greeting": "{{ .Greeting }}"}}}`),
+		},
+	})
+	assert.False(t, resp.Allowed, "Invalid rendered output should not be allowed")
+	if assert.NotNil(t, resp.Result, "Response should include a result") {
+		assert.Contains(t, resp.Result.Message, "Invalid rendered object: rendered output is not valid JSON", "Message should describe the error")
+		assert.NotContains(t, resp.Result.Message, "say", "Message should not include the rendered values")
+	}
+}
+
+func TestValidateFields(t *testing.T) {
+	objectMeta := metav1.ObjectMeta{
+		Annotations: map[string]string{
+			quantityFieldsAnnotation: "/spec/containers/0/resources/limits/memory, /spec/containers/0/resources/limits/cpu",
+			durationFieldsAnnotation: "/spec/timeout",
+		},
+	}
+
+	valid := []byte(`{"spec": {"timeout": "30s", "containers": [{"resources": {"limits": {"memory": "100Mi", "cpu": 1}}}]}}`)
+	assert.Nil(t, validateFields(objectMeta, defaultAnnotationDomain, valid), "Valid fields should not return an error")
+
+	invalidQuantity := []byte(`{"spec": {"timeout": "30s", "containers": [{"resources": {"limits": {"memory": "100MB", "cpu": 1}}}]}}`)
+	err := validateFields(objectMeta, defaultAnnotationDomain, invalidQuantity)
+	if assert.NotNil(t, err, "Invalid quantity should return an error") {
+		assert.Contains(t, err.Error(), "/spec/containers/0/resources/limits/memory", "Error should name the field")
+	}
+
+	invalidDuration := []byte(`{"spec": {"timeout": "30 seconds", "containers": [{"resources": {"limits": {"memory": "100Mi", "cpu": 1}}}]}}`)
+	assert.NotNil(t, validateFields(objectMeta, defaultAnnotationDomain, invalidDuration), "Invalid duration should return an error")
+
+	missing := []byte(`{"spec": {"timeout": "30s", "containers": []}}`)
+	assert.NotNil(t, validateFields(objectMeta, defaultAnnotationDomain, missing), "Missing field should return an error")
+
+	assert.Nil(t, validateFields(metav1.ObjectMeta{}, defaultAnnotationDomain, invalidQuantity), "Fields should not be validated without annotations")
+}
+
+func TestAdmitValidateFields(t *testing.T) {
+	for memory, allowed := range map[string]bool{"100Mi": true, "100MB": false} {
+		ah := newTestAdmissionHook(map[string]string{"Memory": memory})
+
+		resp := ah.Admit(&admissionv1beta1.AdmissionRequest{
+			UID:       "create-uid",
+			Operation: admissionv1beta1.Create,
+			Object: runtime.RawExtension{
+				Raw: []byte(`{
+					"metadata": {"name": "foo", "annotations": {"quack.pusher.com/quantity-fields": "/spec/containers/0/resources/limits/memory"}},
+					"spec": {"containers": [{"name": "app", "resources": {"limits": {"memory": "{{ .Memory }}"}}}]}
+				}`),
+			},
+		})
+		assert.Equal(t, allowed, resp.Allowed, "Rendering memory %s should be allowed: %v", memory, allowed)
+	}
+}
+
+func TestOutputSnippet(t *testing.T) {
+	output := []byte(strings.Repeat("a", 50) + "|" + strings.Repeat("b", 50))
+	assert.Equal(t, `..."`+strings.Repeat("a", 40)+"|"+strings.Repeat("b", 39)+`"...`, outputSnippet(output, 50), "Snippet should surround the offset")
+	assert.Equal(t, `"{}"`, outputSnippet([]byte("{}"), 0), "Short output should be included whole")
+}
@@ -0,0 +1,174 @@
+package quack
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const valuesResyncPeriod = 10 * time.Minute
+
+// valuesCache watches the Values ConfigMap in each of the values namespaces,
+// so values can be read without a request to the API server.
+type valuesCache struct {
+	name       string
+	namespaces []string
+	stores     map[string]cache.Store
+	synced     []cache.InformerSynced
+}
+
+// newValuesCache creates a cache of the named ConfigMap in each namespace.
+// The cache is empty until started with run.
+func newValuesCache(client kubernetes.Interface, namespaces []string, name string) (*valuesCache, []cache.SharedIndexInformer) {
+	vc := &valuesCache{
+		name:       name,
+		namespaces: namespaces,
+		stores:     make(map[string]cache.Store, len(namespaces)),
+	}
+
+	informers := []cache.SharedIndexInformer{}
+	for _, namespace := range namespaces {
+		informer := newValuesInformer(client, namespace, name)
+		vc.stores[namespace] = informer.GetStore()
+		vc.synced = append(vc.synced, informer.HasSynced)
+		informers = append(informers, informer)
+	}
+	return vc, informers
+}
+
+// newValuesInformer creates an informer watching a single ConfigMap.
+func newValuesInformer(client kubernetes.Interface, namespace string, name string) cache.SharedIndexInformer {
+	fieldSelector := fields.OneTermEqualSelector("metadata.name", name).String()
+	configMaps := client.CoreV1().ConfigMaps(namespace)
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.FieldSelector = fieldSelector
+				return configMaps.List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.FieldSelector = fieldSelector
+				return configMaps.Watch(options)
+			},
+		},
+		&corev1.ConfigMap{},
+		valuesResyncPeriod,
+		cache.Indexers{},
+	)
+}
+
+// hasSynced determines whether every namespace has been synced.
+func (vc *valuesCache) hasSynced() bool {
+	for _, synced := range vc.synced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+// get merges the cached ConfigMaps in the same way as getValues.
+func (vc *valuesCache) get() (map[string]string, string, error) {
+	values := make(map[string]string)
+	versions := []string{}
+	for _, namespace := range vc.namespaces {
+		obj, exists, err := vc.stores[namespace].GetByKey(podID(namespace, vc.name))
+		if err != nil {
+			return nil, "", fmt.Errorf("couldn't get configmap %s from cache: %v", podID(namespace, vc.name), err)
+		}
+		if !exists {
+			continue
+		}
+
+		cm, ok := obj.(*corev1.ConfigMap)
+		if !ok {
+			return nil, "", fmt.Errorf("unexpected object %T in values cache", obj)
+		}
+		versions = append(versions, fmt.Sprintf("%s@%s", podID(namespace, vc.name), cm.ResourceVersion))
+		for key, value := range cm.Data {
+			values[key] = value
+		}
+	}
+
+	if len(versions) == 0 {
+		return nil, "", &configMapNotFoundError{name: vc.name, namespaces: vc.namespaces}
+	}
+	return values, strings.Join(versions, ","), nil
+}
+
+// initializeValuesCache starts watching the Values ConfigMap, or refreshing
+// it periodically if ValuesRefreshInterval is set.
+// Until the cache has synced, values are read from the API server.
+func (ah *AdmissionHook) initializeValuesCache(stopCh <-chan struct{}) {
+	if ah.ValuesMapName == "" {
+		return
+	}
+	if ah.ValuesRefreshInterval > 0 {
+		ah.initializeValuesSnapshot(stopCh)
+		return
+	}
+
+	vc, informers := newValuesCache(ah.client, ah.valuesMapNamespaces(), ah.ValuesMapName)
+	for _, informer := range informers {
+		// The values are refreshed whenever the informer lists or resyncs the
+		// ConfigMap, as well as when it changes, so stop being refreshed if the
+		// informer stops
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				ah.valuesStatus.markRefreshed(time.Now())
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				ah.valuesStatus.markRefreshed(time.Now())
+			},
+		})
+		go informer.Run(stopCh)
+	}
+	ah.valuesCache = vc
+}
+
+// getMapValues reads the Values ConfigMap from the cache once it has synced,
+// and from the API server otherwise.
+func (ah *AdmissionHook) getMapValues() (map[string]string, string, error) {
+	if ah.valuesSnapshot != nil {
+		if values, version, ok := ah.valuesSnapshot.get(); ok {
+			return values, version, nil
+		}
+	}
+	if ah.valuesCache != nil && ah.valuesCache.hasSynced() {
+		return ah.valuesCache.get()
+	}
+	return getValues(ah.client, ah.valuesMapNamespaces(), ah.ValuesMapName)
+}
+
+// mapValuesOnce returns a function reading the Values ConfigMap with
+// getMapValues on its first call, and returning the same values after, so a
+// request reads a single version of it.
+func (ah *AdmissionHook) mapValuesOnce() func() (map[string]string, string, error) {
+	var values map[string]string
+	var version string
+	var err error
+	read := false
+	return func() (map[string]string, string, error) {
+		if !read {
+			values, version, err = ah.getMapValues()
+			read = true
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		// Copied, as callers modify the values they are given
+		copied := make(map[string]string, len(values))
+		for key, value := range values {
+			copied[key] = value
+		}
+		return copied, version, nil
+	}
+}
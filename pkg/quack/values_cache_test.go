@@ -0,0 +1,82 @@
+package quack
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestValuesCache(t *testing.T) {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "quack-values",
+			Namespace: "quack",
+		},
+		Data: map[string]string{"A": "alpha"},
+	}
+	client := fake.NewSimpleClientset(configMap)
+	watcher := watch.NewFake()
+	client.PrependWatchReactor("configmaps", clienttesting.DefaultWatchReactor(watcher, nil))
+	ah := &AdmissionHook{
+		client:             client,
+		ValuesMapName:      "quack-values",
+		ValuesMapNamespace: "quack",
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ah.initializeValuesCache(stopCh)
+	if !cache.WaitForCacheSync(stopCh, ah.valuesCache.hasSynced) {
+		assert.FailNowf(t, "methodError", "Values cache failed to sync")
+	}
+
+	values, _, err := ah.getMapValues()
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in getMapValues: %v", err)
+	}
+	assert.Equal(t, map[string]string{"A": "alpha"}, values, "Values should be read from the cache")
+
+	updated := configMap.DeepCopy()
+	updated.Data["A"] = "updated-alpha"
+	_, err = client.CoreV1().ConfigMaps("quack").Update(updated)
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error updating configmap: %v", err)
+	}
+	watcher.Modify(updated)
+
+	// The informer processes the update asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		values, _, err = ah.valuesCache.get()
+		if err == nil && values["A"] == "updated-alpha" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, map[string]string{"A": "updated-alpha"}, values, "Cached values should be updated")
+
+	// The informer's handlers are also called asynchronously
+	for time.Now().Before(deadline) && ah.valuesStatus.lastRefreshed().IsZero() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(t, ah.valuesStatus.lastRefreshed().IsZero(), "Values received by the informer should be marked refreshed")
+}
+
+func TestValuesCacheFallback(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.valuesCache, _ = newValuesCache(ah.client, ah.valuesMapNamespaces(), ah.ValuesMapName)
+
+	// The informers were never started, so the cache hasn't synced
+	values, _, err := ah.getMapValues()
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in getMapValues: %v", err)
+	}
+	assert.Equal(t, map[string]string{"A": "alpha"}, values, "Values should be read from the API server until the cache syncs")
+}
@@ -0,0 +1,90 @@
+package quack
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// valuesSnapshot holds the Values ConfigMap as last loaded, so values can be
+// read without a request to the API server when informers aren't used.
+type valuesSnapshot struct {
+	mutex   sync.RWMutex
+	load    func() (map[string]string, string, error)
+	status  *valuesStatus // Marked refreshed on each successful load, if set
+	values  map[string]string
+	version string
+	loaded  bool
+}
+
+// refresh replaces the snapshot with newly loaded values.
+// If loading fails, the last good snapshot is kept.
+func (s *valuesSnapshot) refresh() error {
+	values, version, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.values = values
+	s.version = version
+	s.loaded = true
+	if s.status != nil {
+		s.status.markRefreshed(time.Now())
+	}
+	return nil
+}
+
+// get returns a copy of the snapshot, and whether values have been loaded.
+func (s *valuesSnapshot) get() (map[string]string, string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if !s.loaded {
+		return nil, "", false
+	}
+
+	values := make(map[string]string, len(s.values))
+	for key, value := range s.values {
+		values[key] = value
+	}
+	return values, s.version, true
+}
+
+// run refreshes the snapshot every interval until stopCh is closed.
+func (s *valuesSnapshot) run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			err := s.refresh()
+			if err != nil {
+				glog.Errorf("Failed to refresh values, keeping the last values loaded: %v", err)
+			}
+		}
+	}
+}
+
+// initializeValuesSnapshot loads the Values ConfigMap, then refreshes it
+// every ValuesRefreshInterval.
+// Until values have been loaded, they are read from the API server.
+func (ah *AdmissionHook) initializeValuesSnapshot(stopCh <-chan struct{}) {
+	client, namespaces, name := ah.client, ah.valuesMapNamespaces(), ah.ValuesMapName
+	snapshot := &valuesSnapshot{
+		load: func() (map[string]string, string, error) {
+			return getValues(client, namespaces, name)
+		},
+		status: &ah.valuesStatus,
+	}
+
+	err := snapshot.refresh()
+	if err != nil {
+		glog.Errorf("Failed to load values, retrying in %s: %v", ah.ValuesRefreshInterval, err)
+	}
+	go snapshot.run(ah.ValuesRefreshInterval, stopCh)
+	ah.valuesSnapshot = snapshot
+}
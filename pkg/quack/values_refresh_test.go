@@ -0,0 +1,99 @@
+package quack
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValuesSnapshotRefresh(t *testing.T) {
+	values := map[string]string{"A": "alpha"}
+	snapshot := &valuesSnapshot{
+		load: func() (map[string]string, string, error) {
+			return values, "quack/quack-values@1", nil
+		},
+	}
+
+	_, _, ok := snapshot.get()
+	assert.False(t, ok, "Values should not be loaded before the first refresh")
+
+	err := snapshot.refresh()
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in refresh: %v", err)
+	}
+	loaded, version, ok := snapshot.get()
+	assert.True(t, ok, "Values should be loaded after a refresh")
+	assert.Equal(t, map[string]string{"A": "alpha"}, loaded, "Values should be loaded")
+	assert.Equal(t, "quack/quack-values@1", version, "Version should be loaded")
+
+	loaded["A"] = "modified"
+	loaded, _, _ = snapshot.get()
+	assert.Equal(t, "alpha", loaded["A"], "Modifying returned values should not modify the snapshot")
+}
+
+func TestValuesSnapshotRefreshFailure(t *testing.T) {
+	fail := false
+	snapshot := &valuesSnapshot{
+		load: func() (map[string]string, string, error) {
+			if fail {
+				return nil, "", fmt.Errorf("unavailable")
+			}
+			return map[string]string{"A": "alpha"}, "quack/quack-values@1", nil
+		},
+	}
+
+	err := snapshot.refresh()
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error in refresh: %v", err)
+	}
+
+	fail = true
+	err = snapshot.refresh()
+	assert.Error(t, err, "Refresh should fail")
+
+	loaded, version, ok := snapshot.get()
+	assert.True(t, ok, "Values should still be loaded")
+	assert.Equal(t, map[string]string{"A": "alpha"}, loaded, "The last values loaded should be kept")
+	assert.Equal(t, "quack/quack-values@1", version, "The last version loaded should be kept")
+}
+
+func TestInitializeValuesSnapshot(t *testing.T) {
+	ah := newTestAdmissionHook(map[string]string{"A": "alpha"})
+	ah.ValuesRefreshInterval = 10 * time.Millisecond
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ah.initializeValuesCache(stopCh)
+	assert.Nil(t, ah.valuesCache, "Values should not be watched")
+
+	// The values are loaded synchronously
+	values, _, ok := ah.valuesSnapshot.get()
+	assert.True(t, ok, "Values should be loaded on initialization")
+	assert.Equal(t, map[string]string{"A": "alpha"}, values, "Values should be loaded on initialization")
+	assert.False(t, ah.valuesStatus.lastRefreshed().IsZero(), "Values loaded by the snapshot should be marked refreshed")
+
+	_, err := ah.client.CoreV1().ConfigMaps("quack").Update(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "quack-values",
+			Namespace: "quack",
+		},
+		Data: map[string]string{"A": "updated-alpha"},
+	})
+	if err != nil {
+		assert.FailNowf(t, "methodError", "Error updating configmap: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		values, _, err = ah.getMapValues()
+		if err == nil && values["A"] == "updated-alpha" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, map[string]string{"A": "updated-alpha"}, values, "Values should be refreshed")
+}